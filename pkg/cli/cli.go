@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/m-mizutani/backstream/pkg/cli/config"
+	"github.com/m-mizutani/backstream/pkg/model"
 	"github.com/m-mizutani/backstream/pkg/utils/logging"
 	"github.com/m-mizutani/goerr/v2"
 	"github.com/urfave/cli/v3"
@@ -13,8 +14,9 @@ func Run(ctx context.Context, args []string) error {
 	var loggerCfg config.Logger
 	flags := loggerCfg.Flags()
 	app := cli.Command{
-		Name:  "backstream",
-		Flags: flags,
+		Name:    "backstream",
+		Version: model.AppVersion,
+		Flags:   flags,
 		Commands: []*cli.Command{
 			cmdClient(),
 			cmdServer(),
@@ -4,9 +4,11 @@ import (
 	"context"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/m-mizutani/backstream/pkg/controller/client"
 	"github.com/m-mizutani/backstream/pkg/service/tunnel"
+	"github.com/m-mizutani/backstream/pkg/utils/keepalive"
 	"github.com/m-mizutani/backstream/pkg/utils/logging"
 	"github.com/m-mizutani/goerr/v2"
 	"github.com/m-mizutani/harlog"
@@ -15,10 +17,24 @@ import (
 
 func cmdClient() *cli.Command {
 	var (
-		srcURL string
-		dstURL string
-		header []string
-		output string
+		srcURL       string
+		dstURL       string
+		rules        []string
+		tcpAddr      string
+		udpAddr      string
+		udpIdle      time.Duration
+		shutdownTO   time.Duration
+		tunnelName   string
+		pathPrefixes []string
+		stripPrefix  bool
+		mirror       bool
+		maxInFlight  int64
+		maxAttempts  int64
+		pingInterval time.Duration
+		pingTimeout  time.Duration
+		header       []string
+		output       string
+		preserveHost bool
 	)
 
 	cmd := &cli.Command{
@@ -36,11 +52,94 @@ func cmdClient() *cli.Command {
 			&cli.StringFlag{
 				Name:        "dst",
 				Aliases:     []string{"d"},
-				Usage:       "Destination URL",
+				Usage:       "Destination URL. It's the default destination of requests that match no --rule",
 				Sources:     cli.EnvVars("BACKSTREAM_DST_URL"),
-				Required:    true,
 				Destination: &dstURL,
 			},
+			&cli.StringSliceFlag{
+				Name:        "rule",
+				Usage:       "Destination rule in '<condition>[,<condition>...]=<url>' format. Condition is one of 'path:<prefix>', 'host:<name>', 'method:<method>' and 'strip' to remove the path prefix, e.g. 'path:/api,strip=http://localhost:8080'. It can be specified multiple times and the first matched rule is used",
+				Sources:     cli.EnvVars("BACKSTREAM_RULE"),
+				Destination: &rules,
+			},
+			&cli.StringFlag{
+				Name:        "tcp",
+				Usage:       "Destination TCP address, e.g. 'localhost:5432'. The server relays raw TCP connections instead of HTTP requests",
+				Sources:     cli.EnvVars("BACKSTREAM_TCP_ADDR"),
+				Destination: &tcpAddr,
+			},
+			&cli.StringFlag{
+				Name:        "udp",
+				Usage:       "Destination UDP address, e.g. 'localhost:53'. The server relays UDP datagrams instead of HTTP requests",
+				Sources:     cli.EnvVars("BACKSTREAM_UDP_ADDR"),
+				Destination: &udpAddr,
+			},
+			&cli.IntFlag{
+				Name:        "max-in-flight",
+				Usage:       "Max number of requests sent to the destination concurrently",
+				Value:       client.DefaultMaxInFlight,
+				Sources:     cli.EnvVars("BACKSTREAM_MAX_IN_FLIGHT"),
+				Destination: &maxInFlight,
+			},
+			&cli.IntFlag{
+				Name:        "max-reconnect-attempts",
+				Usage:       "Max number of consecutive reconnect attempts when the connection is lost. 0 means no limit",
+				Sources:     cli.EnvVars("BACKSTREAM_MAX_RECONNECT_ATTEMPTS"),
+				Destination: &maxAttempts,
+			},
+			&cli.DurationFlag{
+				Name:        "ping-interval",
+				Usage:       "Interval of WebSocket pings to keep the tunnel alive. 0 disables pings",
+				Value:       keepalive.DefaultInterval,
+				Sources:     cli.EnvVars("BACKSTREAM_PING_INTERVAL"),
+				Destination: &pingInterval,
+			},
+			&cli.DurationFlag{
+				Name:        "ping-timeout",
+				Usage:       "Max duration without any message from the peer before the connection is regarded as dead",
+				Value:       keepalive.DefaultTimeout,
+				Sources:     cli.EnvVars("BACKSTREAM_PING_TIMEOUT"),
+				Destination: &pingTimeout,
+			},
+			&cli.DurationFlag{
+				Name:        "udp-idle-timeout",
+				Usage:       "Duration to keep a UDP session of a remote peer without any datagram",
+				Value:       client.DefaultUDPIdleTimeout,
+				Sources:     cli.EnvVars("BACKSTREAM_UDP_IDLE_TIMEOUT"),
+				Destination: &udpIdle,
+			},
+			&cli.DurationFlag{
+				Name:        "shutdown-timeout",
+				Usage:       "Max duration to wait for in-flight requests on SIGTERM or SIGINT",
+				Value:       client.DefaultShutdownTimeout,
+				Sources:     cli.EnvVars("BACKSTREAM_SHUTDOWN_TIMEOUT"),
+				Destination: &shutdownTO,
+			},
+			&cli.StringFlag{
+				Name:        "tunnel",
+				Aliases:     []string{"t"},
+				Usage:       "Name of tunnel to subscribe. If it's not set, the server assigns a random subdomain with virtual hosting, or 'default' tunnel otherwise",
+				Sources:     cli.EnvVars("BACKSTREAM_TUNNEL"),
+				Destination: &tunnelName,
+			},
+			&cli.StringSliceFlag{
+				Name:        "path-prefix",
+				Usage:       "Path prefix to be routed to this client, e.g. '/github-webhook'. It can be specified multiple times",
+				Sources:     cli.EnvVars("BACKSTREAM_PATH_PREFIX"),
+				Destination: &pathPrefixes,
+			},
+			&cli.BoolFlag{
+				Name:        "strip-prefix",
+				Usage:       "Remove the path prefix from the request path before forwarding",
+				Sources:     cli.EnvVars("BACKSTREAM_STRIP_PREFIX"),
+				Destination: &stripPrefix,
+			},
+			&cli.BoolFlag{
+				Name:        "mirror",
+				Usage:       "Join the tunnel as a mirror that receives copies of requests. Responses are compared with the primary client by the server and never returned to callers",
+				Sources:     cli.EnvVars("BACKSTREAM_MIRROR"),
+				Destination: &mirror,
+			},
 			&cli.StringSliceFlag{
 				Name:        "header",
 				Aliases:     []string{"H"},
@@ -54,10 +153,35 @@ func cmdClient() *cli.Command {
 				Usage:       "Directory to save HAR files",
 				Destination: &output,
 			},
+			&cli.BoolFlag{
+				Name:        "preserve-host",
+				Usage:       "Send the Host header of the original request to the destination",
+				Sources:     cli.EnvVars("BACKSTREAM_PRESERVE_HOST"),
+				Destination: &preserveHost,
+			},
 		},
 		Usage: "Start backstream client",
 
 		Action: func(ctx context.Context, cmd *cli.Command) error {
+			var destinations int
+			for _, v := range []string{dstURL, tcpAddr, udpAddr} {
+				if v != "" {
+					destinations++
+				}
+			}
+			switch {
+			case destinations == 0 && len(rules) == 0:
+				return goerr.New("one of --dst, --rule, --tcp or --udp is required")
+			case destinations > 1:
+				return goerr.New("only one of --dst, --tcp and --udp can be specified")
+			case len(rules) > 0 && (tcpAddr != "" || udpAddr != ""):
+				return goerr.New("--rule is available only for HTTP destinations")
+			case tcpAddr != "":
+				dstURL = "tcp://" + tcpAddr
+			case udpAddr != "":
+				dstURL = "udp://" + udpAddr
+			}
+
 			var tunnelOptions []tunnel.Option
 			if output != "" {
 				logger := harlog.New(
@@ -69,9 +193,33 @@ func cmdClient() *cli.Command {
 				}
 				tunnelOptions = append(tunnelOptions, tunnel.WithHTTPClient(httpClient))
 			}
+			if preserveHost {
+				tunnelOptions = append(tunnelOptions, tunnel.WithPreserveHost())
+			}
+			for _, v := range rules {
+				rule, err := tunnel.ParseRule(v)
+				if err != nil {
+					return err
+				}
+				tunnelOptions = append(tunnelOptions, tunnel.WithRules(rule))
+			}
 			svc := tunnel.New(dstURL, tunnelOptions...)
 
-			var options []client.Option
+			options := []client.Option{
+				client.WithUDPIdleTimeout(udpIdle),
+				client.WithMaxInFlight(int(maxInFlight)),
+				client.WithMaxReconnectAttempts(int(maxAttempts)),
+				client.WithKeepalive(pingInterval, pingTimeout),
+				client.WithShutdownTimeout(shutdownTO),
+				client.WithTunnel(tunnelName),
+				client.WithPathPrefix(pathPrefixes...),
+			}
+			if stripPrefix {
+				options = append(options, client.WithStripPrefix())
+			}
+			if mirror {
+				options = append(options, client.WithMirror())
+			}
 			for _, h := range header {
 				parts := strings.Split(h, ":")
 				if len(parts) != 2 {
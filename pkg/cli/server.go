@@ -2,14 +2,25 @@ package cli
 
 import (
 	"context"
+	"expvar"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/m-mizutani/backstream/pkg/controller/server"
 	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/m-mizutani/backstream/pkg/service/inbox"
+	"github.com/m-mizutani/backstream/pkg/utils/keepalive"
 	"github.com/m-mizutani/backstream/pkg/utils/logging"
 	"github.com/m-mizutani/goerr/v2"
 	"github.com/m-mizutani/opaq"
+	"github.com/redis/go-redis/v9"
 	"github.com/urfave/cli/v3"
 )
 
@@ -18,6 +29,33 @@ func cmdServer() *cli.Command {
 		addr         string
 		policyPath   []string
 		noClientCode int64
+		readTimeout  time.Duration
+		writeTimeout time.Duration
+		respTimeout  time.Duration
+		pingInterval time.Duration
+		pingTimeout  time.Duration
+		tcpPorts     string
+		udpPorts     string
+		routes       []string
+		virtualHost  string
+		strategies   []string
+		redisURL     string
+		redisPrefix  string
+		peerSelf     string
+		peerURLs     []string
+		peerSecret   string
+		gossipIntvl  time.Duration
+		holdTimeout  time.Duration
+		holdSize     int64
+		metricsAddr  string
+		inboxPath    string
+		inboxCode    int64
+		inboxBody    string
+		inboxRetain  time.Duration
+		inboxEntries int64
+		inboxMaxBody int64
+
+		shutdownTimeout time.Duration
 	)
 
 	cmd := &cli.Command{
@@ -48,6 +86,173 @@ func cmdServer() *cli.Command {
 				Sources:     cli.EnvVars("BACKSTREAM_NO_CLIENT_CODE"),
 				Destination: &noClientCode,
 			},
+			&cli.DurationFlag{
+				Name:        "read-timeout",
+				Usage:       "Max duration to read an entire request including body. 0 means no limit",
+				Sources:     cli.EnvVars("BACKSTREAM_READ_TIMEOUT"),
+				Destination: &readTimeout,
+			},
+			&cli.DurationFlag{
+				Name:        "write-timeout",
+				Usage:       "Max duration to write an entire response including body. 0 means no limit",
+				Sources:     cli.EnvVars("BACKSTREAM_WRITE_TIMEOUT"),
+				Destination: &writeTimeout,
+			},
+			&cli.DurationFlag{
+				Name:        "response-timeout",
+				Usage:       "Max duration to wait for a response head from the client. The server returns 504 if it exceeded. 0 means no limit",
+				Sources:     cli.EnvVars("BACKSTREAM_RESPONSE_TIMEOUT"),
+				Destination: &respTimeout,
+			},
+			&cli.DurationFlag{
+				Name:        "ping-interval",
+				Usage:       "Interval of WebSocket pings to keep the tunnel alive. 0 disables pings",
+				Value:       keepalive.DefaultInterval,
+				Sources:     cli.EnvVars("BACKSTREAM_PING_INTERVAL"),
+				Destination: &pingInterval,
+			},
+			&cli.DurationFlag{
+				Name:        "ping-timeout",
+				Usage:       "Max duration without any message from the peer before the connection is regarded as dead",
+				Value:       keepalive.DefaultTimeout,
+				Sources:     cli.EnvVars("BACKSTREAM_PING_TIMEOUT"),
+				Destination: &pingTimeout,
+			},
+			&cli.StringFlag{
+				Name:        "tcp-ports",
+				Usage:       "Port range for TCP tunnels, e.g. '10000-10100'. TCP tunnels are disabled if not set",
+				Sources:     cli.EnvVars("BACKSTREAM_TCP_PORTS"),
+				Destination: &tcpPorts,
+			},
+			&cli.StringFlag{
+				Name:        "udp-ports",
+				Usage:       "Port range for UDP tunnels, e.g. '20000-20100'. UDP tunnels are disabled if not set",
+				Sources:     cli.EnvVars("BACKSTREAM_UDP_PORTS"),
+				Destination: &udpPorts,
+			},
+			&cli.StringSliceFlag{
+				Name:        "route",
+				Aliases:     []string{"r"},
+				Usage:       "Route of public requests to a tunnel in '<tunnel>=<kind>:<pattern>' format, e.g. 'alice=host:alice.example.com', 'github=path:/github' or 'bob=header:X-Tunnel:bob'. Requests that match no route are sent to 'default' tunnel",
+				Sources:     cli.EnvVars("BACKSTREAM_ROUTE"),
+				Destination: &routes,
+			},
+			&cli.StringFlag{
+				Name:        "virtual-host",
+				Usage:       "Base URL of subdomain based virtual hosting, e.g. 'https://tunnel.example.com'. A request to '<tunnel>.tunnel.example.com' is routed to the tunnel",
+				Sources:     cli.EnvVars("BACKSTREAM_VIRTUAL_HOST"),
+				Destination: &virtualHost,
+			},
+			&cli.StringSliceFlag{
+				Name:        "strategy",
+				Usage:       "Load balancing strategy among clients of a tunnel in '<tunnel>=<strategy>' format, or '<strategy>' for all tunnels. Strategy is one of round-robin (default), least-in-flight and random",
+				Sources:     cli.EnvVars("BACKSTREAM_STRATEGY"),
+				Destination: &strategies,
+			},
+			&cli.StringFlag{
+				Name:        "redis-url",
+				Usage:       "Redis URL to share clients among server replicas, e.g. 'redis://localhost:6379/0'. A request to any replica is routed to a client connected to another replica",
+				Sources:     cli.EnvVars("BACKSTREAM_REDIS_URL"),
+				Destination: &redisURL,
+			},
+			&cli.StringFlag{
+				Name:        "redis-prefix",
+				Usage:       "Prefix of Redis keys and channels",
+				Value:       hub.DefaultRedisPrefix,
+				Sources:     cli.EnvVars("BACKSTREAM_REDIS_PREFIX"),
+				Destination: &redisPrefix,
+			},
+			&cli.StringSliceFlag{
+				Name:        "peer",
+				Usage:       "URL of another server replica to forward requests for tunnels without local clients, e.g. 'http://10.0.0.2:8080'. It can be specified multiple times",
+				Sources:     cli.EnvVars("BACKSTREAM_PEERS"),
+				Destination: &peerURLs,
+			},
+			&cli.StringFlag{
+				Name:        "peer-self",
+				Usage:       "URL of this replica to be reached from peers. Required with --peer",
+				Sources:     cli.EnvVars("BACKSTREAM_PEER_SELF"),
+				Destination: &peerSelf,
+			},
+			&cli.StringFlag{
+				Name:        "peer-secret",
+				Usage:       "Shared secret to authenticate requests between peers. Required with --peer",
+				Sources:     cli.EnvVars("BACKSTREAM_PEER_SECRET"),
+				Destination: &peerSecret,
+			},
+			&cli.DurationFlag{
+				Name:        "gossip-interval",
+				Usage:       "Interval to exchange tunnels with peers",
+				Value:       server.DefaultGossipInterval,
+				Sources:     cli.EnvVars("BACKSTREAM_GOSSIP_INTERVAL"),
+				Destination: &gossipIntvl,
+			},
+			&cli.DurationFlag{
+				Name:        "hold-timeout",
+				Usage:       "Max duration to hold a request while the tunnel has no client, to deliver it when a client joins. 0 disables holding",
+				Sources:     cli.EnvVars("BACKSTREAM_HOLD_TIMEOUT"),
+				Destination: &holdTimeout,
+			},
+			&cli.IntFlag{
+				Name:        "hold-queue-size",
+				Usage:       "Max number of requests held at once. Requests over it are answered as no client immediately",
+				Value:       server.DefaultHoldQueueSize,
+				Sources:     cli.EnvVars("BACKSTREAM_HOLD_QUEUE_SIZE"),
+				Destination: &holdSize,
+			},
+			&cli.StringFlag{
+				Name:        "metrics-addr",
+				Usage:       "Listen address of metrics in expvar JSON format at /debug/vars and delivery status of inbox at /inbox, e.g. 'localhost:9090'. Metrics are disabled if not set",
+				Sources:     cli.EnvVars("BACKSTREAM_METRICS_ADDR"),
+				Destination: &metricsAddr,
+			},
+			&cli.StringFlag{
+				Name:        "inbox",
+				Usage:       "File path of durable inbox. Requests while no client is connected are stored in it and replayed in order when a client joins. Inbox is disabled if not set",
+				Sources:     cli.EnvVars("BACKSTREAM_INBOX"),
+				Destination: &inboxPath,
+			},
+			&cli.IntFlag{
+				Name:        "inbox-ack-code",
+				Usage:       "HTTP status code of the response to a request stored in inbox",
+				Value:       server.DefaultInboxAckCode,
+				Sources:     cli.EnvVars("BACKSTREAM_INBOX_ACK_CODE"),
+				Destination: &inboxCode,
+			},
+			&cli.StringFlag{
+				Name:        "inbox-ack-body",
+				Usage:       "Body of the response to a request stored in inbox",
+				Sources:     cli.EnvVars("BACKSTREAM_INBOX_ACK_BODY"),
+				Destination: &inboxBody,
+			},
+			&cli.DurationFlag{
+				Name:        "inbox-retention",
+				Usage:       "Duration to keep requests in inbox. Requests not delivered within it are discarded",
+				Value:       inbox.DefaultRetention,
+				Sources:     cli.EnvVars("BACKSTREAM_INBOX_RETENTION"),
+				Destination: &inboxRetain,
+			},
+			&cli.IntFlag{
+				Name:        "inbox-max-entries",
+				Usage:       "Max number of requests in inbox. Delivered requests are removed from the oldest to store a new one",
+				Value:       inbox.DefaultMaxEntries,
+				Sources:     cli.EnvVars("BACKSTREAM_INBOX_MAX_ENTRIES"),
+				Destination: &inboxEntries,
+			},
+			&cli.IntFlag{
+				Name:        "inbox-max-body-size",
+				Usage:       "Max size of a request body in bytes to be stored in inbox",
+				Value:       inbox.DefaultMaxBodySize,
+				Sources:     cli.EnvVars("BACKSTREAM_INBOX_MAX_BODY_SIZE"),
+				Destination: &inboxMaxBody,
+			},
+			&cli.DurationFlag{
+				Name:        "shutdown-timeout",
+				Usage:       "Max duration to wait for in-flight requests on SIGTERM or SIGINT before closing client connections",
+				Value:       8 * time.Second,
+				Sources:     cli.EnvVars("BACKSTREAM_SHUTDOWN_TIMEOUT"),
+				Destination: &shutdownTimeout,
+			},
 		},
 		Action: func(ctx context.Context, cmd *cli.Command) error {
 			var serverOptions []server.Option
@@ -59,22 +264,182 @@ func cmdServer() *cli.Command {
 				serverOptions = append(serverOptions, server.WithPolicy(policy))
 			}
 
-			serverOptions = append(serverOptions, server.WithNoClientCode(noClientCode))
+			serverOptions = append(serverOptions,
+				server.WithNoClientCode(noClientCode),
+				server.WithResponseTimeout(respTimeout),
+				server.WithKeepalive(pingInterval, pingTimeout),
+			)
 
-			svc := hub.New()
+			if holdTimeout > 0 {
+				if holdSize < 1 {
+					return goerr.New("--hold-queue-size must be positive", goerr.V("size", holdSize))
+				}
+				serverOptions = append(serverOptions, server.WithHold(holdTimeout, int(holdSize)))
+			}
+
+			for _, v := range routes {
+				route, err := server.ParseRoute(v)
+				if err != nil {
+					return err
+				}
+				serverOptions = append(serverOptions, server.WithRoutes(route))
+			}
+
+			if virtualHost != "" {
+				base, err := url.Parse(virtualHost)
+				if err != nil {
+					return goerr.Wrap(err, "failed to parse virtual host URL", goerr.V("virtual_host", virtualHost))
+				}
+				if base.Scheme == "" || base.Hostname() == "" {
+					return goerr.New("virtual host must be a URL with scheme and host", goerr.V("virtual_host", virtualHost))
+				}
+				serverOptions = append(serverOptions, server.WithVirtualHost(base))
+			}
+
+			if tcpPorts != "" || udpPorts != "" {
+				host, _, err := net.SplitHostPort(addr)
+				if err != nil {
+					return goerr.Wrap(err, "failed to parse listen address", goerr.V("addr", addr))
+				}
+
+				if tcpPorts != "" {
+					min, max, err := parsePortRange(tcpPorts)
+					if err != nil {
+						return err
+					}
+					serverOptions = append(serverOptions, server.WithTCPPorts(host, min, max))
+				}
+				if udpPorts != "" {
+					min, max, err := parsePortRange(udpPorts)
+					if err != nil {
+						return err
+					}
+					serverOptions = append(serverOptions, server.WithUDPPorts(host, min, max))
+				}
+			}
+
+			if len(peerURLs) > 0 {
+				if peerSelf == "" || peerSecret == "" {
+					return goerr.New("--peer-self and --peer-secret are required with --peer")
+				}
+				for _, v := range append([]string{peerSelf}, peerURLs...) {
+					u, err := url.Parse(v)
+					if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+						return goerr.New("peer must be HTTP or HTTPS URL", goerr.V("peer", v))
+					}
+				}
+				serverOptions = append(serverOptions,
+					server.WithPeers(peerSelf, peerURLs, peerSecret),
+					server.WithGossipInterval(gossipIntvl),
+				)
+			}
+
+			if inboxPath != "" {
+				if inboxCode < 100 || inboxCode > 599 {
+					return goerr.New("--inbox-ack-code must be a valid HTTP status code", goerr.V("code", inboxCode))
+				}
+				box, err := inbox.Open(inboxPath,
+					inbox.WithRetention(inboxRetain),
+					inbox.WithMaxEntries(int(inboxEntries)),
+					inbox.WithMaxBodySize(inboxMaxBody),
+				)
+				if err != nil {
+					return err
+				}
+				defer box.Close()
+				serverOptions = append(serverOptions, server.WithInbox(box, int(inboxCode), inboxBody))
+			}
+
+			var hubOptions []hub.Option
+			for _, v := range strategies {
+				tunnel, name, found := strings.Cut(v, "=")
+				if !found {
+					name = tunnel
+				}
+				strategy, err := hub.ParseStrategy(name)
+				if err != nil {
+					return err
+				}
+				if found {
+					hubOptions = append(hubOptions, hub.WithStrategy(tunnel, strategy))
+				} else {
+					hubOptions = append(hubOptions, hub.WithDefaultStrategy(strategy))
+				}
+			}
+
+			if redisURL != "" {
+				opt, err := redis.ParseURL(redisURL)
+				if err != nil {
+					return goerr.Wrap(err, "failed to parse Redis URL")
+				}
+				rc := redis.NewClient(opt)
+				defer rc.Close()
+				if err := rc.Ping(ctx).Err(); err != nil {
+					return goerr.Wrap(err, "failed to connect to Redis", goerr.V("addr", opt.Addr))
+				}
+				hubOptions = append(hubOptions, hub.WithBackend(hub.NewRedisBackend(rc, hub.WithRedisPrefix(redisPrefix))))
+			}
+
+			svc := hub.New(hubOptions...)
+			defer svc.Close()
 			s := server.New(svc, serverOptions...)
 
-			logging.Extract(ctx).Info("Start server", "addr", addr)
+			logger := logging.Extract(ctx)
+			logger.Info("Start server", "addr", addr)
+
+			if metricsAddr != "" {
+				expvar.Publish("hold", expvar.Func(func() any { return s.HoldStats() }))
+				mux := http.NewServeMux()
+				mux.Handle("/debug/vars", expvar.Handler())
+				mux.Handle("/inbox", s.InboxHandler())
+				mux.Handle("/inbox/", s.InboxHandler())
+				metrics := &http.Server{Addr: metricsAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+				defer metrics.Close()
+				go func() {
+					if err := metrics.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+						logger.Error("failed to serve metrics", "error", err, "addr", metricsAddr)
+					}
+				}()
+				logger.Info("Start metrics server", "addr", metricsAddr)
+			}
 
+			// Request and response bodies are streamed, so ReadTimeout and WriteTimeout are disabled by default not to cut off large or long-lived transfers.
 			server := &http.Server{
-				Addr:         addr,
-				Handler:      s,
-				ReadTimeout:  10 * time.Second,
-				WriteTimeout: 30 * time.Second,
+				Addr:              addr,
+				Handler:           s,
+				ReadHeaderTimeout: 10 * time.Second,
+				ReadTimeout:       readTimeout,
+				WriteTimeout:      writeTimeout,
 			}
 
-			if err := server.ListenAndServe(); err != nil {
+			sigCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- server.ListenAndServe()
+			}()
+
+			select {
+			case err := <-errCh:
 				return goerr.Wrap(err, "failed to listen and serve")
+			case <-sigCtx.Done():
+			}
+
+			logger.Info("Shutting down server", "timeout", shutdownTimeout)
+			shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+			defer cancel()
+
+			// http.Server stops listening and waits for plain HTTP requests, but it does not track hijacked WebSocket connections of clients. They are closed by the backstream server.
+			httpErrCh := make(chan error, 1)
+			go func() {
+				httpErrCh <- server.Shutdown(shutdownCtx)
+			}()
+			if err := s.Shutdown(shutdownCtx); err != nil {
+				return err
+			}
+			if err := <-httpErrCh; err != nil {
+				return goerr.Wrap(err, "failed to shut down HTTP server")
 			}
 
 			return nil
@@ -83,3 +448,25 @@ func cmdServer() *cli.Command {
 
 	return cmd
 }
+
+// parsePortRange parses a port range in "min-max" format. A single port is also accepted.
+func parsePortRange(v string) (int, int, error) {
+	minStr, maxStr, found := strings.Cut(v, "-")
+	if !found {
+		maxStr = minStr
+	}
+
+	min, err := strconv.Atoi(strings.TrimSpace(minStr))
+	if err != nil {
+		return 0, 0, goerr.Wrap(err, "invalid port range", goerr.V("range", v))
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(maxStr))
+	if err != nil {
+		return 0, 0, goerr.Wrap(err, "invalid port range", goerr.V("range", v))
+	}
+	if min < 1 || max > 65535 || min > max {
+		return 0, 0, goerr.New("invalid port range", goerr.V("range", v))
+	}
+
+	return min, max, nil
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/goerr/v2"
+)
+
+// handshakeTimeout is a max duration to wait for the welcome frame from the server.
+const handshakeTimeout = 10 * time.Second
+
+var ErrIncompatible = errors.New("incompatible with server")
+
+// handshake sends the hello frame and waits for the welcome frame from the server.
+func handshake(conn *websocket.Conn, codec model.Codec) (*model.Welcome, error) {
+	hello := &model.Frame{
+		Type: model.FrameHello,
+		Hello: &model.Hello{
+			ProtocolVersion: model.ProtocolVersion,
+			ClientVersion:   model.AppVersion,
+			Features:        []model.Feature{model.FeatureStreaming, model.FeatureBinary, model.FeatureDrain},
+		},
+	}
+	messageType, message, err := codec.Encode(hello)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.WriteMessage(messageType, message); err != nil {
+		return nil, goerr.Wrap(err, "failed to write hello")
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return nil, goerr.Wrap(err, "failed to set read deadline")
+	}
+	messageType, message, err = conn.ReadMessage()
+	if err != nil {
+		var closeErr *websocket.CloseError
+		switch {
+		case errors.As(err, &closeErr) && closeErr.Code == model.CloseIncompatible:
+			return nil, goerr.Wrap(ErrIncompatible, "server rejected the client", goerr.V("reason", closeErr.Text), goerr.V("client_version", model.AppVersion))
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			return nil, goerr.Wrap(ErrIncompatible, "server did not reply to hello, it may be an older version", goerr.V("client_version", model.AppVersion))
+		}
+		return nil, goerr.Wrap(err, "failed to read welcome")
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, goerr.Wrap(err, "failed to reset read deadline")
+	}
+
+	frame, err := model.DecodeFrame(messageType, message)
+	if err != nil {
+		return nil, err
+	}
+	if frame.Type != model.FrameWelcome || frame.Welcome == nil {
+		return nil, goerr.Wrap(ErrIncompatible, "unexpected frame instead of welcome", goerr.V("type", frame.Type))
+	}
+
+	welcome := frame.Welcome
+	if !model.IsCompatibleProtocol(welcome.ProtocolVersion) {
+		return nil, goerr.Wrap(ErrIncompatible, "protocol version of server is not supported",
+			goerr.V("server_protocol_version", welcome.ProtocolVersion),
+			goerr.V("server_version", welcome.ServerVersion),
+			goerr.V("client_version", model.AppVersion),
+		)
+	}
+
+	return welcome, nil
+}
@@ -2,26 +2,48 @@ package client
 
 import (
 	"context"
-	"encoding/json"
-	"log/slog"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/m-mizutani/backstream/pkg/model"
 	"github.com/m-mizutani/backstream/pkg/service/tunnel"
+	"github.com/m-mizutani/backstream/pkg/utils/keepalive"
 	"github.com/m-mizutani/backstream/pkg/utils/logging"
 	"github.com/m-mizutani/goerr/v2"
 )
 
 type Option func(*Client)
 
+// DefaultMaxInFlight is a default max number of HTTP requests sent to the local application concurrently.
+const DefaultMaxInFlight = 32
+
 type Client struct {
-	svc    *tunnel.Service
-	srcURL string
-	header http.Header
+	svc            *tunnel.Service
+	srcURL         string
+	header         http.Header
+	udpIdleTimeout time.Duration
+	maxInFlight    int
+	codecs         []model.Codec
+	tunnel         string
+	pathPrefixes   []string
+	stripPrefix    bool
+	mirror         bool
+	reconnect      backoff
+	keepalive      keepalive.Config
+
+	shutdownTimeout time.Duration
+	draining        chan struct{}
+	drainOnce       sync.Once
 }
 
 func WithHeader(key, value string) Option {
@@ -30,11 +52,100 @@ func WithHeader(key, value string) Option {
 	}
 }
 
+// WithUDPIdleTimeout sets a duration to keep a UDP session of a remote peer without any datagram. The default is DefaultUDPIdleTimeout.
+func WithUDPIdleTimeout(d time.Duration) Option {
+	return func(x *Client) {
+		x.udpIdleTimeout = d
+	}
+}
+
+// WithMaxInFlight sets the max number of HTTP requests sent to the local application concurrently. Requests over the limit wait until others complete. The default is DefaultMaxInFlight.
+func WithMaxInFlight(n int) Option {
+	return func(x *Client) {
+		x.maxInFlight = n
+	}
+}
+
+// WithMaxReconnectAttempts sets the max number of consecutive reconnect attempts. Connect returns an error when all attempts failed. 0 means no limit, and it's the default.
+func WithMaxReconnectAttempts(n int) Option {
+	return func(x *Client) {
+		x.reconnect.maxAttempts = n
+	}
+}
+
+// WithReconnectDelay sets the initial and max delay of reconnect. The delay is doubled on each failed attempt up to max with jitter.
+func WithReconnectDelay(initial, max time.Duration) Option {
+	return func(x *Client) {
+		x.reconnect.initial = initial
+		x.reconnect.max = max
+	}
+}
+
+// WithKeepalive sets an interval of pings to the server and a timeout to regard the connection as dead without any message. The client reconnects after the timeout. The default is keepalive.Default(), and interval 0 disables keepalive.
+func WithKeepalive(interval, timeout time.Duration) Option {
+	return func(x *Client) {
+		x.keepalive = keepalive.Config{Interval: interval, Timeout: timeout}
+	}
+}
+
+// WithCodecs sets codecs of frames that the client accepts in order of preference. The default is binary and then JSON.
+func WithCodecs(codecs ...model.Codec) Option {
+	return func(x *Client) {
+		x.codecs = codecs
+	}
+}
+
+// WithTunnel sets a name of tunnel that the client subscribes. The server routes public requests to the tunnel by its routes or subdomain. If it's not set, the server assigns a random name with virtual hosting, or model.DefaultTunnel otherwise.
+func WithTunnel(name string) Option {
+	return func(x *Client) {
+		x.tunnel = name
+	}
+}
+
+// WithPathPrefix registers path prefixes on the server so that public requests under them are routed to the client, e.g. "/github-webhook". The longest prefix wins, and the connection is rejected if another client already registered the prefix.
+func WithPathPrefix(prefixes ...string) Option {
+	return func(x *Client) {
+		x.pathPrefixes = append(x.pathPrefixes, prefixes...)
+	}
+}
+
+// WithStripPrefix makes the server remove the registered path prefix from the request path, e.g. "/slack/events" is forwarded as "/events".
+func WithStripPrefix() Option {
+	return func(x *Client) {
+		x.stripPrefix = true
+	}
+}
+
+// WithMirror makes the client a mirror of the tunnel. The mirror receives a copy of each request sent to the primary client of the tunnel, and the server logs differences of the responses. Responses of the mirror are never returned to callers.
+func WithMirror() Option {
+	return func(x *Client) {
+		x.mirror = true
+	}
+}
+
+// WithShutdownTimeout sets a max duration to wait for in-flight requests on shutdown. Requests remaining after the timeout are aborted. The default is DefaultShutdownTimeout.
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(x *Client) {
+		x.shutdownTimeout = d
+	}
+}
+
 func New(svc *tunnel.Service, src string, opts ...Option) *Client {
 	x := &Client{
 		svc:    svc,
 		srcURL: src,
 		header: http.Header{},
+
+		udpIdleTimeout: DefaultUDPIdleTimeout,
+		maxInFlight:    DefaultMaxInFlight,
+		codecs:         []model.Codec{model.CodecBinary, model.CodecJSON},
+		keepalive:      keepalive.Default(),
+		reconnect: backoff{
+			initial: DefaultReconnectInitialDelay,
+			max:     DefaultReconnectMaxDelay,
+		},
+		shutdownTimeout: DefaultShutdownTimeout,
+		draining:        make(chan struct{}),
 	}
 	for _, opt := range opts {
 		opt(x)
@@ -42,6 +153,7 @@ func New(svc *tunnel.Service, src string, opts ...Option) *Client {
 	return x
 }
 
+// Connect connects to the server and relays requests until ctx is canceled or Shutdown is called. SIGINT and SIGTERM trigger Shutdown, and the second signal aborts in-flight requests immediately. The connection is re-established with backoff when it's lost.
 func (x *Client) Connect(ctx context.Context) error {
 	logger := logging.Extract(ctx)
 
@@ -49,85 +161,194 @@ func (x *Client) Connect(ctx context.Context) error {
 	if err != nil {
 		return goerr.Wrap(err, "failed to convert URL")
 	}
+	if x.tunnel != "" {
+		if err := model.ValidateTunnelName(x.tunnel); err != nil {
+			return err
+		}
+	}
 
 	headers := x.header.Clone()
 	headers.Add("Backstream-Client", "default")
+	headers.Set(model.HeaderTunnelMode, string(x.svc.Mode()))
+	if x.tunnel != "" {
+		headers.Set(model.HeaderTunnel, x.tunnel)
+	}
+	if x.mirror {
+		headers.Set(model.HeaderMirror, "true")
+	}
+	if len(x.pathPrefixes) > 0 {
+		headers.Set(model.HeaderPathPrefix, strings.Join(x.pathPrefixes, ", "))
+		if x.stripPrefix {
+			headers.Set(model.HeaderStripPrefix, "true")
+		}
+	}
+	codecs := make([]string, len(x.codecs))
+	for i, c := range x.codecs {
+		codecs[i] = string(c)
+	}
+	headers.Set(model.HeaderCodec, strings.Join(codecs, ", "))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case sig := <-interrupt:
+			logger.Info("Quit signal received, shutting down", "signal", sig, "timeout", x.shutdownTimeout)
+			x.Shutdown()
+		case <-ctx.Done():
+			return
+		}
+
+		select {
+		case <-interrupt:
+			logger.Info("Quit signal received again, aborting")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for attempt := 1; ; attempt++ {
+		connected, err := x.connect(ctx, wsURL, headers)
+		if ctx.Err() != nil {
+			logger.Info("Context canceled")
+			return nil
+		}
+		if x.isDraining() {
+			logger.Info("Client is shut down")
+			return err
+		}
+		if !isRetryable(err) {
+			return err
+		}
+		if connected {
+			attempt = 1
+		}
+		if x.reconnect.maxAttempts > 0 && attempt > x.reconnect.maxAttempts {
+			return goerr.Wrap(err, "gave up reconnecting", goerr.V("attempts", attempt-1))
+		}
 
-	conn, _, err := websocket.DefaultDialer.Dial(wsURL, headers)
+		delay := x.reconnect.delay(attempt)
+		if websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			logger.Info("server is going away, reconnecting", "delay", delay)
+		} else {
+			logger.Warn("connection lost, reconnecting", "error", err, "attempt", attempt, "delay", delay)
+		}
 
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			logger.Info("Context canceled")
+			return nil
+		case <-x.draining:
+			logger.Info("Client is shut down")
+			return nil
+		}
+	}
+}
+
+// connect establishes a connection with the server and runs a session until it ends. connected is true if the handshake succeeded.
+func (x *Client) connect(ctx context.Context, wsURL string, headers http.Header) (connected bool, err error) {
+	logger := logging.Extract(ctx)
+
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, wsURL, headers)
 	if err != nil {
-		return goerr.Wrap(err, "failed to connect")
+		if resp != nil {
+			// The server tells the reason of rejection in the body, e.g. a conflict of path prefix
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			return false, goerr.Wrap(err, "failed to connect",
+				goerr.V("status", resp.StatusCode),
+				goerr.V("message", strings.TrimSpace(string(body))),
+			)
+		}
+		return false, goerr.Wrap(err, "failed to connect")
 	}
 	defer conn.Close()
 
-	logger.Info("connected to server", "url", wsURL)
+	codec, err := model.ParseCodec(resp.Header.Get(model.HeaderCodec))
+	if err != nil {
+		return false, err
+	}
+
+	welcome, err := handshake(conn, codec)
+	if err != nil {
+		return false, err
+	}
 
-	errCh := make(chan error)
+	// Keep the tunnel name assigned by the server over reconnects so that the public URL does not change
+	tunnelName := resp.Header.Get(model.HeaderTunnel)
+	if tunnelName != "" {
+		headers.Set(model.HeaderTunnel, tunnelName)
+	}
+
+	logger.Info("connected to server", "url", wsURL, "tunnel", tunnelName, "codec", codec,
+		"session_id", welcome.SessionID,
+		"server_version", welcome.ServerVersion,
+		"features", welcome.Features,
+	)
+	if u := resp.Header.Get(model.HeaderPublicURL); u != "" {
+		logger.Info("tunnel is public", "url", u)
+	}
+	if addr := resp.Header.Get(model.HeaderTCPAddr); addr != "" {
+		logger.Info("TCP tunnel is open", "addr", publicAddr(x.srcURL, addr))
+	}
+	if addr := resp.Header.Get(model.HeaderUDPAddr); addr != "" {
+		logger.Info("UDP tunnel is open", "addr", publicAddr(x.srcURL, addr))
+	}
+
+	sess := newSession(x.svc, conn, sessionConfig{
+		codec:          codec,
+		maxInFlight:    x.maxInFlight,
+		udpIdleTimeout: x.udpIdleTimeout,
+		keepalive:      x.keepalive,
+		drainAck:       slices.Contains(welcome.Features, model.FeatureDrain),
+	})
+	errCh := make(chan error, 1)
 	go func() {
-		defer close(errCh)
-
-		for {
-			logger.Info("waiting for message")
-			_, message, err := conn.ReadMessage()
-			if err != nil {
-				logging.Default().Error("failed to read message", "error", err)
-				return
-			}
-
-			var req model.Request
-			if err := json.Unmarshal(message, &req); err != nil {
-				errCh <- goerr.Wrap(err, "failed to unmarshal message")
-				return
-			}
-			logger.Debug("received message", slog.Group("request",
-				slog.Any("id", req.ID),
-				slog.Any("path", req.Path),
-				slog.Any("method", req.Method),
-				slog.Any("header", req.Header),
-				slog.Any("body", string(req.Body)),
-			))
-
-			resp, err := x.svc.ToLocal(ctx, &req)
-			if err != nil {
-				errCh <- goerr.Wrap(err, "failed to handle local request")
-				return
-			}
-
-			respBody, err := json.Marshal(resp)
-			if err != nil {
-				errCh <- goerr.Wrap(err, "failed to marshal response")
-				return
-			}
-
-			logger.Info("sending response", "id", resp.ID, "code", resp.Code, "path", req.Path, "method", req.Method)
-			if err := conn.WriteMessage(websocket.TextMessage, respBody); err != nil {
-				errCh <- goerr.Wrap(err, "failed to write response")
-				return
-			}
-		}
+		errCh <- sess.run(ctx)
 	}()
 
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-
 	select {
-	case <-interrupt:
-		logger.Info("Quit signal received")
-
+	case <-ctx.Done():
+		return true, nil
 	case err := <-errCh:
-		if err != nil {
-			return goerr.Wrap(err, "failed to read message")
-		}
+		return true, goerr.Wrap(err, "failed to read message")
+	case <-x.draining:
 	}
 
-	return nil
+	// Frames are still read by the session while draining to complete in-flight requests
+	logger.Info("draining in-flight requests", "timeout", x.shutdownTimeout)
+	drainCtx, cancel := context.WithTimeout(ctx, x.shutdownTimeout)
+	defer cancel()
+	if err := sess.drain(drainCtx); err != nil {
+		logger.Warn("failed to drain in-flight requests, closing anyway", "error", err)
+	}
 
-	/*
-		if err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")); err != nil {
-			return goerr.Wrap(err, "failed to write close message")
-		}
-		<-done
-	*/
+	if err := sess.closeNormal(); err != nil {
+		return true, err
+	}
+	select {
+	case <-errCh:
+	case <-time.After(closeTimeout):
+	}
+	return true, nil
+}
+
+// publicAddr replaces the host of the listener address with the host of the server URL because the server may listen on all interfaces.
+func publicAddr(srcURL, listenAddr string) string {
+	_, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return listenAddr
+	}
+	u, err := url.Parse(srcURL)
+	if err != nil {
+		return listenAddr
+	}
+
+	return net.JoinHostPort(u.Hostname(), port)
 }
 
 func convertToWebSocketURL(rawURL string) (string, error) {
@@ -0,0 +1,453 @@
+package client_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-mizutani/backstream/pkg/controller/client"
+	"github.com/m-mizutani/backstream/pkg/controller/server"
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/m-mizutani/backstream/pkg/service/tunnel"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/m-mizutani/gt"
+)
+
+// setupTunnel starts a backstream server and a client connected to local, and returns URL of the server.
+func setupTunnel(t testing.TB, local http.Handler, opts ...client.Option) string {
+	t.Helper()
+	return setupTunnelWithServer(t, local, nil, opts...)
+}
+
+// setupTunnelWithServer is setupTunnel with options of the server.
+func setupTunnelWithServer(t testing.TB, local http.Handler, serverOpts []server.Option, opts ...client.Option) string {
+	t.Helper()
+	logging.Disable()
+
+	localServer := httptest.NewServer(local)
+	t.Cleanup(localServer.Close)
+
+	srv := httptest.NewServer(server.New(hub.New(), serverOpts...))
+	t.Cleanup(srv.Close)
+
+	connectClient(t, srv.URL, localServer.URL, opts...)
+
+	// Wait until the client is connected
+	eventually(t, "client is not connected", func() bool {
+		code := status(srv.URL + "/")
+		return code != 0 && code != http.StatusServiceUnavailable
+	})
+
+	return srv.URL
+}
+
+// eventually waits until cond returns true, and fails the test with msg if it takes too long.
+func eventually(t testing.TB, msg string, cond func() bool) {
+	t.Helper()
+	for i := 0; !cond(); i++ {
+		if i > 300 {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// status returns the status code of a GET request to url, or 0 if the request failed.
+func status(url string) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		return 0
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+// waitStatus waits until a GET request to url returns code.
+func waitStatus(t testing.TB, url string, code int) {
+	t.Helper()
+	eventually(t, fmt.Sprintf("%s does not return %d", url, code), func() bool {
+		return status(url) == code
+	})
+}
+
+// connectClient runs a client that connects srvURL and relays requests to dstURL until the test ends.
+func connectClient(t testing.TB, srvURL, dstURL string, opts ...client.Option) {
+	t.Helper()
+	connectService(t, srvURL, tunnel.New(dstURL), opts...)
+}
+
+// connectService runs a client that connects srvURL and relays requests by svc until the test ends.
+func connectService(t testing.TB, srvURL string, svc *tunnel.Service, opts ...client.Option) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = client.New(svc, srvURL, opts...).Connect(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestClient_StreamLargeBody(t *testing.T) {
+	const size = 8*1024*1024 + 123
+
+	local := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			h := sha256.New()
+			n, err := io.Copy(h, r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("X-Size", strconv.FormatInt(n, 10))
+			_, _ = w.Write(h.Sum(nil))
+
+		case http.MethodGet:
+			w.Header().Set("Content-Length", strconv.Itoa(size))
+			_, _ = io.CopyN(w, zeroReader{}, size)
+		}
+	})
+
+	for _, codec := range []model.Codec{model.CodecBinary, model.CodecJSON} {
+		t.Run(string(codec), func(t *testing.T) {
+			srvURL := setupTunnel(t, local, client.WithCodecs(codec))
+
+			t.Run("upload", func(t *testing.T) {
+				data := make([]byte, size)
+				gt.R1(rand.Read(data)).NoError(t)
+				expect := sha256.Sum256(data)
+
+				resp := gt.R1(http.Post(srvURL+"/upload", "application/octet-stream", bytes.NewReader(data))).NoError(t)
+				defer resp.Body.Close()
+
+				gt.V(t, resp.StatusCode).Equal(http.StatusOK)
+				gt.V(t, resp.Header.Get("X-Size")).Equal(strconv.Itoa(size))
+				gt.A(t, gt.R1(io.ReadAll(resp.Body)).NoError(t)).Equal(expect[:])
+			})
+
+			t.Run("download", func(t *testing.T) {
+				resp := gt.R1(http.Get(srvURL + "/download")).NoError(t)
+				defer resp.Body.Close()
+
+				gt.V(t, resp.StatusCode).Equal(http.StatusOK)
+				gt.V(t, resp.ContentLength).Equal(int64(size))
+				gt.V(t, gt.R1(io.Copy(io.Discard, resp.Body)).NoError(t)).Equal(int64(size))
+			})
+		})
+	}
+}
+
+func BenchmarkClient_Download(b *testing.B) {
+	const size = 16 * 1024 * 1024
+
+	local := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		_, _ = io.CopyN(w, zeroReader{}, size)
+	})
+
+	for _, codec := range []model.Codec{model.CodecJSON, model.CodecBinary} {
+		b.Run(string(codec), func(b *testing.B) {
+			srvURL := setupTunnel(b, local, client.WithCodecs(codec))
+			b.SetBytes(size)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Get(srvURL + "/download")
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, err = io.Copy(io.Discard, resp.Body)
+				_ = resp.Body.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestClient_ServerSentEvents(t *testing.T) {
+	next := make(chan struct{})
+	srvURL := setupTunnel(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/events" {
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+
+		for i := range 3 {
+			_, _ = fmt.Fprintf(w, "data: event-%d\n\n", i)
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	}))
+
+	resp := gt.R1(http.Get(srvURL + "/events")).NoError(t)
+	defer resp.Body.Close()
+	gt.V(t, resp.Header.Get("Content-Type")).Equal("text/event-stream")
+
+	// Each event must arrive before the local app writes the next one
+	reader := bufio.NewReader(resp.Body)
+	for i := range 3 {
+		line := gt.R1(reader.ReadString('\n')).NoError(t)
+		gt.V(t, line).Equal(fmt.Sprintf("data: event-%d\n", i))
+		gt.V(t, gt.R1(reader.ReadString('\n')).NoError(t)).Equal("\n")
+		next <- struct{}{}
+	}
+
+	_, err := reader.ReadString('\n')
+	gt.True(t, errors.Is(err, io.EOF))
+}
+
+// blockingApp is a local application where /slow blocks until release is closed.
+type blockingApp struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingApp() *blockingApp {
+	return &blockingApp{started: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (x *blockingApp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/slow" {
+		x.started <- struct{}{}
+		<-x.release
+	}
+	_, _ = w.Write([]byte(r.URL.Path))
+}
+
+func TestClient_ConcurrentRequests(t *testing.T) {
+	get := func(client *http.Client, url string) (string, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	t.Run("slow request does not block others", func(t *testing.T) {
+		app := newBlockingApp()
+		srvURL := setupTunnel(t, app, client.WithMaxInFlight(4))
+
+		slow := make(chan string, 1)
+		go func() {
+			body, _ := get(http.DefaultClient, srvURL+"/slow")
+			slow <- body
+		}()
+		<-app.started
+
+		var wg sync.WaitGroup
+		for i := range 3 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				path := fmt.Sprintf("/fast/%d", i)
+				body, err := get(&http.Client{Timeout: 5 * time.Second}, srvURL+path)
+				gt.NoError(t, err)
+				gt.V(t, body).Equal(path)
+			}()
+		}
+		wg.Wait()
+
+		close(app.release)
+		gt.V(t, <-slow).Equal("/slow")
+	})
+
+	t.Run("requests over the limit wait", func(t *testing.T) {
+		app := newBlockingApp()
+		srvURL := setupTunnel(t, app, client.WithMaxInFlight(1))
+
+		slow := make(chan string, 1)
+		go func() {
+			body, _ := get(http.DefaultClient, srvURL+"/slow")
+			slow <- body
+		}()
+		<-app.started
+
+		_, err := get(&http.Client{Timeout: 200 * time.Millisecond}, srvURL+"/fast")
+		gt.Error(t, err)
+
+		close(app.release)
+		gt.V(t, <-slow).Equal("/slow")
+		gt.V(t, gt.R1(get(http.DefaultClient, srvURL+"/fast")).NoError(t)).Equal("/fast")
+	})
+}
+
+func TestClient_Cancel(t *testing.T) {
+	canceled := make(chan struct{}, 1)
+	local := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/slow" {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			canceled <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	t.Run("caller went away", func(t *testing.T) {
+		srvURL := setupTunnel(t, local)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		req := gt.R1(http.NewRequestWithContext(ctx, http.MethodGet, srvURL+"/slow", nil)).NoError(t)
+		_, err := http.DefaultClient.Do(req)
+		gt.Error(t, err)
+
+		select {
+		case <-canceled:
+		case <-time.After(3 * time.Second):
+			t.Fatal("local request was not canceled")
+		}
+	})
+
+	t.Run("response timeout", func(t *testing.T) {
+		srvURL := setupTunnelWithServer(t, local, []server.Option{server.WithResponseTimeout(100 * time.Millisecond)})
+
+		resp := gt.R1(http.Get(srvURL + "/slow")).NoError(t)
+		defer resp.Body.Close()
+		gt.V(t, resp.StatusCode).Equal(http.StatusGatewayTimeout)
+
+		select {
+		case <-canceled:
+		case <-time.After(3 * time.Second):
+			t.Fatal("local request was not canceled")
+		}
+	})
+}
+
+func TestClient_EarlyResponse(t *testing.T) {
+	srvURL := setupTunnel(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "too large", http.StatusRequestEntityTooLarge)
+	}))
+
+	// The caller sends a part of the large body and stalls
+	pr, pw := io.Pipe()
+	t.Cleanup(func() { _ = pw.Close() })
+	go func() { _, _ = pw.Write(make([]byte, 1024)) }()
+
+	type result struct {
+		code int
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		req, err := http.NewRequest(http.MethodPost, srvURL+"/upload", pr)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		req.ContentLength = 10 * 1024 * 1024
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		resp.Body.Close()
+		done <- result{code: resp.StatusCode}
+	}()
+
+	select {
+	case r := <-done:
+		gt.NoError(t, r.err)
+		gt.V(t, r.code).Equal(http.StatusRequestEntityTooLarge)
+	case <-time.After(3 * time.Second):
+		t.Fatal("response is blocked by the stalled upload")
+	}
+}
+
+func TestClient_WebSocketProxy(t *testing.T) {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"chat"}}
+	srvURL := setupTunnel(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ws" {
+			return
+		}
+		if r.URL.Query().Get("token") != "secret" {
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// Echo server
+		for {
+			msgType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(msgType, msg); err != nil {
+				return
+			}
+		}
+	}))
+	wsURL := "ws" + strings.TrimPrefix(srvURL, "http") + "/ws"
+
+	t.Run("relay messages", func(t *testing.T) {
+		dialer := websocket.Dialer{Subprotocols: []string{"chat"}}
+		conn, resp, err := dialer.Dial(wsURL+"?token=secret", nil)
+		gt.NoError(t, err)
+		defer conn.Close()
+		gt.V(t, resp.Header.Get("Sec-Websocket-Protocol")).Equal("chat")
+
+		gt.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("hello")))
+		msgType, msg := gt.R2(conn.ReadMessage()).NoError(t)
+		gt.V(t, msgType).Equal(websocket.TextMessage)
+		gt.V(t, string(msg)).Equal("hello")
+
+		// A message larger than the window is split into frames and reassembled
+		large := make([]byte, 300*1024)
+		gt.R1(rand.Read(large)).NoError(t)
+		gt.NoError(t, conn.WriteMessage(websocket.BinaryMessage, large))
+		msgType, msg = gt.R2(conn.ReadMessage()).NoError(t)
+		gt.V(t, msgType).Equal(websocket.BinaryMessage)
+		gt.A(t, msg).Equal(large)
+
+		// Close status is forwarded to local and echoed back
+		gt.NoError(t, conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4000, "bye")))
+		_, _, err = conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		gt.True(t, errors.As(err, &closeErr))
+		gt.V(t, closeErr.Code).Equal(4000)
+	})
+
+	t.Run("rejected by local", func(t *testing.T) {
+		_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		gt.Error(t, err)
+		gt.V(t, resp.StatusCode).Equal(http.StatusForbidden)
+	})
+}
@@ -0,0 +1,53 @@
+package client
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/m-mizutani/goerr/v2"
+)
+
+const (
+	// DefaultReconnectInitialDelay is a default delay before the first reconnect attempt.
+	DefaultReconnectInitialDelay = time.Second
+	// DefaultReconnectMaxDelay is a default upper limit of reconnect delay.
+	DefaultReconnectMaxDelay = 30 * time.Second
+)
+
+// backoff is a policy of reconnect delay, that is exponential backoff with jitter.
+type backoff struct {
+	initial     time.Duration
+	max         time.Duration
+	maxAttempts int
+}
+
+// delay returns a delay before the attempt. It's a random duration between half and full of the exponential delay so that clients don't reconnect at once after a server restart.
+func (x backoff) delay(attempt int) time.Duration {
+	d := x.initial
+	for i := 1; i < attempt && d < x.max; i++ {
+		d *= 2
+	}
+	d = min(d, x.max)
+	if d <= 0 {
+		return 0
+	}
+
+	half := d / 2
+	return half + rand.N(d-half+1)
+}
+
+// isRetryable returns false for errors that reconnecting does not resolve.
+func isRetryable(err error) bool {
+	if errors.Is(err, ErrIncompatible) {
+		return false
+	}
+
+	switch goerr.Values(err)["status"] {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusConflict:
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,102 @@
+package client_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-mizutani/backstream/pkg/controller/client"
+	"github.com/m-mizutani/backstream/pkg/controller/server"
+	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/m-mizutani/backstream/pkg/service/tunnel"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/m-mizutani/gt"
+)
+
+func TestClient_Reconnect(t *testing.T) {
+	logging.Disable()
+
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(local.Close)
+
+	// Record WebSocket connections of clients to cut them from the server side. A connection without the client header is rejected.
+	var (
+		mutex sync.Mutex
+		conns []*websocket.Conn
+		dials int
+	)
+	upgrader := websocket.Upgrader{}
+	upgrade := func(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*websocket.Conn, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		dials++
+		if r.Header.Get("X-Token") != "secret" {
+			return nil, nil
+		}
+
+		conn, err := upgrader.Upgrade(w, r, responseHeader)
+		if err == nil {
+			conns = append(conns, conn)
+		}
+		return conn, err
+	}
+	srv := httptest.NewServer(server.New(hub.New(), server.WithUpgrade(upgrade)))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- client.New(tunnel.New(local.URL), srv.URL,
+			client.WithHeader("X-Token", "secret"),
+			client.WithReconnectDelay(10*time.Millisecond, 50*time.Millisecond),
+		).Connect(ctx)
+	}()
+
+	get := func() string {
+		waitStatus(t, srv.URL+"/", http.StatusOK)
+		resp := gt.R1(http.Get(srv.URL + "/")).NoError(t)
+		defer resp.Body.Close()
+		return string(gt.R1(io.ReadAll(resp.Body)).NoError(t))
+	}
+
+	gt.V(t, get()).Equal("ok")
+
+	mutex.Lock()
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+	mutex.Unlock()
+
+	// The client reconnects with the same headers
+	gt.V(t, get()).Equal("ok")
+	mutex.Lock()
+	gt.N(t, len(conns)).Equal(2)
+	gt.N(t, dials).Equal(2)
+	mutex.Unlock()
+
+	cancel()
+	gt.NoError(t, <-done)
+}
+
+func TestClient_ReconnectGiveUp(t *testing.T) {
+	logging.Disable()
+
+	// Reserve an address that refuses connections
+	ln := gt.R1(net.Listen("tcp", "127.0.0.1:0")).NoError(t)
+	addr := ln.Addr().String()
+	gt.NoError(t, ln.Close())
+
+	err := client.New(tunnel.New("http://localhost:0"), "http://"+addr,
+		client.WithReconnectDelay(time.Millisecond, time.Millisecond),
+		client.WithMaxReconnectAttempts(3),
+	).Connect(context.Background())
+	gt.Error(t, err)
+}
@@ -0,0 +1,80 @@
+package client_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/m-mizutani/backstream/pkg/controller/server"
+	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/m-mizutani/backstream/pkg/service/tunnel"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/m-mizutani/gt"
+)
+
+func TestClient_DestinationRules(t *testing.T) {
+	logging.Disable()
+
+	newApp := func(name string) string {
+		local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name + " " + r.URL.Path + " " + r.Header.Get("X-Forwarded-Prefix")))
+		}))
+		t.Cleanup(local.Close)
+		return local.URL
+	}
+	frontend, api, auth := newApp("frontend"), newApp("api"), newApp("auth")
+
+	rules := []tunnel.Rule{
+		gt.R1(tunnel.ParseRule("path:/api,strip=" + api)).NoError(t),
+		gt.R1(tunnel.ParseRule("host:auth.example.com=" + auth)).NoError(t),
+		gt.R1(tunnel.ParseRule("method:delete,path:/admin=" + auth)).NoError(t),
+	}
+
+	srv := httptest.NewServer(server.New(hub.New()))
+	t.Cleanup(srv.Close)
+	connectService(t, srv.URL, tunnel.New(frontend, tunnel.WithRules(rules...)))
+
+	do := func(method, host, path string) (int, string) {
+		req := gt.R1(http.NewRequest(method, srv.URL+path, nil)).NoError(t)
+		if host != "" {
+			req.Host = host
+		}
+		resp := gt.R1(http.DefaultClient.Do(req)).NoError(t)
+		defer resp.Body.Close()
+		return resp.StatusCode, string(gt.R1(io.ReadAll(resp.Body)).NoError(t))
+	}
+
+	waitStatus(t, srv.URL+"/", http.StatusOK)
+
+	testCases := map[string]struct {
+		method string
+		host   string
+		path   string
+		expect string
+	}{
+		"default":             {method: http.MethodGet, path: "/index.html", expect: "frontend /index.html "},
+		"path with strip":     {method: http.MethodGet, path: "/api/users", expect: "api /users /api"},
+		"path boundary":       {method: http.MethodGet, path: "/apis", expect: "frontend /apis "},
+		"host":                {method: http.MethodGet, host: "auth.example.com:443", path: "/login", expect: "auth /login "},
+		"method and path":     {method: http.MethodDelete, path: "/admin/users", expect: "auth /admin/users "},
+		"method not matched":  {method: http.MethodGet, path: "/admin/users", expect: "frontend /admin/users "},
+		"first rule is prior": {method: http.MethodGet, host: "auth.example.com", path: "/api/me", expect: "api /me /api"},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			code, body := do(tc.method, tc.host, tc.path)
+			gt.V(t, code).Equal(http.StatusOK)
+			gt.V(t, body).Equal(tc.expect)
+		})
+	}
+
+	t.Run("no destination", func(t *testing.T) {
+		srv := httptest.NewServer(server.New(hub.New()))
+		t.Cleanup(srv.Close)
+		connectService(t, srv.URL, tunnel.New("", tunnel.WithRules(rules[0])))
+
+		waitStatus(t, srv.URL+"/api/users", http.StatusOK)
+		gt.V(t, status(srv.URL+"/index.html")).Equal(http.StatusNotFound)
+	})
+}
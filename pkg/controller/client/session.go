@@ -0,0 +1,440 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/service/tunnel"
+	"github.com/m-mizutani/backstream/pkg/utils/flow"
+	"github.com/m-mizutani/backstream/pkg/utils/keepalive"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/m-mizutani/backstream/pkg/utils/relay"
+	"github.com/m-mizutani/goerr/v2"
+)
+
+var errStreamClosed = errors.New("stream closed")
+
+// session handles frames over a WebSocket connection with the server.
+type session struct {
+	svc   *tunnel.Service
+	conn  *websocket.Conn
+	codec model.Codec
+
+	writeMutex sync.Mutex
+
+	streams      map[string]*stream
+	streamsMutex sync.Mutex
+	// drained is closed when all streams are closed while draining
+	drained chan struct{}
+	// drainAcked is closed when the server replied the drain frame or the session ended. It's nil if the server does not support FeatureDrain.
+	drainAcked chan struct{}
+	drainOnce  sync.Once
+
+	// gate limits the number of requests sent to the local application at once
+	gate chan struct{}
+
+	// udp is set in UDP mode
+	udp *udpSessions
+
+	keepaliveConfig keepalive.Config
+	keeper          *keepalive.Keeper
+}
+
+// stream is a request from the server and its response from the local application.
+type stream struct {
+	req *model.Request
+	// ctx is canceled when the server cancels the stream
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	body   *flow.Buffer
+	window *flow.Window
+	write  func(frame *model.Frame) error
+}
+
+// ReadChunk reads data from the server keeping message boundaries.
+func (x *stream) ReadChunk() (flow.Chunk, error) {
+	return x.body.ReadChunk()
+}
+
+// Send sends data to the server with flow control.
+func (x *stream) Send(ctx context.Context, chunk flow.Chunk) error {
+	return x.window.Send(ctx, chunk, func(c flow.Chunk) error {
+		return x.write(model.NewDataFrame(x.req.ID, c))
+	})
+}
+
+// CloseSend notifies the server that no more data will be sent. err is sent as the reason of the end.
+func (x *stream) CloseSend(err error) error {
+	return x.write(model.NewEndFrame(x.req.ID, err))
+}
+
+func (x *stream) respond(resp *model.Response) error {
+	return x.write(&model.Frame{Type: model.FrameResponse, ID: x.req.ID, Response: resp})
+}
+
+// sessionConfig is a configuration of session given by Client.
+type sessionConfig struct {
+	codec          model.Codec
+	maxInFlight    int
+	udpIdleTimeout time.Duration
+	keepalive      keepalive.Config
+	// drainAck is true if the server replies the drain frame
+	drainAck bool
+}
+
+func newSession(svc *tunnel.Service, conn *websocket.Conn, cfg sessionConfig) *session {
+	x := &session{
+		svc:     svc,
+		conn:    conn,
+		codec:   cfg.codec,
+		streams: make(map[string]*stream),
+		gate:    make(chan struct{}, max(cfg.maxInFlight, 1)),
+
+		keepaliveConfig: cfg.keepalive,
+	}
+	if svc.Mode() == model.TunnelUDP {
+		x.udp = newUDPSessions(svc.DialUDP, x.write, cfg.udpIdleTimeout)
+	}
+	if cfg.drainAck {
+		x.drainAcked = make(chan struct{})
+	}
+	return x
+}
+
+func (x *session) write(frame *model.Frame) error {
+	messageType, msg, err := x.codec.Encode(frame)
+	if err != nil {
+		return err
+	}
+
+	x.writeMutex.Lock()
+	defer x.writeMutex.Unlock()
+
+	x.keeper.Sending()
+	if err := x.conn.WriteMessage(messageType, msg); err != nil {
+		return goerr.Wrap(err, "failed to write frame", goerr.V("type", frame.Type), goerr.V("id", frame.ID))
+	}
+	return nil
+}
+
+// run reads frames from the server until the connection is closed.
+func (x *session) run(ctx context.Context) error {
+	logger := logging.Extract(ctx)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer x.closeAll()
+	defer x.ackDrain()
+
+	x.keeper = keepalive.Start(ctx, x.conn, x.keepaliveConfig)
+
+	for {
+		messageType, message, err := x.conn.ReadMessage()
+		if err != nil {
+			if keepalive.IsTimeout(err) {
+				return goerr.Wrap(err, "server is not responding")
+			}
+			return goerr.Wrap(err, "failed to read message")
+		}
+		x.keeper.Received()
+
+		frame, err := model.DecodeFrame(messageType, message)
+		if err != nil {
+			return err
+		}
+
+		switch frame.Type {
+		case model.FrameRequest:
+			if frame.Request == nil {
+				logger.Warn("request frame without request", "id", frame.ID)
+				continue
+			}
+			logger.Debug("received request", slog.Group("request",
+				slog.Any("id", frame.Request.ID),
+				slog.Any("path", frame.Request.Path),
+				slog.Any("method", frame.Request.Method),
+				slog.Any("header", frame.Request.Header),
+			))
+
+			s := x.openStream(ctx, frame.Request)
+			go x.handle(s.ctx, s)
+
+		case model.FrameData:
+			if s := x.lookup(frame.ID); s != nil {
+				s.body.Push(frame.Chunk())
+			}
+
+		case model.FrameEnd:
+			if s := x.lookup(frame.ID); s != nil {
+				s.body.Close(frame.EndError())
+			}
+
+		case model.FrameAck:
+			if s := x.lookup(frame.ID); s != nil {
+				s.window.Release(frame.Size)
+			}
+
+		case model.FrameCancel:
+			if s := x.lookup(frame.ID); s != nil {
+				logger.Info("request canceled by server", "id", frame.ID)
+				s.cancel()
+			}
+
+		case model.FrameDrain:
+			x.ackDrain()
+
+		case model.FrameDatagram:
+			if x.udp == nil {
+				logger.Warn("datagram frame in non-UDP mode", "peer", frame.Peer)
+				continue
+			}
+			if err := x.udp.deliver(ctx, frame.Peer, frame.Data); err != nil {
+				logger.Warn("failed to deliver UDP datagram", "error", err, "peer", frame.Peer)
+			}
+
+		default:
+			logger.Warn("unknown frame type", "type", frame.Type, "id", frame.ID)
+		}
+	}
+}
+
+// ackDrain notifies drain that no more request will be sent by the server.
+func (x *session) ackDrain() {
+	if x.drainAcked != nil {
+		x.drainOnce.Do(func() { close(x.drainAcked) })
+	}
+}
+
+func (x *session) openStream(ctx context.Context, req *model.Request) *stream {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &stream{
+		req:    req,
+		ctx:    ctx,
+		cancel: cancel,
+		window: flow.NewWindow(model.WindowSize),
+		write:  x.write,
+		body: flow.NewBuffer(func(n int) {
+			if err := x.write(&model.Frame{Type: model.FrameAck, ID: req.ID, Size: n}); err != nil {
+				logging.Default().Warn("failed to send ack", "error", err)
+			}
+		}),
+	}
+
+	x.streamsMutex.Lock()
+	defer x.streamsMutex.Unlock()
+	x.streams[req.ID] = s
+
+	return s
+}
+
+func (x *session) lookup(id string) *stream {
+	x.streamsMutex.Lock()
+	defer x.streamsMutex.Unlock()
+	return x.streams[id]
+}
+
+func (x *session) closeStream(s *stream) {
+	x.streamsMutex.Lock()
+	delete(x.streams, s.req.ID)
+	if x.drained != nil && len(x.streams) == 0 {
+		close(x.drained)
+		x.drained = nil
+	}
+	x.streamsMutex.Unlock()
+
+	s.cancel()
+	s.body.Close(errStreamClosed)
+	s.window.Close()
+}
+
+func (x *session) closeAll() {
+	x.streamsMutex.Lock()
+	streams := make([]*stream, 0, len(x.streams))
+	for _, s := range x.streams {
+		streams = append(streams, s)
+	}
+	x.streamsMutex.Unlock()
+
+	for _, s := range streams {
+		x.closeStream(s)
+	}
+
+	if x.udp != nil {
+		x.udp.closeAll()
+	}
+}
+
+// handle sends the request to the local application and streams the response to the server.
+func (x *session) handle(ctx context.Context, s *stream) {
+	logger := logging.Extract(ctx)
+	defer x.closeStream(s)
+
+	// Relayed connections are long-lived, so they don't wait for the gate
+	switch {
+	case x.svc.Mode() == model.TunnelTCP:
+		x.handleTCP(ctx, s)
+		return
+	case s.req.WebSocket:
+		x.handleWebSocket(ctx, s)
+		return
+	}
+
+	select {
+	case x.gate <- struct{}{}:
+	default:
+		logger.Debug("waiting for in-flight requests", "id", s.req.ID, "max_in_flight", cap(x.gate))
+		select {
+		case x.gate <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+	}
+	defer func() { <-x.gate }()
+
+	httpResp, err := x.svc.ToLocal(ctx, s.req, s.body)
+	if err != nil {
+		if ctx.Err() != nil {
+			logger.Info("aborted local request", "id", s.req.ID, "path", s.req.Path, "method", s.req.Method)
+			return
+		}
+		if errors.Is(err, tunnel.ErrNoDestination) {
+			logger.Warn("no destination for request", "id", s.req.ID, "path", s.req.Path, "host", s.req.Host, "method", s.req.Method)
+			x.respondError(ctx, s, http.StatusNotFound)
+			return
+		}
+		logger.Error("failed to handle local request", "error", err, "id", s.req.ID)
+		x.respondError(ctx, s, http.StatusBadGateway)
+		return
+	}
+	defer httpResp.Body.Close()
+
+	resp := s.req.NewResponse(httpResp)
+	logger.Info("sending response", "id", resp.ID, "code", resp.Code, "path", s.req.Path, "method", s.req.Method)
+	if err := s.respond(resp); err != nil {
+		logger.Error("failed to send response", "error", err)
+		return
+	}
+
+	if err := x.sendBody(ctx, s, httpResp.Body, resp.Stream); err != nil {
+		logger.Error("failed to send response body", "error", err, "id", s.req.ID)
+	}
+}
+
+// handleWebSocket connects to the local WebSocket endpoint and relays messages between the server and the local application.
+func (x *session) handleWebSocket(ctx context.Context, s *stream) {
+	logger := logging.Extract(ctx)
+
+	conn, httpResp, err := x.svc.DialWebSocket(ctx, s.req)
+	if err != nil {
+		logger.Error("failed to connect to local WebSocket", "error", err, "id", s.req.ID)
+		if httpResp == nil {
+			x.respondError(ctx, s, http.StatusBadGateway)
+			return
+		}
+
+		// Forward the rejected handshake response as is
+		defer httpResp.Body.Close()
+		resp := s.req.NewResponse(httpResp)
+		if err := s.respond(resp); err != nil {
+			logger.Error("failed to send response", "error", err)
+			return
+		}
+		if err := x.sendBody(ctx, s, httpResp.Body, false); err != nil {
+			logger.Error("failed to send response body", "error", err, "id", s.req.ID)
+		}
+		return
+	}
+	defer conn.Close()
+
+	resp := s.req.NewResponse(httpResp)
+	logger.Info("connected to local WebSocket", "id", resp.ID, "path", s.req.Path)
+	if err := s.respond(resp); err != nil {
+		logger.Error("failed to send response", "error", err)
+		return
+	}
+
+	if err := relay.WebSocket(ctx, conn, s); err != nil {
+		logger.Warn("WebSocket relay closed abnormally", "error", err, "id", s.req.ID)
+	}
+	logger.Info("closed local WebSocket", "id", s.req.ID)
+}
+
+// handleTCP connects to the local TCP destination and relays a raw byte stream of the connection accepted by the server.
+func (x *session) handleTCP(ctx context.Context, s *stream) {
+	logger := logging.Extract(ctx)
+
+	if s.req.Method != http.MethodConnect {
+		logger.Warn("unexpected request in TCP mode", "id", s.req.ID, "method", s.req.Method)
+		x.respondError(ctx, s, http.StatusMethodNotAllowed)
+		return
+	}
+
+	conn, err := x.svc.DialTCP(ctx)
+	if err != nil {
+		logger.Error("failed to connect to local TCP", "error", err, "id", s.req.ID)
+		x.respondError(ctx, s, http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+
+	resp := &model.Response{ID: s.req.ID, Code: http.StatusOK, ContentLength: -1, Header: map[string][]string{}}
+	if err := s.respond(resp); err != nil {
+		logger.Error("failed to send response", "error", err)
+		return
+	}
+
+	logger.Info("relaying TCP connection", "id", s.req.ID, "remote", s.req.Remote)
+	if err := relay.Conn(ctx, conn, s); err != nil {
+		logger.Warn("TCP relay closed abnormally", "error", err, "id", s.req.ID)
+	}
+	logger.Info("closed TCP connection", "id", s.req.ID)
+}
+
+// respondError sends an error response without body.
+func (x *session) respondError(ctx context.Context, s *stream, code int) {
+	resp := &model.Response{
+		ID:     s.req.ID,
+		Code:   code,
+		Header: map[string][]string{},
+	}
+	if err := s.respond(resp); err != nil {
+		logging.Extract(ctx).Error("failed to send response", "error", err)
+		return
+	}
+	if err := s.CloseSend(nil); err != nil {
+		logging.Extract(ctx).Error("failed to send response", "error", err)
+	}
+}
+
+// sendBody sends the response body as data frames with flow control, and then sends an end frame. In streaming mode, data is sent as soon as it's read from body. Otherwise, data is gathered up to ChunkSize to reduce frames.
+func (x *session) sendBody(ctx context.Context, s *stream, body io.Reader, streaming bool) error {
+	read := func(buf []byte) (int, error) { return io.ReadFull(body, buf) }
+	if streaming {
+		read = body.Read
+	}
+
+	buf := make([]byte, model.ChunkSize)
+	for {
+		n, readErr := read(buf)
+		if n > 0 {
+			if err := s.Send(ctx, flow.Chunk{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+
+		if readErr != nil {
+			if errors.Is(readErr, io.ErrUnexpectedEOF) {
+				readErr = nil
+			}
+			return s.CloseSend(readErr)
+		}
+	}
+}
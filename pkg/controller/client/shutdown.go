@@ -0,0 +1,82 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/goerr/v2"
+)
+
+const (
+	// DefaultShutdownTimeout is a default max duration to wait for in-flight requests on shutdown.
+	DefaultShutdownTimeout = 30 * time.Second
+
+	// closeTimeout is a max duration to wait for the server to reply the close frame.
+	closeTimeout = time.Second
+)
+
+// Shutdown makes the running Connect stop gracefully. The server is told not to route new requests to the client, and Connect returns after in-flight requests are completed or the shutdown timeout exceeded.
+func (x *Client) Shutdown() {
+	x.drainOnce.Do(func() { close(x.draining) })
+}
+
+func (x *Client) isDraining() bool {
+	select {
+	case <-x.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// drain sends a drain frame to the server and waits until all streams are closed or ctx is done. Streams are counted after the server replied the drain frame, so that requests sent by the server before it stopped routing are also completed.
+func (x *session) drain(ctx context.Context) error {
+	if err := x.write(&model.Frame{Type: model.FrameDrain}); err != nil {
+		return err
+	}
+
+	if x.drainAcked != nil {
+		select {
+		case <-x.drainAcked:
+		case <-ctx.Done():
+			return goerr.Wrap(ctx.Err(), "server did not reply drain frame")
+		}
+	}
+
+	x.streamsMutex.Lock()
+	drained := make(chan struct{})
+	if len(x.streams) == 0 {
+		close(drained)
+	} else {
+		x.drained = drained
+	}
+	x.streamsMutex.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return goerr.Wrap(ctx.Err(), "in-flight requests remain", goerr.V("count", x.countStreams()))
+	}
+}
+
+// closeNormal sends a close frame of normal closure to the server.
+func (x *session) closeNormal() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "client shutting down")
+
+	x.writeMutex.Lock()
+	defer x.writeMutex.Unlock()
+
+	if err := x.conn.WriteMessage(websocket.CloseMessage, msg); err != nil {
+		return goerr.Wrap(err, "failed to send close frame")
+	}
+	return nil
+}
+
+func (x *session) countStreams() int {
+	x.streamsMutex.Lock()
+	defer x.streamsMutex.Unlock()
+	return len(x.streams)
+}
@@ -0,0 +1,152 @@
+package client_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-mizutani/backstream/pkg/controller/client"
+	"github.com/m-mizutani/backstream/pkg/controller/server"
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/m-mizutani/backstream/pkg/service/tunnel"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/m-mizutani/gt"
+)
+
+func TestClient_Shutdown(t *testing.T) {
+	logging.Disable()
+
+	app := newBlockingApp()
+	local := httptest.NewServer(app)
+	t.Cleanup(local.Close)
+
+	srv := httptest.NewServer(server.New(hub.New()))
+	t.Cleanup(srv.Close)
+
+	c := client.New(tunnel.New(local.URL), srv.URL, client.WithShutdownTimeout(5*time.Second))
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Connect(context.Background())
+	}()
+
+	waitStatus(t, srv.URL+"/", http.StatusOK)
+
+	slow := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(srv.URL + "/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		slow <- string(body)
+	}()
+	<-app.started
+
+	c.Shutdown()
+
+	// The server stops routing new requests to the draining client
+	waitStatus(t, srv.URL+"/new", http.StatusServiceUnavailable)
+
+	select {
+	case err := <-done:
+		t.Fatalf("client stopped before completing in-flight request: %v", err)
+	default:
+	}
+
+	close(app.release)
+	gt.V(t, <-slow).Equal("/slow")
+
+	select {
+	case err := <-done:
+		gt.NoError(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("client is not shut down")
+	}
+}
+
+func TestClient_ShutdownWithRequestInDrain(t *testing.T) {
+	logging.Disable()
+
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	t.Cleanup(local.Close)
+
+	// The server sends a request routed before it handled the drain frame, and then replies the drain frame
+	connected := make(chan struct{})
+	responses := make(chan *model.Frame, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		read := func() (*model.Frame, error) {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				return nil, err
+			}
+			return model.DecodeFrame(messageType, message)
+		}
+		write := func(frame *model.Frame) {
+			messageType, message, _ := model.CodecJSON.Encode(frame)
+			_ = conn.WriteMessage(messageType, message)
+		}
+
+		if _, err := read(); err != nil {
+			return
+		}
+		write(&model.Frame{Type: model.FrameWelcome, Welcome: &model.Welcome{
+			ProtocolVersion: model.ProtocolVersion,
+			Features:        []model.Feature{model.FeatureDrain},
+		}})
+		close(connected)
+
+		for {
+			frame, err := read()
+			if err != nil {
+				return
+			}
+			switch frame.Type {
+			case model.FrameDrain:
+				write(&model.Frame{Type: model.FrameRequest, ID: "late", Request: &model.Request{ID: "late", Method: http.MethodGet, Path: "/late"}})
+				write(model.NewEndFrame("late", nil))
+				write(&model.Frame{Type: model.FrameDrain})
+			case model.FrameResponse:
+				responses <- frame
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	c := client.New(tunnel.New(local.URL), srv.URL, client.WithShutdownTimeout(5*time.Second))
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Connect(context.Background())
+	}()
+	<-connected
+
+	c.Shutdown()
+
+	select {
+	case frame := <-responses:
+		gt.V(t, frame.Response.Code).Equal(http.StatusOK)
+	case <-time.After(3 * time.Second):
+		t.Fatal("request sent while draining is dropped")
+	}
+
+	select {
+	case err := <-done:
+		gt.NoError(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("client is not shut down")
+	}
+}
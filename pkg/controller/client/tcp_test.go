@@ -0,0 +1,92 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/m-mizutani/backstream/pkg/controller/client"
+	"github.com/m-mizutani/backstream/pkg/controller/server"
+	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/m-mizutani/backstream/pkg/service/tunnel"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/m-mizutani/gt"
+)
+
+func TestClient_TCPTunnel(t *testing.T) {
+	logging.Disable()
+
+	// Local TCP server that echoes back and closes the write side after EOF
+	local := gt.R1(net.Listen("tcp", "127.0.0.1:0")).NoError(t)
+	t.Cleanup(func() { _ = local.Close() })
+	go func() {
+		for {
+			conn, err := local.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+				_ = conn.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+
+	// Reserve a free port for the tunnel
+	ln := gt.R1(net.Listen("tcp", "127.0.0.1:0")).NoError(t)
+	port := ln.Addr().(*net.TCPAddr).Port
+	gt.NoError(t, ln.Close())
+
+	srv := httptest.NewServer(server.New(hub.New(), server.WithTCPPorts("127.0.0.1", port, port)))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = client.New(tunnel.New("tcp://"+local.Addr().String()), srv.URL).Connect(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	echo := func(data []byte) ([]byte, error) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+
+		go func() {
+			_, _ = conn.Write(data)
+			_ = conn.(*net.TCPConn).CloseWrite()
+		}()
+		return io.ReadAll(conn)
+	}
+
+	// Wait until the client is connected
+	eventually(t, "TCP tunnel is not ready", func() bool {
+		resp, err := echo([]byte("ping"))
+		return err == nil && string(resp) == "ping"
+	})
+
+	// A long-lived connection does not block others
+	idle := gt.R1(net.Dial("tcp", addr)).NoError(t)
+	defer idle.Close()
+	gt.R1(idle.Write([]byte("x"))).NoError(t)
+	buf := make([]byte, 1)
+	gt.R1(io.ReadFull(idle, buf)).NoError(t)
+
+	data := make([]byte, 1024*1024+7)
+	gt.R1(rand.Read(data)).NoError(t)
+	resp := gt.R1(echo(data)).NoError(t)
+	gt.True(t, bytes.Equal(resp, data))
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/m-mizutani/goerr/v2"
+)
+
+const (
+	// DefaultUDPIdleTimeout is a default duration to keep a UDP session of a remote peer without any datagram.
+	DefaultUDPIdleTimeout = 60 * time.Second
+
+	// maxDatagramSize is a max payload size of a UDP datagram.
+	maxDatagramSize = 64 * 1024
+)
+
+// udpSessions manages a UDP socket to the local destination for each remote peer. A session is closed when no datagram is exchanged for idleTimeout.
+type udpSessions struct {
+	dial        func(ctx context.Context) (net.Conn, error)
+	write       func(frame *model.Frame) error
+	idleTimeout time.Duration
+
+	mutex sync.Mutex
+	peers map[string]*udpPeer
+}
+
+// udpPeer is a UDP session of a remote peer.
+type udpPeer struct {
+	addr       string
+	conn       net.Conn
+	lastActive atomic.Int64
+}
+
+func (x *udpPeer) touch() {
+	x.lastActive.Store(time.Now().UnixNano())
+}
+
+func (x *udpPeer) idle() time.Duration {
+	return time.Since(time.Unix(0, x.lastActive.Load()))
+}
+
+func newUDPSessions(dial func(ctx context.Context) (net.Conn, error), write func(frame *model.Frame) error, idleTimeout time.Duration) *udpSessions {
+	return &udpSessions{
+		dial:        dial,
+		write:       write,
+		idleTimeout: idleTimeout,
+		peers:       make(map[string]*udpPeer),
+	}
+}
+
+// deliver sends a datagram from the remote peer to the local destination. A new session is opened if the peer has no session.
+func (x *udpSessions) deliver(ctx context.Context, peerAddr string, data []byte) error {
+	peer, err := x.lookup(ctx, peerAddr)
+	if err != nil {
+		return err
+	}
+
+	peer.touch()
+	if _, err := peer.conn.Write(data); err != nil {
+		return goerr.Wrap(err, "failed to write UDP datagram", goerr.V("peer", peerAddr))
+	}
+	return nil
+}
+
+func (x *udpSessions) lookup(ctx context.Context, peerAddr string) (*udpPeer, error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if peer, ok := x.peers[peerAddr]; ok {
+		return peer, nil
+	}
+
+	conn, err := x.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	peer := &udpPeer{addr: peerAddr, conn: conn}
+	peer.touch()
+	x.peers[peerAddr] = peer
+	go x.serve(ctx, peer)
+
+	logging.Extract(ctx).Info("opened UDP session", "peer", peerAddr)
+	return peer, nil
+}
+
+// serve sends datagrams from the local destination back to the remote peer until the session expires.
+func (x *udpSessions) serve(ctx context.Context, peer *udpPeer) {
+	logger := logging.Extract(ctx)
+	defer x.remove(peer)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		if err := peer.conn.SetReadDeadline(time.Now().Add(x.idleTimeout - peer.idle())); err != nil {
+			logger.Warn("failed to set UDP read deadline", "error", err, "peer", peer.addr)
+			return
+		}
+
+		n, err := peer.conn.Read(buf)
+		if err != nil {
+			switch {
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				if peer.idle() < x.idleTimeout {
+					continue
+				}
+				logger.Info("UDP session expired", "peer", peer.addr)
+			case errors.Is(err, syscall.ECONNREFUSED):
+				// ICMP port unreachable from the local destination. The session is kept because the destination may start later.
+				logger.Warn("local UDP destination refused datagram", "peer", peer.addr)
+				continue
+			case !errors.Is(err, net.ErrClosed):
+				logger.Warn("failed to read UDP datagram", "error", err, "peer", peer.addr)
+			}
+			return
+		}
+
+		peer.touch()
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		if err := x.write(&model.Frame{Type: model.FrameDatagram, Peer: peer.addr, Data: data}); err != nil {
+			logger.Warn("failed to send UDP datagram", "error", err, "peer", peer.addr)
+			return
+		}
+	}
+}
+
+func (x *udpSessions) remove(peer *udpPeer) {
+	x.mutex.Lock()
+	if x.peers[peer.addr] == peer {
+		delete(x.peers, peer.addr)
+	}
+	x.mutex.Unlock()
+
+	_ = peer.conn.Close()
+}
+
+func (x *udpSessions) closeAll() {
+	x.mutex.Lock()
+	peers := make([]*udpPeer, 0, len(x.peers))
+	for _, peer := range x.peers {
+		peers = append(peers, peer)
+	}
+	x.mutex.Unlock()
+
+	for _, peer := range peers {
+		x.remove(peer)
+	}
+}
@@ -0,0 +1,111 @@
+package client_test
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/backstream/pkg/controller/client"
+	"github.com/m-mizutani/backstream/pkg/controller/server"
+	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/m-mizutani/backstream/pkg/service/tunnel"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/m-mizutani/gt"
+)
+
+func TestClient_UDPTunnel(t *testing.T) {
+	logging.Disable()
+
+	// Local UDP server that echoes back and records source addresses
+	local := gt.R1(net.ListenPacket("udp", "127.0.0.1:0")).NoError(t)
+	t.Cleanup(func() { _ = local.Close() })
+
+	var (
+		mutex   sync.Mutex
+		sources = map[string]bool{}
+	)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := local.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			sources[addr.String()] = true
+			mutex.Unlock()
+			_, _ = local.WriteTo(buf[:n], addr)
+		}
+	}()
+	countSources := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(sources)
+	}
+
+	// Reserve a free port for the tunnel
+	pc := gt.R1(net.ListenPacket("udp", "127.0.0.1:0")).NoError(t)
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	gt.NoError(t, pc.Close())
+
+	srv := httptest.NewServer(server.New(hub.New(), server.WithUDPPorts("127.0.0.1", port, port)))
+	t.Cleanup(srv.Close)
+
+	const idleTimeout = 200 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = client.New(tunnel.New("udp://"+local.LocalAddr().String()), srv.URL,
+			client.WithUDPIdleTimeout(idleTimeout),
+		).Connect(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	echo := func(conn net.Conn, msg string) (string, error) {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			return "", err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return "", err
+			}
+			// Skip late replies of retried datagrams
+			if string(buf[:n]) == msg {
+				return msg, nil
+			}
+		}
+	}
+
+	peerA := gt.R1(net.Dial("udp", addr)).NoError(t)
+	defer peerA.Close()
+	peerB := gt.R1(net.Dial("udp", addr)).NoError(t)
+	defer peerB.Close()
+
+	// Wait until the client is connected
+	eventually(t, "UDP tunnel is not ready", func() bool {
+		resp, err := echo(peerA, "ping")
+		return err == nil && resp == "ping"
+	})
+
+	// Replies are routed to each peer
+	gt.V(t, gt.R1(echo(peerB, "from B")).NoError(t)).Equal("from B")
+	gt.V(t, gt.R1(echo(peerA, "from A")).NoError(t)).Equal("from A")
+	gt.V(t, countSources()).Equal(2)
+
+	// A new session is opened after the idle session expired
+	time.Sleep(idleTimeout * 2)
+	gt.V(t, gt.R1(echo(peerA, "again")).NoError(t)).Equal("again")
+	gt.V(t, countSources()).Equal(3)
+}
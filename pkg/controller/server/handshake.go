@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/goerr/v2"
+)
+
+// handshakeTimeout is a max duration to wait for the hello frame from the client.
+const handshakeTimeout = 10 * time.Second
+
+// handshake receives the hello frame from the client and replies the welcome frame with sessionID. If the client is not compatible, the connection is closed with model.CloseIncompatible and the reason.
+func handshake(ws *websocket.Conn, codec model.Codec, sessionID string) (*model.Hello, error) {
+	if err := ws.SetReadDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return nil, goerr.Wrap(err, "failed to set read deadline")
+	}
+	messageType, message, err := ws.ReadMessage()
+	if err != nil {
+		return nil, goerr.Wrap(err, "failed to read hello")
+	}
+	if err := ws.SetReadDeadline(time.Time{}); err != nil {
+		return nil, goerr.Wrap(err, "failed to reset read deadline")
+	}
+
+	var hello *model.Hello
+	if frame, err := model.DecodeFrame(messageType, message); err == nil && frame.Type == model.FrameHello {
+		hello = frame.Hello
+	}
+
+	switch {
+	case hello == nil:
+		// Clients before the handshake was introduced send no hello
+		return nil, rejectClient(ws, "client does not support handshake", nil)
+	case !model.IsCompatibleProtocol(hello.ProtocolVersion):
+		return nil, rejectClient(ws, fmt.Sprintf("protocol version %d is not supported", hello.ProtocolVersion), hello)
+	}
+
+	supported := []model.Feature{model.FeatureStreaming, model.FeatureDrain}
+	if codec == model.CodecBinary {
+		supported = append(supported, model.FeatureBinary)
+	}
+
+	welcome := &model.Frame{
+		Type: model.FrameWelcome,
+		Welcome: &model.Welcome{
+			ProtocolVersion: model.ProtocolVersion,
+			ServerVersion:   model.AppVersion,
+			SessionID:       sessionID,
+			Features:        model.CommonFeatures(hello.Features, supported),
+		},
+	}
+	messageType, message, err = codec.Encode(welcome)
+	if err != nil {
+		return nil, err
+	}
+	if err := ws.WriteMessage(messageType, message); err != nil {
+		return nil, goerr.Wrap(err, "failed to write welcome")
+	}
+
+	return hello, nil
+}
+
+var ErrIncompatibleClient = errors.New("incompatible client")
+
+// maxCloseReason is a max length of the close reason because a control frame payload is limited to 125 bytes including the close code.
+const maxCloseReason = 123
+
+func rejectClient(ws *websocket.Conn, reason string, hello *model.Hello) error {
+	text := fmt.Sprintf("%s (server %s, protocol %d-%d)", reason, model.AppVersion, model.MinProtocolVersion, model.ProtocolVersion)
+	if len(text) > maxCloseReason {
+		text = text[:maxCloseReason]
+	}
+	msg := websocket.FormatCloseMessage(model.CloseIncompatible, text)
+	_ = ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+
+	var values []goerr.Option
+	if hello != nil {
+		values = append(values,
+			goerr.V("protocol_version", hello.ProtocolVersion),
+			goerr.V("client_version", hello.ClientVersion),
+		)
+	}
+	return goerr.Wrap(ErrIncompatibleClient, reason, values...)
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Handshake(t *testing.T) {
+	srv := httptest.NewServer(New(hub.New()))
+	defer srv.Close()
+
+	dial := func(t *testing.T, codec model.Codec, first *model.Frame) (*model.Frame, error) {
+		header := http.Header{
+			"Backstream-Client": {"test"},
+			model.HeaderCodec:   {string(codec)},
+		}
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		messageType, message, err := codec.Encode(first)
+		require.NoError(t, err)
+		require.NoError(t, conn.WriteMessage(messageType, message))
+
+		messageType, message, err = conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		return model.DecodeFrame(messageType, message)
+	}
+
+	t.Run("compatible client", func(t *testing.T) {
+		frame, err := dial(t, model.CodecBinary, &model.Frame{
+			Type: model.FrameHello,
+			Hello: &model.Hello{
+				ProtocolVersion: model.ProtocolVersion,
+				ClientVersion:   "test",
+				Features:        []model.Feature{model.FeatureBinary, model.FeatureStreaming, model.FeatureDrain, "unknown"},
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, model.FrameWelcome, frame.Type)
+		require.NotNil(t, frame.Welcome)
+		assert.Equal(t, model.ProtocolVersion, frame.Welcome.ProtocolVersion)
+		assert.NotEmpty(t, frame.Welcome.SessionID)
+		assert.Equal(t, []model.Feature{model.FeatureBinary, model.FeatureStreaming, model.FeatureDrain}, frame.Welcome.Features)
+	})
+
+	t.Run("binary is not enabled with JSON codec", func(t *testing.T) {
+		frame, err := dial(t, model.CodecJSON, &model.Frame{
+			Type:  model.FrameHello,
+			Hello: &model.Hello{ProtocolVersion: model.ProtocolVersion, Features: []model.Feature{model.FeatureBinary, model.FeatureStreaming}},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []model.Feature{model.FeatureStreaming}, frame.Welcome.Features)
+	})
+
+	testCases := map[string]*model.Frame{
+		"old protocol version": {Type: model.FrameHello, Hello: &model.Hello{ProtocolVersion: model.MinProtocolVersion - 1}},
+		"no hello":             {Type: model.FrameResponse, ID: "x", Response: &model.Response{ID: "x", Code: 200}},
+	}
+	for name, first := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := dial(t, model.CodecJSON, first)
+			var closeErr *websocket.CloseError
+			require.True(t, errors.As(err, &closeErr))
+			assert.Equal(t, model.CloseIncompatible, closeErr.Code)
+			assert.Contains(t, closeErr.Text, "protocol")
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+)
+
+// DefaultHoldQueueSize is a default max number of requests held at once.
+const DefaultHoldQueueSize = 100
+
+// errShuttingDown is returned when a held request is released by shutdown.
+var errShuttingDown = errors.New("server is shutting down")
+
+// holdQueue holds public requests while the tunnel has no client, so that requests such as webhooks are not lost during reconnect of the client.
+type holdQueue struct {
+	timeout time.Duration
+	slots   chan struct{}
+
+	held      atomic.Int64
+	delivered atomic.Int64
+	expired   atomic.Int64
+	rejected  atomic.Int64
+}
+
+// HoldStats is counters of held requests.
+type HoldStats struct {
+	// Held is a number of requests that were held because no client was connected
+	Held int64 `json:"held"`
+	// Delivered is a number of held requests delivered to a client that joined
+	Delivered int64 `json:"delivered"`
+	// Expired is a number of held requests that no client joined within the hold timeout
+	Expired int64 `json:"expired"`
+	// Rejected is a number of requests not held because the queue was full
+	Rejected int64 `json:"rejected"`
+	// Holding is a number of requests being held now
+	Holding int64 `json:"holding"`
+}
+
+// WithHold holds a public request up to timeout while the tunnel has no client, and delivers it when a client joins. At most size requests are held at once, and requests over it are answered as no client immediately.
+func WithHold(timeout time.Duration, size int) Option {
+	return func(x *Server) {
+		if timeout <= 0 || size <= 0 {
+			x.hold = nil
+			return
+		}
+		x.hold = &holdQueue{
+			timeout: timeout,
+			slots:   make(chan struct{}, size),
+		}
+	}
+}
+
+// HoldStats returns counters of held requests. All counters are zero if holding is disabled.
+func (x *Server) HoldStats() HoldStats {
+	if x.hold == nil {
+		return HoldStats{}
+	}
+	return HoldStats{
+		Held:      x.hold.held.Load(),
+		Delivered: x.hold.delivered.Load(),
+		Expired:   x.hold.expired.Load(),
+		Rejected:  x.hold.rejected.Load(),
+		Holding:   int64(len(x.hold.slots)),
+	}
+}
+
+// holdAndEmit holds the request until a client of the tunnel joins, and then emits it. It returns hub.ErrNoClient if holding is disabled, the queue is full or the hold timeout exceeded.
+func (x *Server) holdAndEmit(r *http.Request, tunnel string, req *model.Request, body io.Reader) (*hub.Stream, error) {
+	if x.hold == nil {
+		return nil, hub.ErrNoClient
+	}
+	logger := logging.Extract(r.Context())
+
+	select {
+	case x.hold.slots <- struct{}{}:
+	default:
+		x.hold.rejected.Add(1)
+		logger.Warn("hold queue is full", "id", req.ID, "tunnel", tunnel, "size", cap(x.hold.slots))
+		return nil, hub.ErrNoClient
+	}
+	defer func() { <-x.hold.slots }()
+
+	x.hold.held.Add(1)
+	logger.Info("holding request until client joins", "id", req.ID, "tunnel", tunnel, "timeout", x.hold.timeout)
+
+	holdCtx, cancel := context.WithTimeout(r.Context(), x.hold.timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-x.drain.stopping:
+			cancel()
+		case <-holdCtx.Done():
+		}
+	}()
+
+	started := time.Now()
+	for {
+		if err := x.svc.WaitClient(holdCtx, tunnel); err != nil {
+			return nil, x.holdError(r, req, tunnel, err)
+		}
+
+		ctx, cancelResp := x.responseContext(r.Context())
+		stream, err := x.svc.EmitAndWait(ctx, tunnel, req, body)
+		cancelResp()
+		if errors.Is(err, hub.ErrNoClient) {
+			// The client left before the request was emitted. Wait for another one.
+			continue
+		}
+		if err == nil {
+			x.hold.delivered.Add(1)
+			logger.Info("delivered held request", "id", req.ID, "tunnel", tunnel, "held", time.Since(started))
+		}
+		return stream, err
+	}
+}
+
+// holdError converts an error of waiting for a client to an error of emit.
+func (x *Server) holdError(r *http.Request, req *model.Request, tunnel string, err error) error {
+	logger := logging.Extract(r.Context())
+
+	switch {
+	case r.Context().Err() != nil:
+		return r.Context().Err()
+	case isClosed(x.drain.stopping):
+		logger.Info("released held request by shutdown", "id", req.ID, "tunnel", tunnel)
+		return errShuttingDown
+	default:
+		x.hold.expired.Add(1)
+		logger.Warn("held request expired", "id", req.ID, "tunnel", tunnel, "timeout", x.hold.timeout)
+		return hub.ErrNoClient
+	}
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Hold(t *testing.T) {
+	logging.Disable()
+
+	post := func(srvURL, body string) (int, string) {
+		resp, err := http.Post(srvURL+"/hook", "text/plain", strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(data)
+	}
+
+	t.Run("deliver held request when client joins", func(t *testing.T) {
+		s := New(hub.New(), WithHold(5*time.Second, 1))
+		srv := httptest.NewServer(s)
+		t.Cleanup(srv.Close)
+
+		type result struct {
+			code int
+			body string
+		}
+		held := make(chan result, 1)
+		go func() {
+			code, body := post(srv.URL, "webhook payload")
+			held <- result{code, body}
+		}()
+		require.Eventually(t, func() bool {
+			return s.HoldStats().Holding > 0
+		}, 3*time.Second, 10*time.Millisecond, "request is not held")
+
+		// The queue is full, so the next request is not held
+		code, _ := post(srv.URL, "overflow")
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+
+		local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			_, _ = w.Write([]byte("received: " + string(body)))
+		}))
+		t.Cleanup(local.Close)
+		connectClient(t, srv.URL, local.URL)
+
+		select {
+		case r := <-held:
+			assert.Equal(t, http.StatusOK, r.code)
+			assert.Equal(t, "received: webhook payload", r.body)
+		case <-time.After(5 * time.Second):
+			t.Fatal("held request is not delivered")
+		}
+		assert.Equal(t, HoldStats{Held: 1, Delivered: 1, Rejected: 1}, s.HoldStats())
+	})
+
+	t.Run("expire held request", func(t *testing.T) {
+		s := New(hub.New(), WithHold(100*time.Millisecond, 10))
+		srv := httptest.NewServer(s)
+		t.Cleanup(srv.Close)
+
+		started := time.Now()
+		code, _ := post(srv.URL, "webhook payload")
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.GreaterOrEqual(t, time.Since(started), 100*time.Millisecond)
+		assert.Equal(t, HoldStats{Held: 1, Expired: 1}, s.HoldStats())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		s := New(hub.New())
+		srv := httptest.NewServer(s)
+		t.Cleanup(srv.Close)
+
+		code, _ := post(srv.URL, "webhook payload")
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, HoldStats{}, s.HoldStats())
+	})
+}
@@ -2,15 +2,20 @@ package server
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/m-mizutani/backstream/pkg/model"
 	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/m-mizutani/backstream/pkg/utils/keepalive"
 	"github.com/m-mizutani/backstream/pkg/utils/logging"
 	"github.com/m-mizutani/goerr/v2"
 	"github.com/m-mizutani/opaq"
@@ -23,6 +28,22 @@ type Server struct {
 	upgrade      Upgrade
 	policy       *opaq.Client
 	noClientCode int
+	tcpPorts     *portPool
+	udpPorts     *portPool
+
+	routes   []Route
+	vhost    *url.URL
+	prefixes *prefixRegistry
+
+	peers          *peers
+	gossipInterval time.Duration
+	hold           *holdQueue
+	inbox          *replayer
+
+	responseTimeout time.Duration
+	keepalive       keepalive.Config
+
+	drain *drainer
 }
 
 func New(svc *hub.Service, opts ...Option) *Server {
@@ -36,12 +57,26 @@ func New(svc *hub.Service, opts ...Option) *Server {
 		svc:          svc,
 		upgrade:      upgrade.Upgrade,
 		noClientCode: 503, // デフォルト値
+		keepalive:    keepalive.Default(),
+		drain:        newDrainer(),
+		prefixes:     newPrefixRegistry(),
 	}
 
 	for _, opt := range opts {
 		opt(x)
 	}
 
+	if x.peers != nil {
+		if x.gossipInterval > 0 {
+			x.peers.interval = x.gossipInterval
+		}
+		x.peers.start(svc)
+	}
+	if x.inbox != nil {
+		x.inbox.timeout = x.responseTimeout
+		x.inbox.start(svc)
+	}
+
 	return x
 }
 
@@ -65,10 +100,57 @@ func WithNoClientCode(code int64) Option {
 	}
 }
 
+// WithTCPPorts enables TCP tunnels. A listener on host is allocated from the port range between min and max for each TCP client.
+func WithTCPPorts(host string, min, max int) Option {
+	return func(x *Server) {
+		x.tcpPorts = newPortPool(host, min, max)
+	}
+}
+
+// WithResponseTimeout sets a max duration to wait for the response head from the client including time to send the request body. The server returns 504 Gateway Timeout if it exceeded. 0 means no limit.
+func WithResponseTimeout(d time.Duration) Option {
+	return func(x *Server) {
+		x.responseTimeout = d
+	}
+}
+
+// WithKeepalive sets an interval of pings to clients and a timeout to regard a client as dead without any message. The default is keepalive.Default(), and interval 0 disables keepalive.
+func WithKeepalive(interval, timeout time.Duration) Option {
+	return func(x *Server) {
+		x.keepalive = keepalive.Config{Interval: interval, Timeout: timeout}
+	}
+}
+
+// WithUDPPorts enables UDP tunnels. A socket on host is allocated from the port range between min and max for each UDP client.
+func WithUDPPorts(host string, min, max int) Option {
+	return func(x *Server) {
+		x.udpPorts = newPortPool(host, min, max)
+	}
+}
+
 func (x *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wg := &x.drain.requests
 	if r.Header.Get("Backstream-Client") != "" {
+		wg = &x.drain.clients
+	}
+	if !x.drain.enter(wg) {
+		writeShuttingDown(w)
+		return
+	}
+	defer wg.Done()
+
+	if r.Header.Get(headerPeerSecret) != "" {
+		if r = x.handlePeer(w, r); r == nil {
+			return
+		}
+	}
+
+	switch {
+	case r.Header.Get("Backstream-Client") != "":
 		x.handleWebSocket(w, r)
-	} else {
+	case websocket.IsWebSocketUpgrade(r):
+		x.handleWebSocketProxy(w, r)
+	default:
 		x.handleHTTP(w, r)
 	}
 }
@@ -76,64 +158,175 @@ func (x *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (x *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	logger := logging.Extract(r.Context())
 
+	// The request body is streamed to the client while the response may start before the upload ends, e.g. 413 from the local app. Without full duplex, net/http waits for a pending body read of a stalled caller to write the response head.
+	_ = http.NewResponseController(w).EnableFullDuplex()
+
 	if x.policy != nil {
 		if err := checkAuthPolicy(r.Context(), x.policy, r, "data.auth.server"); err != nil {
 			logger.Error("auth policy failed", "error", err)
 			http.Error(w, "auth policy denied", http.StatusForbidden)
+			return
 		}
 	}
 
-	req, err := model.NewRequest(r)
-	if err != nil {
-		logging.Extract(r.Context()).Error("failed to create request", "error", err)
-		http.Error(w, "failed to create request", http.StatusBadRequest)
+	req, tunnel := x.newRequest(r)
+	logger.Debug("received HTTP request", "request", req, "tunnel", tunnel)
+
+	// Requests behind pending ones in the inbox are stored to be delivered in the received order
+	if x.inbox != nil && x.inbox.pending(tunnel) {
+		if !x.storeInbox(w, r, tunnel, req) {
+			x.writeEmitError(w, r, tunnel, hub.ErrNoClient)
+		}
 		return
 	}
 
-	logger.Debug("received HTTP request", "request", req)
+	ctx, cancel := x.responseContext(r.Context())
+	defer cancel()
 
-	resp, err := x.svc.EmitAndWait(req)
+	stream, err := x.svc.EmitAndWait(ctx, tunnel, req, r.Body)
+	if errors.Is(err, hub.ErrNoClient) && x.forwardToPeer(w, r) {
+		return
+	}
+	if errors.Is(err, hub.ErrNoClient) {
+		stream, err = x.holdAndEmit(r, tunnel, req, r.Body)
+	}
+	if errors.Is(err, hub.ErrNoClient) && x.inbox != nil && x.storeInbox(w, r, tunnel, req) {
+		return
+	}
 	if err != nil {
-		if errors.Is(err, hub.ErrNoClient) {
-			logging.Extract(r.Context()).Error("no client connected", "error", err)
-			switch {
-			case x.noClientCode == 0:
-				http.Error(w, "no WebSocket client connected", http.StatusServiceUnavailable)
-			case x.noClientCode < 400:
-				w.WriteHeader(x.noClientCode)
-				_, _ = w.Write([]byte("no WebSocket client connected"))
-			default:
-				http.Error(w, "no WebSocket client connected", x.noClientCode)
-			}
-		} else {
-			logging.Extract(r.Context()).Error("failed to get response", "error", err)
-			http.Error(w, "failed to get response", http.StatusInternalServerError)
-		}
+		x.writeEmitError(w, r, tunnel, err)
 		return
 	}
+	defer stream.Close()
+
+	// Abort the request of the client if the caller went away while waiting for the response body
+	stop := context.AfterFunc(r.Context(), stream.Close)
+	defer stop()
 
-	if resp == nil {
-		logging.Extract(r.Context()).Error("failed to get response")
-		http.Error(w, "no WebSocket client connected", x.noClientCode)
+	resp := stream.Response()
+	if err := writeResponse(w, resp, stream); err != nil {
+		logger.Error("failed to send response body", "error", err, "id", resp.ID)
 		return
 	}
 
+	logger.Info("sent HTTP response", "id", resp.ID, "method", r.Method, "url", r.URL, "code", resp.Code)
+}
+
+// responseContext returns a context to wait for the response head with the response timeout.
+func (x *Server) responseContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if x.responseTimeout > 0 {
+		return context.WithTimeout(ctx, x.responseTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// writeEmitError writes an error response when the request could not be delivered to clients.
+func (x *Server) writeEmitError(w http.ResponseWriter, r *http.Request, tunnel string, err error) {
+	logger := logging.Extract(r.Context())
+
+	switch {
+	case errors.Is(err, hub.ErrNoClient):
+		logger.Error("no client connected", "error", err, "tunnel", tunnel)
+		switch {
+		case x.noClientCode == 0:
+			http.Error(w, "no WebSocket client connected", http.StatusServiceUnavailable)
+		case x.noClientCode < 400:
+			w.WriteHeader(x.noClientCode)
+			_, _ = w.Write([]byte("no WebSocket client connected"))
+		default:
+			http.Error(w, "no WebSocket client connected", x.noClientCode)
+		}
+
+	case errors.Is(err, hub.ErrTimeout):
+		logger.Error("response timeout", "error", err, "timeout", x.responseTimeout)
+		http.Error(w, "response timeout", http.StatusGatewayTimeout)
+
+	case errors.Is(err, errShuttingDown):
+		logger.Warn("server shut down before client joined", "tunnel", tunnel)
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+
+	case errors.Is(err, context.Canceled):
+		logger.Info("caller went away before response", "method", r.Method, "url", r.URL)
+
+	default:
+		logger.Error("failed to get response", "error", err)
+		http.Error(w, "failed to get response", http.StatusBadGateway)
+	}
+}
+
+// writeResponse writes the response head and streams the body from body.
+func writeResponse(w http.ResponseWriter, resp *model.Response, body io.Reader) error {
 	for key, values := range resp.Header {
 		for _, value := range values {
 			w.Header().Add(key, value)
 		}
 	}
+	if resp.Stream {
+		// Disable response buffering of reverse proxies such as nginx
+		w.Header().Set("X-Accel-Buffering", "no")
+	}
 	w.WriteHeader(resp.Code)
-	_, _ = w.Write(resp.Body)
 
-	logger.Info("sent HTTP response", "id", resp.ID, "method", r.Method, "url", r.URL, "code", resp.Code)
+	copyBody := io.Copy
+	if resp.Stream {
+		copyBody = copyAndFlush
+	}
+	if _, err := copyBody(w, body); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// copyAndFlush copies src to w and flushes every chunk to the caller immediately.
+func copyAndFlush(w io.Writer, src io.Reader) (int64, error) {
+	flush := func() error { return nil }
+	if rw, ok := w.(http.ResponseWriter); ok {
+		rc := http.NewResponseController(rw)
+		flush = func() error {
+			if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				return err
+			}
+			return nil
+		}
+	}
+
+	// Send response header before the first chunk arrives
+	if err := flush(); err != nil {
+		return 0, goerr.Wrap(err, "failed to flush response")
+	}
+
+	var written int64
+	buf := make([]byte, model.ChunkSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return written, goerr.Wrap(err, "failed to write response")
+			}
+			written += int64(n)
+			if err := flush(); err != nil {
+				return written, goerr.Wrap(err, "failed to flush response")
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
 }
 
 type AuthPolicyInput struct {
-	Method string            `json:"method"`
-	Path   string            `json:"path"`
-	Header map[string]string `json:"header"`
-	Remote string            `json:"remote"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Host   string `json:"host"`
+	// Header has only the first value of each header for convenience. Headers has all values.
+	Header  map[string]string   `json:"header"`
+	Headers map[string][]string `json:"headers"`
+	Remote  string              `json:"remote"`
 }
 
 type AuthPolicyOutput struct {
@@ -144,13 +337,17 @@ func checkAuthPolicy(ctx context.Context, policy *opaq.Client, r *http.Request,
 	logger := logging.Extract(ctx)
 
 	input := AuthPolicyInput{
-		Method: r.Method,
-		Path:   r.URL.Path,
-		Header: make(map[string]string),
-		Remote: r.RemoteAddr,
+		Method:  r.Method,
+		Path:    r.URL.Path,
+		Host:    r.Host,
+		Header:  make(map[string]string),
+		Headers: r.Header,
+		Remote:  r.RemoteAddr,
 	}
 	for k, v := range r.Header {
-		input.Header[k] = v[0]
+		if len(v) > 0 {
+			input.Header[k] = v[0]
+		}
 	}
 
 	var output AuthPolicyOutput
@@ -181,7 +378,105 @@ func (x *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	ws, err := x.upgrade(w, r, nil)
+	mode := model.TunnelMode(r.Header.Get(model.HeaderTunnelMode))
+	if mode == "" {
+		mode = model.TunnelHTTP
+	}
+
+	prefixes, err := pathPrefixes(r)
+	if err != nil {
+		logger.Warn("invalid path prefix", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(prefixes) > 0 && mode != model.TunnelHTTP {
+		http.Error(w, "path prefix is available only in HTTP mode", http.StatusBadRequest)
+		return
+	}
+
+	var joinOptions []hub.JoinOption
+	mirror := r.Header.Get(model.HeaderMirror) == "true"
+	if mirror {
+		if mode != model.TunnelHTTP {
+			http.Error(w, "mirror is available only in HTTP mode", http.StatusBadRequest)
+			return
+		}
+		joinOptions = append(joinOptions, hub.AsMirror())
+	}
+
+	tunnel, err := x.tunnelName(r, len(prefixes) > 0)
+	if err != nil {
+		logger.Warn("invalid tunnel name", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(prefixes) > 0 {
+		strip := r.Header.Get(model.HeaderStripPrefix) == "true"
+		if err := x.prefixes.register(tunnel, prefixes, strip); err != nil {
+			logger.Warn("failed to register path prefix", "error", err, "tunnel", tunnel)
+			http.Error(w, fmt.Sprintf("path prefix %v is already registered by another client", goerr.Values(err)["prefix"]), http.StatusConflict)
+			return
+		}
+		defer x.prefixes.unregister(prefixes)
+		logger.Info("registered path prefixes", "tunnel", tunnel, "prefixes", prefixes, "strip", strip)
+	}
+
+	codec := model.NegotiateCodec(r.Header.Get(model.HeaderCodec))
+	responseHeader := http.Header{
+		model.HeaderCodec:  {string(codec)},
+		model.HeaderTunnel: {tunnel},
+	}
+	if x.vhost != nil {
+		responseHeader.Set(model.HeaderPublicURL, x.publicURL(tunnel))
+	}
+
+	var (
+		listener   net.Listener
+		packetConn net.PacketConn
+	)
+	switch mode {
+	case model.TunnelHTTP:
+	case model.TunnelTCP:
+		if x.tcpPorts == nil {
+			http.Error(w, "TCP tunnel is not enabled", http.StatusBadRequest)
+			return
+		}
+
+		ln, port, err := x.tcpPorts.listen()
+		if err != nil {
+			logger.Error("failed to allocate TCP port", "error", err)
+			http.Error(w, "no TCP port available", http.StatusServiceUnavailable)
+			return
+		}
+		defer x.tcpPorts.release(port)
+		defer ln.Close()
+
+		listener = ln
+		responseHeader.Set(model.HeaderTCPAddr, ln.Addr().String())
+	case model.TunnelUDP:
+		if x.udpPorts == nil {
+			http.Error(w, "UDP tunnel is not enabled", http.StatusBadRequest)
+			return
+		}
+
+		pc, port, err := x.udpPorts.listenPacket()
+		if err != nil {
+			logger.Error("failed to allocate UDP port", "error", err)
+			http.Error(w, "no UDP port available", http.StatusServiceUnavailable)
+			return
+		}
+		defer x.udpPorts.release(port)
+		defer pc.Close()
+
+		packetConn = pc
+		responseHeader.Set(model.HeaderUDPAddr, pc.LocalAddr().String())
+	default:
+		http.Error(w, "unsupported tunnel mode: "+string(mode), http.StatusBadRequest)
+		return
+	}
+
+	ws, err := x.upgrade(w, r, responseHeader)
 	if err != nil {
 		logger.Error("failed to upgrade", "error", err)
 		http.Error(w, "failed to upgrade: "+err.Error(), http.StatusInternalServerError)
@@ -193,61 +488,118 @@ func (x *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer ws.Close()
-	logger.Info("connected to WebSocket server", "remote", ws.RemoteAddr())
+	logger.Info("connected to WebSocket server", "remote", ws.RemoteAddr(), "mode", mode, "codec", codec)
 
 	clientID := uuid.New().String()
-	reqCh := x.svc.Join(clientID)
+	hello, err := handshake(ws, codec, clientID)
+	if err != nil {
+		logger.Error("handshake failed", "error", err)
+		return
+	}
+	logger.Info("client joined", "session_id", clientID, "tunnel", tunnel, "mirror", mirror, "client_version", hello.ClientVersion, "protocol_version", hello.ProtocolVersion, "features", hello.Features)
+
+	frameCh := x.svc.Join(clientID, tunnel, mode, joinOptions...)
 	defer x.svc.Leave(clientID)
 
-	respCh := make(chan *model.Response)
-	errCh := make(chan error)
-	go func() {
-		defer close(respCh)
-		defer close(errCh)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	keeper := keepalive.Start(ctx, ws, x.keepalive)
+
+	if listener != nil {
+		go x.serveTCP(ctx, listener, clientID)
+		logger.Info("TCP tunnel is listening", "addr", listener.Addr())
+	}
+	if packetConn != nil {
+		go x.serveUDP(ctx, packetConn, clientID)
+		logger.Info("UDP tunnel is listening", "addr", packetConn.LocalAddr())
+	}
 
+	errCh := make(chan error, 1)
+	go func() {
 		for {
-			_, message, err := ws.ReadMessage()
+			messageType, message, err := ws.ReadMessage()
 			if err != nil {
 				errCh <- err
 				return
 			}
+			keeper.Received()
 
-			var resp model.Response
-			if err := json.Unmarshal(message, &resp); err != nil {
+			frame, err := model.DecodeFrame(messageType, message)
+			if err != nil {
 				errCh <- err
 				return
 			}
 
-			logger.Debug("received message", slog.Group("request",
-				slog.Any("id", resp.ID),
-				slog.Any("code", resp.Code),
-				slog.Any("header", resp.Header),
-				slog.Any("body", string(resp.Body)),
+			logger.Debug("received frame", slog.Group("frame",
+				slog.Any("type", frame.Type),
+				slog.Any("id", frame.ID),
+				slog.Any("size", len(frame.Data)),
 			))
 
-			x.svc.PutResponse(&resp)
+			if frame.Type == model.FrameDatagram {
+				if packetConn == nil {
+					logger.Warn("datagram frame from non-UDP client")
+					continue
+				}
+				if err := writeDatagram(packetConn, frame); err != nil {
+					logger.Warn("failed to relay UDP datagram", "error", err)
+				}
+				continue
+			}
+
+			if frame.Type == model.FrameDrain {
+				logger.Info("client is draining", "session_id", clientID)
+				x.svc.Drain(clientID)
+				continue
+			}
+
+			if frame.Type == model.FrameResponse && frame.Response != nil {
+				logger.Info("received response", "id", frame.ID, "code", frame.Response.Code)
+			}
+			x.svc.PutFrame(clientID, frame)
 		}
 	}()
 
 	for {
 		select {
-		case req := <-reqCh:
-			message, err := json.Marshal(req)
+		case frame := <-frameCh:
+			messageType, message, err := codec.Encode(frame)
 			if err != nil {
-				logger.Error("failed to marshal message", "error", err)
+				logger.Error("failed to encode frame", "error", err)
 				return
 			}
 
-			if err := ws.WriteMessage(websocket.TextMessage, message); err != nil {
+			keeper.Sending()
+			if err := ws.WriteMessage(messageType, message); err != nil {
 				logger.Error("failed to write message", "error", err)
 				return
 			}
-			logger.Info("sent message", "id", req.ID, "method", req.Method, "path", req.Path)
+			if frame.Type == model.FrameRequest {
+				logger.Info("sent request", "id", frame.ID, "method", frame.Request.Method, "path", frame.Request.Path, "session_id", clientID, "in_flight", x.svc.InFlight(clientID))
+			}
 
-		case resp := <-respCh:
-			x.svc.PutResponse(resp)
+		case <-x.drain.closing:
+			logger.Info("closing client connection for shutdown", "session_id", clientID)
+			if err := closeGoingAway(ws); err != nil {
+				logger.Warn("failed to close client connection", "error", err)
+				return
+			}
+			// Wait for the close frame replied by the client
+			select {
+			case <-errCh:
+			case <-time.After(goingAwayTimeout):
+			}
+			return
 
 		case err := <-errCh:
+			if keepalive.IsTimeout(err) {
+				logger.Warn("client is not responding, disconnecting", "session_id", clientID)
+				return
+			}
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				logger.Info("client closed connection", "session_id", clientID)
+				return
+			}
 			logger.Error("failed to read message", "error", err)
 			return
 		}
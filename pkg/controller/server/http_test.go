@@ -1,16 +1,77 @@
 package server
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/m-mizutani/backstream/pkg/controller/client"
+	"github.com/m-mizutani/backstream/pkg/model"
 	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/m-mizutani/backstream/pkg/service/tunnel"
 	"github.com/m-mizutani/opaq"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// connectClient runs a client that connects srvURL and relays requests to dstURL until the test ends.
+func connectClient(t testing.TB, srvURL, dstURL string, opts ...client.Option) {
+	t.Helper()
+	connectService(t, srvURL, tunnel.New(dstURL), opts...)
+}
+
+// connectService runs a client that connects srvURL and relays requests by svc until cancel is called or the test ends.
+func connectService(t testing.TB, srvURL string, svc *tunnel.Service, opts ...client.Option) (cancel func()) {
+	t.Helper()
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = client.New(svc, srvURL, opts...).Connect(ctx)
+	}()
+	cancel = func() {
+		cancelCtx()
+		<-done
+	}
+	t.Cleanup(cancel)
+	return cancel
+}
+
+// status returns the status code of a GET request to url, or 0 if the request failed.
+func status(url string) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		return 0
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+// waitStatus waits until a GET request to url returns code.
+func waitStatus(t testing.TB, url string, code int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		return status(url) == code
+	}, 3*time.Second, 10*time.Millisecond, "%s does not return %d", url, code)
+}
+
+// countingApp is a local application that responds its name and counts requests.
+type countingApp struct {
+	name  string
+	count atomic.Int64
+}
+
+func (x *countingApp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	x.count.Add(1)
+	_, _ = w.Write([]byte(x.name))
+}
+
 func TestServer_WebSocket_Auth(t *testing.T) {
 	policy, err := opaq.New(opaq.Files("testdata/policy/auth_client.rego"))
 	if err != nil {
@@ -103,3 +164,30 @@ func TestWithNoClientCode(t *testing.T) {
 		})
 	}
 }
+
+func TestServer_Keepalive(t *testing.T) {
+	svc := hub.New()
+	srv := httptest.NewServer(New(svc, WithKeepalive(20*time.Millisecond, 100*time.Millisecond)))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), http.Header{"Backstream-Client": {"test"}})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	hello := &model.Frame{Type: model.FrameHello, Hello: &model.Hello{ProtocolVersion: model.ProtocolVersion}}
+	messageType, message, err := model.CodecJSON.Encode(hello)
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(messageType, message))
+	_, _, err = conn.ReadMessage()
+	require.NoError(t, err)
+
+	// The client stops reading and never returns pong, so the server removes it
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get(srv.URL + "/")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode == http.StatusServiceUnavailable
+	}, 3*time.Second, 20*time.Millisecond)
+}
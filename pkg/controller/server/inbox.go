@@ -0,0 +1,293 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/m-mizutani/backstream/pkg/service/inbox"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+)
+
+const (
+	// HeaderInboxID is a response header with the entry ID of a request stored in the inbox.
+	HeaderInboxID = "Backstream-Inbox-ID"
+
+	// DefaultInboxAckCode is a default status code of the response to a request stored in the inbox.
+	DefaultInboxAckCode = http.StatusAccepted
+
+	// inboxRetryInterval is an interval to replay an entry again after a failure other than no client.
+	inboxRetryInterval = 5 * time.Second
+	// inboxPurgeInterval is an interval to remove entries over the retention.
+	inboxPurgeInterval = time.Minute
+)
+
+// replayer delivers requests stored in the inbox to clients in the received order, with a worker per tunnel that runs while the tunnel has pending entries.
+type replayer struct {
+	box     *inbox.Inbox
+	ackCode int
+	ackBody string
+	// timeout is the response timeout of the server to wait for the response head of a replayed request
+	timeout time.Duration
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mutex   sync.Mutex
+	running map[string]bool
+	workers sync.WaitGroup
+}
+
+// WithInbox stores a public request in box when the tunnel has no client, and answers the caller with ackCode and ackBody instead of the no client response. The entry ID is returned by the Backstream-Inbox-ID header. Stored requests are replayed in the received order when a client of the tunnel joins, and requests arriving while the tunnel has pending entries are also stored to keep the order. Each request is delivered at least once, and may be delivered again if the connection is lost during the delivery.
+func WithInbox(box *inbox.Inbox, ackCode int, ackBody string) Option {
+	return func(x *Server) {
+		x.inbox = &replayer{
+			box:     box,
+			ackCode: ackCode,
+			ackBody: ackBody,
+			running: make(map[string]bool),
+		}
+	}
+}
+
+// start begins replay of tunnels that have pending entries and purge of old entries.
+func (x *replayer) start(svc *hub.Service) {
+	x.ctx, x.cancel = context.WithCancel(context.Background())
+
+	tunnels, err := x.box.Tunnels()
+	if err != nil {
+		logging.Default().Error("failed to get tunnels of inbox", "error", err)
+	}
+	for _, tunnel := range tunnels {
+		x.replay(svc, tunnel)
+	}
+
+	x.workers.Add(1)
+	go func() {
+		defer x.workers.Done()
+		x.purge()
+	}()
+}
+
+// stop aborts replay and waits until workers exit. Entries being delivered stay pending and are replayed after restart.
+func (x *replayer) stop() {
+	x.cancel()
+	x.workers.Wait()
+}
+
+func (x *replayer) purge() {
+	ticker := time.NewTicker(inboxPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := x.box.Purge(time.Now())
+		if err != nil {
+			logging.Default().Error("failed to purge inbox", "error", err)
+		}
+		for _, entry := range purged {
+			if entry.Status == inbox.StatusPending {
+				logging.Default().Warn("inbox entry expired before delivery", "id", entry.ID, "tunnel", entry.Tunnel, "received_at", entry.ReceivedAt)
+			}
+		}
+
+		select {
+		case <-x.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// replay runs a worker of the tunnel unless it's already running.
+func (x *replayer) replay(svc *hub.Service, tunnel string) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if x.running[tunnel] || x.ctx.Err() != nil {
+		return
+	}
+	x.running[tunnel] = true
+
+	x.workers.Add(1)
+	go func() {
+		defer x.workers.Done()
+		x.work(svc, tunnel)
+	}()
+}
+
+// work delivers pending entries of the tunnel one by one until none remains.
+func (x *replayer) work(svc *hub.Service, tunnel string) {
+	logger := logging.Default().With("tunnel", tunnel)
+
+	for {
+		entry, body, err := x.box.Next(tunnel)
+		if err != nil {
+			logger.Error("failed to get inbox entry", "error", err)
+			if !x.sleep(inboxRetryInterval) {
+				return
+			}
+			continue
+		}
+		if entry == nil && x.finish(tunnel) {
+			return
+		}
+		if entry == nil {
+			continue
+		}
+
+		if err := svc.WaitClient(x.ctx, tunnel); err != nil {
+			return
+		}
+
+		code, err := x.deliver(svc, entry, body)
+		if err != nil {
+			logger.Warn("failed to replay inbox entry", "id", entry.ID, "error", err)
+			if err := x.box.Failed(entry.ID, err); err != nil {
+				logger.Error("failed to record inbox failure", "id", entry.ID, "error", err)
+			}
+			// A client that left is waited by WaitClient, and other failures are retried later not to flood the client
+			if !errors.Is(err, hub.ErrNoClient) && !x.sleep(inboxRetryInterval) {
+				return
+			}
+			continue
+		}
+
+		if err := x.box.Delivered(entry.ID, code); err != nil {
+			logger.Error("failed to record inbox delivery", "id", entry.ID, "error", err)
+			if !x.sleep(inboxRetryInterval) {
+				return
+			}
+			continue
+		}
+		logger.Info("replayed inbox entry", "id", entry.ID, "code", code, "received_at", entry.ReceivedAt)
+	}
+}
+
+// finish marks the worker of the tunnel as stopped if the tunnel still has no pending entry. The check is done with mutex locked so that an entry put after Next is replayed by this worker or a new one.
+func (x *replayer) finish(tunnel string) bool {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if pending, err := x.box.Pending(tunnel); err == nil && pending {
+		return false
+	}
+	delete(x.running, tunnel)
+	return true
+}
+
+// deliver emits the stored request and reads the response. The request has a new ID for each attempt so that a stream of a failed attempt does not conflict.
+func (x *replayer) deliver(svc *hub.Service, entry *inbox.Entry, body []byte) (int, error) {
+	req := *entry.Request
+	req.ID = uuid.NewString()
+
+	ctx, cancel := context.WithCancel(x.ctx)
+	if x.timeout > 0 {
+		ctx, cancel = context.WithTimeout(x.ctx, x.timeout)
+	}
+	defer cancel()
+
+	stream, err := svc.EmitAndWait(ctx, entry.Tunnel, &req, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+
+	resp := stream.Response()
+	if _, err := io.Copy(io.Discard, stream); err != nil {
+		// The client already handled the request because it returned the response head
+		logging.Default().Warn("failed to read response of inbox entry", "id", entry.ID, "error", err)
+	}
+	return resp.Code, nil
+}
+
+func (x *replayer) sleep(d time.Duration) bool {
+	select {
+	case <-x.ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// pending returns true if the tunnel has entries to be delivered before a new request.
+func (x *replayer) pending(tunnel string) bool {
+	pending, err := x.box.Pending(tunnel)
+	if err != nil {
+		logging.Default().Error("failed to check pending inbox entries", "tunnel", tunnel, "error", err)
+		return false
+	}
+	return pending
+}
+
+// storeInbox stores the request in the inbox and writes the acknowledgment. It returns false if the request could not be stored because the inbox is full, and the caller should respond as no client.
+func (x *Server) storeInbox(w http.ResponseWriter, r *http.Request, tunnel string, req *model.Request) bool {
+	logger := logging.Extract(r.Context())
+	box := x.inbox.box
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, box.MaxBodySize()+1))
+	if err != nil {
+		logger.Warn("failed to read request body for inbox", "id", req.ID, "error", err)
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		return true
+	}
+
+	entry, err := box.Put(tunnel, req, body)
+	switch {
+	case errors.Is(err, inbox.ErrFull):
+		logger.Warn("inbox is full", "id", req.ID, "tunnel", tunnel)
+		return false
+	case errors.Is(err, inbox.ErrTooLarge):
+		logger.Warn("request body is too large for inbox", "id", req.ID, "tunnel", tunnel, "max", box.MaxBodySize())
+		http.Error(w, "request body is too large", http.StatusRequestEntityTooLarge)
+		return true
+	case err != nil:
+		logger.Error("failed to store request in inbox", "id", req.ID, "error", err)
+		http.Error(w, "failed to store request", http.StatusInternalServerError)
+		return true
+	}
+
+	logger.Info("stored request in inbox", "id", entry.ID, "tunnel", tunnel, "method", r.Method, "url", r.URL)
+	x.inbox.replay(x.svc, tunnel)
+
+	w.Header().Set(HeaderInboxID, entry.ID)
+	w.WriteHeader(x.inbox.ackCode)
+	_, _ = w.Write([]byte(x.inbox.ackBody))
+	return true
+}
+
+// InboxHandler returns a handler of delivery status of the inbox. "/inbox/<id>" returns the entry of the ID, and "/inbox?tunnel=<tunnel>" returns entries of the tunnel in the received order. It should be served on a private address because requests include headers of callers.
+func (x *Server) InboxHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if x.inbox == nil {
+			http.Error(w, "inbox is not enabled", http.StatusNotFound)
+			return
+		}
+
+		var v any
+		var err error
+		if id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/inbox"), "/"); id != "" {
+			v, err = x.inbox.box.Get(id)
+		} else {
+			v, err = x.inbox.box.List(r.URL.Query().Get("tunnel"))
+		}
+		switch {
+		case errors.Is(err, inbox.ErrNotFound):
+			http.Error(w, "inbox entry not found", http.StatusNotFound)
+			return
+		case err != nil:
+			logging.Extract(r.Context()).Error("failed to get inbox entries", "error", err)
+			http.Error(w, "failed to get inbox entries", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(v)
+	})
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/m-mizutani/backstream/pkg/service/inbox"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Inbox(t *testing.T) {
+	logging.Disable()
+
+	box, err := inbox.Open(filepath.Join(t.TempDir(), "inbox.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = box.Close() })
+
+	s := New(hub.New(), WithInbox(box, http.StatusAccepted, "queued"))
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	inboxSrv := httptest.NewServer(s.InboxHandler())
+	t.Cleanup(inboxSrv.Close)
+
+	post := func(body string) string {
+		resp, err := http.Post(srv.URL+"/hook?n=1", "text/plain", strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+		assert.Equal(t, "queued", string(data))
+		return resp.Header.Get(HeaderInboxID)
+	}
+	getEntry := func(id string) *inbox.Entry {
+		resp, err := http.Get(inboxSrv.URL + "/inbox/" + id)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var entry inbox.Entry
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&entry))
+		return &entry
+	}
+
+	var ids []string
+	for _, body := range []string{"first", "second", "third"} {
+		ids = append(ids, post(body))
+	}
+	assert.Equal(t, inbox.StatusPending, getEntry(ids[0]).Status)
+
+	var (
+		mutex    sync.Mutex
+		received []string
+	)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		received = append(received, r.URL.Path+"?"+r.URL.RawQuery+" "+string(body))
+		mutex.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(local.Close)
+	connectClient(t, srv.URL, local.URL)
+
+	require.Eventually(t, func() bool {
+		pending, err := box.Pending("default")
+		return err == nil && !pending
+	}, 3*time.Second, 10*time.Millisecond, "inbox entries are not replayed")
+
+	mutex.Lock()
+	assert.Equal(t, []string{"/hook?n=1 first", "/hook?n=1 second", "/hook?n=1 third"}, received)
+	mutex.Unlock()
+
+	for _, id := range ids {
+		entry := getEntry(id)
+		assert.Equal(t, inbox.StatusDelivered, entry.Status)
+		assert.Equal(t, http.StatusCreated, entry.Code)
+	}
+
+	// Requests are relayed directly after the inbox is drained
+	resp, err := http.Post(srv.URL+"/hook", "text/plain", strings.NewReader("live"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get(HeaderInboxID))
+
+	assert.Equal(t, http.StatusNotFound, status(inboxSrv.URL+"/inbox/unknown"))
+}
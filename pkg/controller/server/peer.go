@@ -0,0 +1,325 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/m-mizutani/goerr/v2"
+)
+
+const (
+	// headerPeerSecret carries the shared secret of peers. Requests with the header are handled as internal requests from a peer.
+	headerPeerSecret = "Backstream-Peer-Secret"
+	// headerPeerTunnel and headerPeerStrip carry the destination of a public request routed by the peer that forwarded it.
+	headerPeerTunnel = "Backstream-Peer-Tunnel"
+	headerPeerStrip  = "Backstream-Peer-Strip"
+
+	// peerGossipPath is an internal endpoint to exchange tunnels owned by peers.
+	peerGossipPath = "/.backstream/peers/gossip"
+
+	// DefaultGossipInterval is an interval to exchange tunnels with peers.
+	DefaultGossipInterval = 2 * time.Second
+	// peerExpiration is a number of gossip intervals until a peer without update is regarded as dead.
+	peerExpiration = 5
+	// gossipBodyLimit is a max size of a gossip message.
+	gossipBodyLimit = 1024 * 1024
+)
+
+// peers forwards public requests to other server replicas that have clients of the tunnel. Replicas know tunnels of each other by gossip with a static list of peers.
+type peers struct {
+	self     string
+	urls     []string
+	secret   string
+	interval time.Duration
+	client   *http.Client
+
+	mutex sync.Mutex
+	nodes map[string]*peerNode
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// peerNode is tunnels owned by a replica. Version is increased by the owner whenever it announces tunnels, and the newer one wins on merge.
+type peerNode struct {
+	Tunnels []string `json:"tunnels"`
+	Version int64    `json:"version"`
+
+	// updatedAt is a local time when the node was updated, to expire dead replicas
+	updatedAt time.Time
+}
+
+type gossipMessage struct {
+	From  string               `json:"from"`
+	Nodes map[string]*peerNode `json:"nodes"`
+}
+
+// WithPeers enables forwarding of public requests among server replicas without an external broker. self is the URL of this replica to be reached from peers, and peers are URLs of other replicas. A public request for a tunnel without local clients is forwarded to a replica that has clients of the tunnel. Internal requests between replicas are authenticated by secret.
+func WithPeers(self string, peerURLs []string, secret string) Option {
+	return func(x *Server) {
+		x.peers = &peers{
+			self:     strings.TrimSuffix(self, "/"),
+			secret:   secret,
+			interval: DefaultGossipInterval,
+			client:   &http.Client{},
+			nodes:    make(map[string]*peerNode),
+			done:     make(chan struct{}),
+		}
+		for _, u := range peerURLs {
+			if u = strings.TrimSuffix(u, "/"); u != x.peers.self {
+				x.peers.urls = append(x.peers.urls, u)
+			}
+		}
+	}
+}
+
+// WithGossipInterval sets an interval to exchange tunnels with peers. The default is DefaultGossipInterval.
+func WithGossipInterval(d time.Duration) Option {
+	return func(x *Server) {
+		x.gossipInterval = d
+	}
+}
+
+// start runs gossip with peers in background until stop is called.
+func (x *peers) start(svc *hub.Service) {
+	ctx, cancel := context.WithCancel(context.Background())
+	x.cancel = cancel
+	x.client.Timeout = x.interval
+
+	go func() {
+		defer close(x.done)
+
+		ticker := time.NewTicker(x.interval)
+		defer ticker.Stop()
+
+		for {
+			x.gossip(ctx, svc.Tunnels())
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (x *peers) stop() {
+	x.cancel()
+	<-x.done
+}
+
+// gossip announces tunnels of this replica and exchanges known nodes with all peers.
+func (x *peers) gossip(ctx context.Context, tunnels []string) {
+	logger := logging.Default()
+
+	x.mutex.Lock()
+	self, ok := x.nodes[x.self]
+	if !ok {
+		self = &peerNode{}
+		x.nodes[x.self] = self
+	}
+	self.Tunnels = tunnels
+	self.Version = max(self.Version+1, time.Now().UnixNano())
+	self.updatedAt = time.Now()
+	x.mutex.Unlock()
+
+	for _, peer := range x.urls {
+		if err := x.exchange(ctx, peer); err != nil && ctx.Err() == nil {
+			logger.Debug("failed to gossip with peer", "peer", peer, "error", err)
+		}
+	}
+}
+
+func (x *peers) exchange(ctx context.Context, peer string) error {
+	raw, err := json.Marshal(x.message())
+	if err != nil {
+		return goerr.Wrap(err, "failed to marshal gossip message")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+peerGossipPath, bytes.NewReader(raw))
+	if err != nil {
+		return goerr.Wrap(err, "failed to create gossip request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerPeerSecret, x.secret)
+
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return goerr.Wrap(err, "failed to send gossip request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return goerr.New("gossip is rejected by peer", goerr.V("code", resp.StatusCode))
+	}
+
+	var msg gossipMessage
+	if err := json.NewDecoder(io.LimitReader(resp.Body, gossipBodyLimit)).Decode(&msg); err != nil {
+		return goerr.Wrap(err, "failed to decode gossip response")
+	}
+	x.merge(&msg)
+	return nil
+}
+
+// message returns nodes known by this replica that are not expired.
+func (x *peers) message() *gossipMessage {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	x.expire()
+	msg := &gossipMessage{From: x.self, Nodes: make(map[string]*peerNode, len(x.nodes))}
+	for u, node := range x.nodes {
+		v := *node
+		msg.Nodes[u] = &v
+	}
+	return msg
+}
+
+// merge takes newer nodes from msg. The node of this replica is updated only by itself.
+func (x *peers) merge(msg *gossipMessage) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	now := time.Now()
+	for u, node := range msg.Nodes {
+		if u == x.self || node == nil {
+			continue
+		}
+		if cur, ok := x.nodes[u]; ok && cur.Version >= node.Version {
+			continue
+		}
+		v := *node
+		v.updatedAt = now
+		x.nodes[u] = &v
+	}
+}
+
+// expire removes nodes that are not updated for a while. It must be called with mutex locked.
+func (x *peers) expire() {
+	deadline := time.Now().Add(-x.interval * peerExpiration)
+	for u, node := range x.nodes {
+		if u != x.self && node.updatedAt.Before(deadline) {
+			delete(x.nodes, u)
+		}
+	}
+}
+
+// owner returns URL of a replica that has clients of the tunnel, chosen at random. It returns false if no other replica has.
+func (x *peers) owner(tunnel string) (string, bool) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	x.expire()
+	var owners []string
+	for u, node := range x.nodes {
+		if u != x.self && slices.Contains(node.Tunnels, tunnel) {
+			owners = append(owners, u)
+		}
+	}
+	if len(owners) == 0 {
+		return "", false
+	}
+	return owners[rand.N(len(owners))], true
+}
+
+// authenticate checks the shared secret of a request from a peer.
+func (x *peers) authenticate(r *http.Request) bool {
+	v := r.Header.Get(headerPeerSecret)
+	return v != "" && subtle.ConstantTimeCompare([]byte(v), []byte(x.secret)) == 1
+}
+
+// peerTargetKey is a context key of the destination routed by the peer that forwarded the request.
+type peerTargetKey struct{}
+
+// handlePeer handles an internal request from a peer. A forwarded public request is returned with its destination in the context to be served by this replica, and nil is returned if the request has been handled.
+func (x *Server) handlePeer(w http.ResponseWriter, r *http.Request) *http.Request {
+	logger := logging.Extract(r.Context())
+
+	if x.peers == nil || !x.peers.authenticate(r) {
+		logger.Warn("invalid peer request", "remote", r.RemoteAddr, "path", r.URL.Path)
+		http.Error(w, "invalid peer secret", http.StatusForbidden)
+		return nil
+	}
+
+	if r.URL.Path == peerGossipPath && r.Header.Get(headerPeerTunnel) == "" {
+		var msg gossipMessage
+		if err := json.NewDecoder(io.LimitReader(r.Body, gossipBodyLimit)).Decode(&msg); err != nil {
+			http.Error(w, "invalid gossip message", http.StatusBadRequest)
+			return nil
+		}
+		x.peers.merge(&msg)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(x.peers.message()); err != nil {
+			logger.Warn("failed to send gossip response", "error", err)
+		}
+		return nil
+	}
+
+	t := target{tunnel: r.Header.Get(headerPeerTunnel), strip: r.Header.Get(headerPeerStrip)}
+	if t.tunnel == "" {
+		http.Error(w, "no tunnel of forwarded request", http.StatusBadRequest)
+		return nil
+	}
+	for _, name := range []string{headerPeerSecret, headerPeerTunnel, headerPeerStrip} {
+		r.Header.Del(name)
+	}
+	return r.WithContext(context.WithValue(r.Context(), peerTargetKey{}, t))
+}
+
+// forwardToPeer forwards the public request to a replica that has clients of the tunnel. It returns false if no replica has them or the request was already forwarded by a peer.
+func (x *Server) forwardToPeer(w http.ResponseWriter, r *http.Request) bool {
+	if x.peers == nil {
+		return false
+	}
+	if _, forwarded := r.Context().Value(peerTargetKey{}).(target); forwarded {
+		return false
+	}
+
+	t := x.route(r)
+	owner, ok := x.peers.owner(t.tunnel)
+	if !ok {
+		return false
+	}
+	ownerURL, err := url.Parse(owner)
+	if err != nil {
+		return false
+	}
+
+	logger := logging.Extract(r.Context())
+	logger.Info("forwarding request to peer", "peer", owner, "tunnel", t.tunnel, "method", r.Method, "path", r.URL.Path)
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(ownerURL)
+			pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+			pr.SetXForwarded()
+			pr.Out.Host = pr.In.Host
+			pr.Out.Header.Set(headerPeerSecret, x.peers.secret)
+			pr.Out.Header.Set(headerPeerTunnel, t.tunnel)
+			if t.strip != "" {
+				pr.Out.Header.Set(headerPeerStrip, t.strip)
+			}
+		},
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.Error("failed to forward request to peer", "error", err, "peer", owner, "tunnel", t.tunnel)
+			http.Error(w, "failed to forward request to peer", http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+	return true
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/backstream/pkg/controller/client"
+	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/m-mizutani/backstream/pkg/service/tunnel"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeers_Gossip(t *testing.T) {
+	var x Server
+	WithPeers("http://a:8080/", []string{"http://a:8080", "http://b:8080", "http://c:8080/"}, "secret")(&x)
+	p := x.peers
+	assert.Equal(t, []string{"http://b:8080", "http://c:8080"}, p.urls)
+
+	_, ok := p.owner("alice")
+	assert.False(t, ok)
+
+	p.merge(&gossipMessage{Nodes: map[string]*peerNode{
+		"http://a:8080": {Tunnels: []string{"alice"}, Version: 100},
+		"http://b:8080": {Tunnels: []string{"alice"}, Version: 2},
+	}})
+	owner, ok := p.owner("alice")
+	assert.True(t, ok)
+	assert.Equal(t, "http://b:8080", owner, "node of this replica must not be updated by others")
+
+	// Older version is ignored, and newer one is taken
+	p.merge(&gossipMessage{Nodes: map[string]*peerNode{"http://b:8080": {Tunnels: nil, Version: 1}}})
+	_, ok = p.owner("alice")
+	assert.True(t, ok)
+	p.merge(&gossipMessage{Nodes: map[string]*peerNode{"http://b:8080": {Tunnels: []string{"bob"}, Version: 3}}})
+	_, ok = p.owner("alice")
+	assert.False(t, ok)
+
+	// Nodes without update expire
+	p.mutex.Lock()
+	p.nodes["http://b:8080"].updatedAt = time.Now().Add(-p.interval * (peerExpiration + 1))
+	p.mutex.Unlock()
+	_, ok = p.owner("bob")
+	assert.False(t, ok)
+}
+
+func TestServer_Peers(t *testing.T) {
+	logging.Disable()
+
+	// Listen before starting replicas because each replica needs URLs of the others
+	listeners := make([]net.Listener, 2)
+	urls := make([]string, 2)
+	for i := range listeners {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners[i] = ln
+		urls[i] = "http://" + ln.Addr().String()
+	}
+	for i, ln := range listeners {
+		s := New(hub.New(),
+			WithPeers(urls[i], urls, "test-secret"),
+			WithGossipInterval(50*time.Millisecond),
+			WithRoutes(Route{Tunnel: "alice", PathPrefix: "/alice"}),
+		)
+		srv := httptest.NewUnstartedServer(s)
+		srv.Listener.Close()
+		srv.Listener = ln
+		srv.Start()
+		t.Cleanup(func() {
+			_ = s.Shutdown(context.Background())
+			srv.Close()
+		})
+	}
+	replicaA, replicaB := urls[0], urls[1]
+
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Host + " " + r.URL.Path))
+	}))
+	t.Cleanup(local.Close)
+
+	// The client subscribing "alice" is connected to replica B only
+	disconnect := connectService(t, replicaB, tunnel.New(local.URL, tunnel.WithPreserveHost()), client.WithTunnel("alice"))
+
+	t.Run("forward to replica of client", func(t *testing.T) {
+		waitStatus(t, replicaA+"/alice/hook", http.StatusOK)
+
+		req, err := http.NewRequest(http.MethodGet, replicaA+"/alice/hook", nil)
+		require.NoError(t, err)
+		req.Host = "public.example.com"
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "public.example.com /alice/hook", string(body))
+
+		// Tunnels without client on any replica are not forwarded
+		assert.Equal(t, http.StatusServiceUnavailable, status(replicaA+"/other"))
+	})
+
+	t.Run("reject invalid secret", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, replicaB+"/alice/hook", nil)
+		require.NoError(t, err)
+		req.Header.Set(headerPeerSecret, "wrong")
+		req.Header.Set(headerPeerTunnel, "alice")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+		req, err = http.NewRequest(http.MethodPost, replicaB+peerGossipPath, strings.NewReader(`{"nodes":{}}`))
+		require.NoError(t, err)
+		req.Header.Set(headerPeerSecret, "wrong")
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("no client after client left", func(t *testing.T) {
+		disconnect()
+		waitStatus(t, replicaA+"/alice/hook", http.StatusServiceUnavailable)
+	})
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/m-mizutani/goerr/v2"
+)
+
+var ErrNoPortAvailable = errors.New("no port available")
+
+// portPool allocates listening ports for tunnels of TCP and UDP clients from a range.
+type portPool struct {
+	host     string
+	min, max int
+
+	mutex sync.Mutex
+	used  map[int]bool
+}
+
+func newPortPool(host string, min, max int) *portPool {
+	return &portPool{
+		host: host,
+		min:  min,
+		max:  max,
+		used: make(map[int]bool),
+	}
+}
+
+// listen opens a TCP listener on a port that is not used by other tunnels.
+func (x *portPool) listen() (net.Listener, int, error) {
+	var ln net.Listener
+	port, err := x.allocate(func(addr string) (err error) {
+		ln, err = net.Listen("tcp", addr)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return ln, port, nil
+}
+
+// listenPacket opens a UDP socket on a port that is not used by other tunnels.
+func (x *portPool) listenPacket() (net.PacketConn, int, error) {
+	var pc net.PacketConn
+	port, err := x.allocate(func(addr string) (err error) {
+		pc, err = net.ListenPacket("udp", addr)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return pc, port, nil
+}
+
+func (x *portPool) allocate(open func(addr string) error) (int, error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	for port := x.min; port <= x.max; port++ {
+		if x.used[port] {
+			continue
+		}
+
+		if err := open(net.JoinHostPort(x.host, strconv.Itoa(port))); err != nil {
+			// The port may be used by another process
+			continue
+		}
+
+		x.used[port] = true
+		return port, nil
+	}
+
+	return 0, goerr.Wrap(ErrNoPortAvailable, "all ports are used", goerr.V("min", x.min), goerr.V("max", x.max))
+}
+
+func (x *portPool) release(port int) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	delete(x.used, port)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/utils/urlutil"
+	"github.com/m-mizutani/goerr/v2"
+)
+
+// ErrPrefixConflict is returned when a path prefix is already registered by another tunnel or with another strip option.
+var ErrPrefixConflict = errors.New("path prefix conflict")
+
+// prefixRegistry has path prefixes registered by clients. Clients of the same tunnel can register the same prefix, and the prefix is removed when all of them left.
+type prefixRegistry struct {
+	mutex   sync.RWMutex
+	entries map[string]*prefixEntry
+}
+
+type prefixEntry struct {
+	tunnel string
+	strip  bool
+	refs   int
+}
+
+func newPrefixRegistry() *prefixRegistry {
+	return &prefixRegistry{entries: make(map[string]*prefixEntry)}
+}
+
+// register adds prefixes for the tunnel. No prefix is registered if any of them conflicts.
+func (x *prefixRegistry) register(tunnel string, prefixes []string, strip bool) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	for _, prefix := range prefixes {
+		if e, ok := x.entries[prefix]; ok && (e.tunnel != tunnel || e.strip != strip) {
+			return goerr.Wrap(ErrPrefixConflict, "path prefix is already registered by another client", goerr.V("prefix", prefix))
+		}
+	}
+
+	for _, prefix := range prefixes {
+		e, ok := x.entries[prefix]
+		if !ok {
+			e = &prefixEntry{tunnel: tunnel, strip: strip}
+			x.entries[prefix] = e
+		}
+		e.refs++
+	}
+	return nil
+}
+
+func (x *prefixRegistry) unregister(prefixes []string) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	for _, prefix := range prefixes {
+		if e, ok := x.entries[prefix]; ok {
+			if e.refs--; e.refs <= 0 {
+				delete(x.entries, prefix)
+			}
+		}
+	}
+}
+
+// lookup returns the longest registered prefix that matches path at a segment boundary.
+func (x *prefixRegistry) lookup(path string) (string, *prefixEntry) {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	var (
+		matched string
+		entry   *prefixEntry
+	)
+	for prefix, e := range x.entries {
+		if len(prefix) > len(matched) && urlutil.MatchPrefix(path, prefix) {
+			matched, entry = prefix, e
+		}
+	}
+	return matched, entry
+}
+
+// pathPrefixes returns normalized path prefixes requested by the client.
+func pathPrefixes(r *http.Request) ([]string, error) {
+	var prefixes []string
+	for _, v := range r.Header.Values(model.HeaderPathPrefix) {
+		for _, prefix := range strings.Split(v, ",") {
+			prefix = strings.TrimSpace(prefix)
+			if prefix == "" {
+				continue
+			}
+			if !strings.HasPrefix(prefix, "/") {
+				return nil, goerr.New("path prefix must start with '/'", goerr.V("prefix", prefix))
+			}
+			if prefix != "/" {
+				prefix = strings.TrimSuffix(prefix, "/")
+			}
+			if !slices.Contains(prefixes, prefix) {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+	}
+	return prefixes, nil
+}
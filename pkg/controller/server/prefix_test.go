@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/m-mizutani/backstream/pkg/controller/client"
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/m-mizutani/backstream/pkg/service/tunnel"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/m-mizutani/goerr/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixRegistry(t *testing.T) {
+	registry := newPrefixRegistry()
+	require.NoError(t, registry.register("github", []string{"/github"}, false))
+	require.NoError(t, registry.register("app", []string{"/github/app", "/app"}, true))
+
+	t.Run("longest prefix wins", func(t *testing.T) {
+		testCases := map[string]struct {
+			path   string
+			prefix string
+			tunnel string
+		}{
+			"exact":           {path: "/github", prefix: "/github", tunnel: "github"},
+			"under prefix":    {path: "/github/push", prefix: "/github", tunnel: "github"},
+			"longer prefix":   {path: "/github/app/hook", prefix: "/github/app", tunnel: "app"},
+			"segment unmatch": {path: "/githubx", prefix: ""},
+			"no match":        {path: "/slack", prefix: ""},
+		}
+		for name, tc := range testCases {
+			t.Run(name, func(t *testing.T) {
+				prefix, e := registry.lookup(tc.path)
+				assert.Equal(t, tc.prefix, prefix)
+				if tc.prefix == "" {
+					assert.Nil(t, e)
+					return
+				}
+				require.NotNil(t, e)
+				assert.Equal(t, tc.tunnel, e.tunnel)
+			})
+		}
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		err := registry.register("bob", []string{"/slack", "/github"}, false)
+		assert.True(t, errors.Is(err, ErrPrefixConflict))
+		assert.Equal(t, "/github", goerr.Values(err)["prefix"])
+
+		// No prefix is registered by the rejected client
+		_, e := registry.lookup("/slack")
+		assert.Nil(t, e)
+
+		// Different strip option of the same tunnel also conflicts
+		assert.Error(t, registry.register("github", []string{"/github"}, true))
+	})
+
+	t.Run("shared by the same tunnel", func(t *testing.T) {
+		require.NoError(t, registry.register("github", []string{"/github"}, false))
+		registry.unregister([]string{"/github"})
+		_, e := registry.lookup("/github")
+		assert.NotNil(t, e)
+
+		registry.unregister([]string{"/github"})
+		_, e = registry.lookup("/github")
+		assert.Nil(t, e)
+	})
+}
+
+func TestPathPrefixes(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Add(model.HeaderPathPrefix, "/github/, /slack")
+	r.Header.Add(model.HeaderPathPrefix, "/slack")
+	prefixes, err := pathPrefixes(r)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/github", "/slack"}, prefixes)
+
+	r.Header.Set(model.HeaderPathPrefix, "github")
+	_, err = pathPrefixes(r)
+	assert.Error(t, err)
+}
+
+func TestServer_PathPrefix(t *testing.T) {
+	logging.Disable()
+
+	srv := httptest.NewServer(New(hub.New()))
+	t.Cleanup(srv.Close)
+
+	echoPath := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name + ":" + r.URL.Path + ":" + r.Header.Get("X-Forwarded-Prefix")))
+		})
+	}
+	github := httptest.NewServer(echoPath("github"))
+	t.Cleanup(github.Close)
+	app := httptest.NewServer(echoPath("app"))
+	t.Cleanup(app.Close)
+
+	connectClient(t, srv.URL, github.URL, client.WithPathPrefix("/github"))
+	connectClient(t, srv.URL, app.URL, client.WithPathPrefix("/github/app"), client.WithStripPrefix())
+
+	// Wait until both clients are connected
+	waitStatus(t, srv.URL+"/github", http.StatusOK)
+	waitStatus(t, srv.URL+"/github/app", http.StatusOK)
+
+	testCases := map[string]struct {
+		path   string
+		code   int
+		expect string
+	}{
+		"prefix":          {path: "/github/push", code: http.StatusOK, expect: "github:/github/push:"},
+		"longest prefix":  {path: "/github/app/hook", code: http.StatusOK, expect: "app:/hook:/github/app"},
+		"strip to root":   {path: "/github/app", code: http.StatusOK, expect: "app:/:/github/app"},
+		"segment unmatch": {path: "/github-x", code: http.StatusServiceUnavailable},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			resp, err := http.Get(srv.URL + tc.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.code, resp.StatusCode)
+			if tc.code == http.StatusOK {
+				assert.Equal(t, tc.expect, string(body))
+			}
+		})
+	}
+
+	t.Run("conflict is rejected", func(t *testing.T) {
+		err := client.New(tunnel.New(github.URL), srv.URL,
+			client.WithTunnel("other"),
+			client.WithPathPrefix("/slack", "/github"),
+		).Connect(context.Background())
+		require.Error(t, err)
+		assert.Equal(t, http.StatusConflict, goerr.Values(err)["status"])
+		assert.Contains(t, goerr.Values(err)["message"], "/github")
+	})
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/m-mizutani/backstream/pkg/utils/relay"
+)
+
+// handleWebSocketProxy proxies a WebSocket connection from an external caller to the local application via the tunnel.
+func (x *Server) handleWebSocketProxy(w http.ResponseWriter, r *http.Request) {
+	logger := logging.Extract(r.Context())
+
+	if x.policy != nil {
+		if err := checkAuthPolicy(r.Context(), x.policy, r, "data.auth.server"); err != nil {
+			logger.Error("auth policy failed", "error", err)
+			http.Error(w, "auth policy denied", http.StatusForbidden)
+			return
+		}
+	}
+
+	req, tunnel := x.newRequest(r)
+	logger.Debug("received WebSocket request", "request", req, "tunnel", tunnel)
+
+	ctx, cancel := x.responseContext(r.Context())
+	defer cancel()
+
+	stream, err := x.svc.EmitAndWait(ctx, tunnel, req, nil)
+	if errors.Is(err, hub.ErrNoClient) && x.forwardToPeer(w, r) {
+		return
+	}
+	if err != nil {
+		x.writeEmitError(w, r, tunnel, err)
+		return
+	}
+	defer stream.Close()
+
+	resp := stream.Response()
+	if resp.Code != http.StatusSwitchingProtocols {
+		// The local application rejected the upgrade
+		logger.Warn("WebSocket upgrade rejected by local", "id", resp.ID, "code", resp.Code)
+		if err := writeResponse(w, resp, stream); err != nil {
+			logger.Error("failed to send response body", "error", err, "id", resp.ID)
+		}
+		return
+	}
+
+	// Sec-WebSocket-Protocol in response header is used as the selected subprotocol by Upgrader
+	header := http.Header{}
+	respHeader := http.Header(resp.Header)
+	if protocol := respHeader.Get("Sec-Websocket-Protocol"); protocol != "" {
+		header.Set("Sec-Websocket-Protocol", protocol)
+	}
+	for _, cookie := range respHeader.Values("Set-Cookie") {
+		header.Add("Set-Cookie", cookie)
+	}
+
+	ws, err := x.upgrade(w, r, header)
+	if err != nil || ws == nil {
+		logger.Error("failed to upgrade", "error", err)
+		_ = stream.CloseSend(&websocket.CloseError{Code: websocket.CloseGoingAway})
+		return
+	}
+	defer ws.Close()
+	logger.Info("proxying WebSocket", "id", req.ID, "path", req.Path, "remote", ws.RemoteAddr())
+
+	if err := relay.WebSocket(r.Context(), ws, stream); err != nil {
+		logger.Warn("WebSocket proxy closed abnormally", "error", err, "id", req.ID)
+	}
+	logger.Info("closed WebSocket proxy", "id", req.ID)
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/m-mizutani/backstream/pkg/service/tunnel"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Replicas(t *testing.T) {
+	logging.Disable()
+
+	testCases := map[string]func(t *testing.T) (hub.Backend, hub.Backend){
+		"memory": func(t *testing.T) (hub.Backend, hub.Backend) {
+			backend := hub.NewMemoryBackend()
+			return backend, backend
+		},
+		"redis": func(t *testing.T) (hub.Backend, hub.Backend) {
+			mr := miniredis.RunT(t)
+			newBackend := func() hub.Backend {
+				rc := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+				t.Cleanup(func() { _ = rc.Close() })
+				return hub.NewRedisBackend(rc)
+			}
+			return newBackend(), newBackend()
+		},
+	}
+
+	for name, newBackends := range testCases {
+		t.Run(name, func(t *testing.T) {
+			backendA, backendB := newBackends(t)
+			newReplica := func(backend hub.Backend) string {
+				svc := hub.New(hub.WithBackend(backend))
+				t.Cleanup(svc.Close)
+				srv := httptest.NewServer(New(svc))
+				t.Cleanup(srv.Close)
+				return srv.URL
+			}
+			replicaA, replicaB := newReplica(backendA), newReplica(backendB)
+
+			local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/hash":
+					h := sha256.New()
+					_, _ = io.Copy(h, r.Body)
+					_, _ = w.Write(h.Sum(nil))
+				case "/download":
+					_, _ = w.Write(make([]byte, 1024*1024))
+				}
+			}))
+			t.Cleanup(local.Close)
+
+			// The client is connected to replica B only
+			disconnect := connectService(t, replicaB, tunnel.New(local.URL))
+			waitStatus(t, replicaA+"/", http.StatusOK)
+
+			// Large bodies require acks of flow control across replicas
+			body := make([]byte, 1024*1024)
+			_, err := rand.Read(body)
+			require.NoError(t, err)
+			expect := sha256.Sum256(body)
+			resp, err := http.Post(replicaA+"/hash", "application/octet-stream", bytes.NewReader(body))
+			require.NoError(t, err)
+			got, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, expect[:], got)
+
+			resp, err = http.Get(replicaA + "/download")
+			require.NoError(t, err)
+			n, err := io.Copy(io.Discard, resp.Body)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, int64(1024*1024), n)
+
+			disconnect()
+			waitStatus(t, replicaA+"/", http.StatusServiceUnavailable)
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/utils/urlutil"
+	"github.com/m-mizutani/goerr/v2"
+)
+
+// Route is a rule to select the tunnel of a public request. Exactly one of Host, PathPrefix and Header should be set.
+type Route struct {
+	Tunnel string
+
+	// Host matches the host name of the request without port.
+	Host string
+	// PathPrefix matches the request path that is the prefix or under the prefix, e.g. "/github" matches "/github/push" but not "/githubber".
+	PathPrefix string
+	// Header and Value match a request header. Any value matches if Value is empty.
+	Header string
+	Value  string
+}
+
+func (x Route) match(r *http.Request) bool {
+	switch {
+	case x.Host != "":
+		return strings.EqualFold(urlutil.StripPort(r.Host), x.Host)
+
+	case x.PathPrefix != "":
+		return urlutil.MatchPrefix(r.URL.Path, x.PathPrefix)
+
+	case x.Header != "":
+		values, ok := r.Header[http.CanonicalHeaderKey(x.Header)]
+		if !ok {
+			return false
+		}
+		if x.Value == "" {
+			return true
+		}
+		for _, v := range values {
+			if v == x.Value {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ParseRoute parses a route in "<tunnel>=<kind>:<pattern>" format. kind is one of "host", "path" and "header", and pattern of header is "<name>" or "<name>:<value>". e.g. "alice=host:alice.example.com", "github=path:/github", "bob=header:X-Tunnel:bob".
+func ParseRoute(v string) (Route, error) {
+	tunnel, rule, found := strings.Cut(v, "=")
+	if !found {
+		return Route{}, goerr.New("route must be in '<tunnel>=<kind>:<pattern>' format", goerr.V("route", v))
+	}
+	if err := model.ValidateTunnelName(tunnel); err != nil {
+		return Route{}, goerr.Wrap(err, "invalid tunnel name of route", goerr.V("route", v))
+	}
+
+	kind, pattern, _ := strings.Cut(rule, ":")
+	if pattern == "" {
+		return Route{}, goerr.New("route pattern is empty", goerr.V("route", v))
+	}
+
+	route := Route{Tunnel: tunnel}
+	switch kind {
+	case "host":
+		route.Host = pattern
+	case "path":
+		if !strings.HasPrefix(pattern, "/") {
+			return Route{}, goerr.New("path prefix must start with '/'", goerr.V("route", v))
+		}
+		if pattern != "/" {
+			pattern = strings.TrimSuffix(pattern, "/")
+		}
+		route.PathPrefix = pattern
+	case "header":
+		route.Header, route.Value, _ = strings.Cut(pattern, ":")
+	default:
+		return Route{}, goerr.New("unsupported route kind", goerr.V("route", v), goerr.V("kind", kind))
+	}
+
+	return route, nil
+}
+
+// WithRoutes sets routes to select the tunnel of public requests. Routes are evaluated in order and the first matched route is used. Requests that match no route are sent to model.DefaultTunnel.
+func WithRoutes(routes ...Route) Option {
+	return func(x *Server) {
+		x.routes = append(x.routes, routes...)
+	}
+}
+
+// target is a destination of a public request.
+type target struct {
+	tunnel string
+	// strip is a path prefix to be removed before forwarding
+	strip string
+}
+
+// route returns the destination of the public request. Routes are evaluated first, then virtual hosts, and then path prefixes registered by clients. A request forwarded by a peer keeps the destination routed by the peer.
+func (x *Server) route(r *http.Request) target {
+	if t, ok := r.Context().Value(peerTargetKey{}).(target); ok {
+		return t
+	}
+	for _, route := range x.routes {
+		if route.match(r) {
+			return target{tunnel: route.Tunnel}
+		}
+	}
+	if name, ok := x.vhostTunnel(r); ok {
+		return target{tunnel: name}
+	}
+	if prefix, e := x.prefixes.lookup(r.URL.Path); e != nil {
+		t := target{tunnel: e.tunnel}
+		if e.strip {
+			t.strip = prefix
+		}
+		return t
+	}
+	return target{tunnel: model.DefaultTunnel}
+}
+
+// newRequest creates a request head to be sent to the tunnel routed from r.
+func (x *Server) newRequest(r *http.Request) (*model.Request, string) {
+	t := x.route(r)
+	req := model.NewRequest(r)
+	if t.strip != "" {
+		req.StripPrefix(t.strip)
+	}
+	return req, t.tunnel
+}
+
+// tunnelName returns the tunnel name requested by the client. A random name is assigned if the client does not request it and virtual hosting is enabled or the client registers path prefixes.
+func (x *Server) tunnelName(r *http.Request, hasPrefix bool) (string, error) {
+	name := r.Header.Get(model.HeaderTunnel)
+	switch {
+	case name == "" && (x.vhost != nil || hasPrefix):
+		return randomTunnelName(), nil
+	case name == "":
+		return model.DefaultTunnel, nil
+	}
+
+	if err := model.ValidateTunnelName(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/backstream/pkg/controller/client"
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRoute(t *testing.T) {
+	testCases := map[string]struct {
+		input  string
+		expect Route
+		err    bool
+	}{
+		"host":              {input: "alice=host:alice.example.com", expect: Route{Tunnel: "alice", Host: "alice.example.com"}},
+		"path":              {input: "github=path:/github", expect: Route{Tunnel: "github", PathPrefix: "/github"}},
+		"path with slash":   {input: "github=path:/github/", expect: Route{Tunnel: "github", PathPrefix: "/github"}},
+		"header":            {input: "bob=header:X-Tunnel", expect: Route{Tunnel: "bob", Header: "X-Tunnel"}},
+		"header with value": {input: "bob=header:X-Tunnel:bob", expect: Route{Tunnel: "bob", Header: "X-Tunnel", Value: "bob"}},
+		"no tunnel":         {input: "host:alice.example.com", err: true},
+		"invalid tunnel":    {input: "Alice=host:alice.example.com", err: true},
+		"unknown kind":      {input: "alice=query:alice", err: true},
+		"empty pattern":     {input: "alice=host:", err: true},
+		"relative path":     {input: "alice=path:github", err: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			route, err := ParseRoute(tc.input)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expect, route)
+		})
+	}
+}
+
+func TestServer_Route(t *testing.T) {
+	server := New(nil, WithRoutes(
+		Route{Tunnel: "alice", Host: "alice.example.com"},
+		Route{Tunnel: "github", PathPrefix: "/github"},
+		Route{Tunnel: "bob", Header: "X-Tunnel", Value: "bob"},
+	))
+
+	testCases := map[string]struct {
+		host   string
+		path   string
+		header map[string]string
+		expect string
+	}{
+		"host":              {host: "alice.example.com", path: "/github", expect: "alice"},
+		"host with port":    {host: "alice.example.com:8080", path: "/", expect: "alice"},
+		"path":              {host: "example.com", path: "/github/push", expect: "github"},
+		"path exactly":      {host: "example.com", path: "/github", expect: "github"},
+		"path not segment":  {host: "example.com", path: "/githubber", expect: model.DefaultTunnel},
+		"header":            {host: "example.com", path: "/", header: map[string]string{"X-Tunnel": "bob"}, expect: "bob"},
+		"header mismatched": {host: "example.com", path: "/", header: map[string]string{"X-Tunnel": "carol"}, expect: model.DefaultTunnel},
+		"no match":          {host: "example.com", path: "/", expect: model.DefaultTunnel},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tc.path, nil)
+			r.Host = tc.host
+			for k, v := range tc.header {
+				r.Header.Set(k, v)
+			}
+			assert.Equal(t, tc.expect, server.route(r).tunnel)
+		})
+	}
+}
+
+func TestServer_NamedTunnel(t *testing.T) {
+	logging.Disable()
+
+	srv := httptest.NewServer(New(hub.New(), WithRoutes(
+		Route{Tunnel: "alice", PathPrefix: "/alice"},
+		Route{Tunnel: "bob", Header: "X-Tunnel", Value: "bob"},
+	)))
+	t.Cleanup(srv.Close)
+
+	alice, bob := &countingApp{name: "alice"}, &countingApp{name: "bob"}
+	for _, app := range []*countingApp{alice, bob} {
+		local := httptest.NewServer(app)
+		t.Cleanup(local.Close)
+		connectClient(t, srv.URL, local.URL, client.WithTunnel(app.name))
+	}
+
+	get := func(path, tunnelHeader string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		require.NoError(t, err)
+		if tunnelHeader != "" {
+			req.Header.Set("X-Tunnel", tunnelHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	// Wait until both clients are connected
+	waitStatus(t, srv.URL+"/alice", http.StatusOK)
+	require.Eventually(t, func() bool {
+		code, _ := get("/", "bob")
+		return code == http.StatusOK
+	}, 3*time.Second, 10*time.Millisecond, "client of bob is not connected")
+	alice.count.Store(0)
+	bob.count.Store(0)
+
+	for i := 0; i < 5; i++ {
+		code, body := get("/alice/hook", "")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "alice", body)
+
+		code, body = get("/hook", "bob")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "bob", body)
+	}
+
+	// Requests are not sent to clients of other tunnels
+	assert.Equal(t, int64(5), alice.count.Load())
+	assert.Equal(t, int64(5), bob.count.Load())
+
+	// The default tunnel has no client
+	assert.Equal(t, http.StatusServiceUnavailable, status(srv.URL+"/hook"))
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/m-mizutani/goerr/v2"
+)
+
+const (
+	// goingAwayReason is a reason of the close frame sent to clients on shutdown.
+	goingAwayReason = "server going away"
+	// goingAwayTimeout is a max duration to wait for clients to reply the close frame.
+	goingAwayTimeout = time.Second
+)
+
+// drainer tracks public requests and client connections in progress for graceful shutdown.
+type drainer struct {
+	mutex    sync.Mutex
+	draining bool
+	// stopping is closed when the server starts shutdown
+	stopping chan struct{}
+
+	requests sync.WaitGroup
+	clients  sync.WaitGroup
+
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func newDrainer() *drainer {
+	return &drainer{stopping: make(chan struct{}), closing: make(chan struct{})}
+}
+
+// enter adds a task to wg. It returns false if the server is shutting down.
+func (x *drainer) enter(wg *sync.WaitGroup) bool {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if x.draining {
+		return false
+	}
+	wg.Add(1)
+	return true
+}
+
+func (x *drainer) start() {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if !x.draining {
+		x.draining = true
+		close(x.stopping)
+	}
+}
+
+// closeClients tells handlers of client connections to close them.
+func (x *drainer) closeClients() {
+	x.closeOnce.Do(func() { close(x.closing) })
+}
+
+// wait waits for wg until ctx is done.
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops accepting new requests and clients, and waits for requests in progress until ctx is done. Then it closes client connections with a close frame of "server going away" so that clients reconnect to another server.
+func (x *Server) Shutdown(ctx context.Context) error {
+	logger := logging.Extract(ctx)
+
+	x.drain.start()
+	if x.peers != nil {
+		// Keep gossip while draining so that peers know tunnels of closed clients
+		defer x.peers.stop()
+	}
+	logger.Info("draining in-flight requests")
+	if err := wait(ctx, &x.drain.requests); err != nil {
+		logger.Warn("in-flight requests remain after shutdown deadline", "error", err)
+	}
+	// Stop replay after the drain so that requests stored in the inbox during the drain are also replayed to connected clients. Entries left pending are replayed after restart.
+	if x.inbox != nil {
+		x.inbox.stop()
+	}
+
+	x.drain.closeClients()
+	// Give clients a moment to reply the close frame even if ctx is already done
+	closeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), goingAwayTimeout)
+	defer cancel()
+	if err := wait(closeCtx, &x.drain.clients); err != nil {
+		return goerr.Wrap(err, "failed to close client connections")
+	}
+
+	logger.Info("server is shut down")
+	return nil
+}
+
+// closeGoingAway sends the close frame of shutdown to the client.
+func closeGoingAway(ws *websocket.Conn) error {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, goingAwayReason)
+	if err := ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(goingAwayTimeout)); err != nil {
+		return goerr.Wrap(err, "failed to send close frame")
+	}
+	return nil
+}
+
+func writeShuttingDown(w http.ResponseWriter) {
+	w.Header().Set("Connection", "close")
+	http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/m-mizutani/backstream/pkg/utils/flow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Shutdown(t *testing.T) {
+	server := New(hub.New())
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), http.Header{"Backstream-Client": {"test"}})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	write := func(frame *model.Frame) {
+		messageType, message, err := model.CodecJSON.Encode(frame)
+		require.NoError(t, err)
+		require.NoError(t, conn.WriteMessage(messageType, message))
+	}
+	read := func() (*model.Frame, error) {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		return model.DecodeFrame(messageType, message)
+	}
+
+	write(&model.Frame{Type: model.FrameHello, Hello: &model.Hello{ProtocolVersion: model.ProtocolVersion}})
+	_, err = read()
+	require.NoError(t, err)
+
+	// Send a public request and hold it in the client
+	type result struct {
+		code int
+		body string
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(srv.URL + "/slow")
+		if err != nil {
+			resultCh <- result{}
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		resultCh <- result{code: resp.StatusCode, body: string(body)}
+	}()
+
+	var reqID string
+	for reqID == "" {
+		frame, err := read()
+		require.NoError(t, err)
+		if frame.Type == model.FrameRequest {
+			reqID = frame.ID
+		}
+	}
+
+	shutdownCh := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownCh <- server.Shutdown(ctx)
+	}()
+
+	// New requests are refused while draining
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get(srv.URL + "/new")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode == http.StatusServiceUnavailable
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// The in-flight request completes
+	write(&model.Frame{Type: model.FrameResponse, ID: reqID, Response: &model.Response{ID: reqID, Code: http.StatusOK}})
+	write(model.NewDataFrame(reqID, flow.Chunk{Data: []byte("done")}))
+	write(model.NewEndFrame(reqID, nil))
+
+	select {
+	case r := <-resultCh:
+		assert.Equal(t, http.StatusOK, r.code)
+		assert.Equal(t, "done", r.body)
+	case <-time.After(3 * time.Second):
+		t.Fatal("in-flight request is not completed")
+	}
+
+	// Then the client is told to go away
+	for {
+		_, err := read()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		require.ErrorAs(t, err, &closeErr)
+		assert.Equal(t, websocket.CloseGoingAway, closeErr.Code)
+		assert.Equal(t, goingAwayReason, closeErr.Text)
+		break
+	}
+
+	select {
+	case err := <-shutdownCh:
+		require.NoError(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("shutdown is not completed")
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/m-mizutani/backstream/pkg/utils/relay"
+)
+
+// serveTCP accepts connections from ln and relays them to the client until ln is closed.
+func (x *Server) serveTCP(ctx context.Context, ln net.Listener, clientID string) {
+	logger := logging.Extract(ctx)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Error("failed to accept TCP connection", "error", err)
+			}
+			return
+		}
+
+		go x.handleTCP(ctx, conn, clientID)
+	}
+}
+
+func (x *Server) handleTCP(ctx context.Context, conn net.Conn, clientID string) {
+	logger := logging.Extract(ctx)
+	defer conn.Close()
+
+	req := &model.Request{
+		ID:            uuid.New().String(),
+		Method:        http.MethodConnect,
+		ContentLength: -1,
+		Remote:        conn.RemoteAddr().String(),
+		Header:        http.Header{},
+	}
+
+	stream, err := x.svc.Open(ctx, clientID, req)
+	if err != nil {
+		logger.Error("failed to open TCP stream", "error", err, "remote", req.Remote)
+		return
+	}
+	defer stream.Close()
+
+	if resp := stream.Response(); resp.Code != http.StatusOK {
+		logger.Warn("TCP connection refused by client", "id", req.ID, "code", resp.Code)
+		return
+	}
+
+	logger.Info("relaying TCP connection", "id", req.ID, "remote", req.Remote)
+	if err := relay.Conn(ctx, conn, stream); err != nil {
+		logger.Warn("TCP relay closed abnormally", "error", err, "id", req.ID)
+	}
+	logger.Info("closed TCP connection", "id", req.ID)
+}
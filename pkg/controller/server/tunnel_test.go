@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/backstream/pkg/controller/client"
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingApp is a local application where /slow blocks until release is closed.
+type blockingApp struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingApp() *blockingApp {
+	return &blockingApp{started: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (x *blockingApp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/slow" {
+		x.started <- struct{}{}
+		<-x.release
+	}
+	_, _ = w.Write([]byte(r.URL.Path))
+}
+
+func TestServer_LoadBalance(t *testing.T) {
+	logging.Disable()
+
+	get := func(srvURL, path string) string {
+		resp, err := http.Get(srvURL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return ""
+		}
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	t.Run("round-robin", func(t *testing.T) {
+		srv := httptest.NewServer(New(hub.New(hub.WithStrategy(model.DefaultTunnel, hub.StrategyRoundRobin))))
+		t.Cleanup(srv.Close)
+
+		apps := []*countingApp{{name: "a"}, {name: "b"}}
+		for _, app := range apps {
+			local := httptest.NewServer(app)
+			t.Cleanup(local.Close)
+			connectClient(t, srv.URL, local.URL)
+		}
+
+		// Wait until both clients receive requests
+		require.Eventually(t, func() bool {
+			get(srv.URL, "/")
+			return apps[0].count.Load() > 0 && apps[1].count.Load() > 0
+		}, 3*time.Second, 5*time.Millisecond, "clients are not connected")
+
+		// Align the turn to the first client
+		require.Eventually(t, func() bool {
+			return get(srv.URL, "/") == "b"
+		}, time.Second, time.Millisecond, "requests are not distributed in turn")
+		apps[0].count.Store(0)
+		apps[1].count.Store(0)
+
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, apps[i%2].name, get(srv.URL, "/"))
+		}
+		assert.Equal(t, int64(5), apps[0].count.Load())
+		assert.Equal(t, int64(5), apps[1].count.Load())
+	})
+
+	t.Run("least-in-flight", func(t *testing.T) {
+		srv := httptest.NewServer(New(hub.New(hub.WithDefaultStrategy(hub.StrategyLeastInFlight))))
+		t.Cleanup(srv.Close)
+
+		named := func(name string, app http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/" {
+					_, _ = w.Write([]byte(name))
+					return
+				}
+				app.ServeHTTP(w, r)
+			})
+		}
+
+		busy := newBlockingApp()
+		localA := httptest.NewServer(named("a", busy))
+		t.Cleanup(localA.Close)
+		connectClient(t, srv.URL, localA.URL)
+		waitStatus(t, srv.URL+"/", http.StatusOK)
+
+		// Make the first client busy
+		slow := make(chan string, 1)
+		go func() { slow <- get(srv.URL, "/slow") }()
+		<-busy.started
+		defer func() {
+			close(busy.release)
+			assert.Equal(t, "/slow", <-slow)
+		}()
+
+		localB := httptest.NewServer(named("b", http.NotFoundHandler()))
+		t.Cleanup(localB.Close)
+		connectClient(t, srv.URL, localB.URL)
+		require.Eventually(t, func() bool {
+			return get(srv.URL, "/") == "b"
+		}, 3*time.Second, 10*time.Millisecond, "client is not connected")
+
+		// Requests go to the idle client while the other is busy
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, "b", get(srv.URL, "/"))
+		}
+	})
+}
+
+// logBuffer is a concurrency safe writer to capture logs.
+type logBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (x *logBuffer) Write(p []byte) (int, error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return x.buf.Write(p)
+}
+
+func (x *logBuffer) String() string {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return x.buf.String()
+}
+
+func TestServer_Mirror(t *testing.T) {
+	logs := &logBuffer{}
+	logging.SetDefault(slog.New(slog.NewJSONHandler(logs, nil)))
+	t.Cleanup(logging.Disable)
+
+	srv := httptest.NewServer(New(hub.New()))
+	t.Cleanup(srv.Close)
+
+	primary := &countingApp{name: "primary"}
+	localPrimary := httptest.NewServer(primary)
+	t.Cleanup(localPrimary.Close)
+	connectClient(t, srv.URL, localPrimary.URL)
+
+	mirror := &countingApp{name: "mirror"}
+	localMirror := httptest.NewServer(mirror)
+	t.Cleanup(localMirror.Close)
+	connectClient(t, srv.URL, localMirror.URL, client.WithMirror())
+
+	post := func() (int, string) {
+		resp, err := http.Post(srv.URL+"/hook", "text/plain", strings.NewReader("hello"))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	// Wait until the mirror client receives a request
+	require.Eventually(t, func() bool {
+		post()
+		return mirror.count.Load() > 0
+	}, 3*time.Second, 5*time.Millisecond, "mirror client is not connected")
+
+	// Callers always get the response of the primary client
+	for i := 0; i < 5; i++ {
+		code, body := post()
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "primary", body)
+	}
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), "mirror response differs")
+	}, 3*time.Second, 5*time.Millisecond, "response diff is not logged")
+	assert.GreaterOrEqual(t, primary.count.Load(), int64(5))
+}
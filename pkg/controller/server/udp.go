@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/m-mizutani/goerr/v2"
+)
+
+// maxDatagramSize is a max payload size of a UDP datagram.
+const maxDatagramSize = 64 * 1024
+
+// serveUDP reads datagrams from pc and sends them to the client with the source address until pc is closed.
+func (x *Server) serveUDP(ctx context.Context, pc net.PacketConn, clientID string) {
+	logger := logging.Extract(ctx)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Error("failed to read UDP datagram", "error", err)
+			}
+			return
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		if err := x.svc.SendDatagram(clientID, addr.String(), data); err != nil {
+			logger.Warn("failed to send UDP datagram to client", "error", err, "peer", addr)
+			return
+		}
+	}
+}
+
+// writeDatagram sends a datagram frame from the client to the peer.
+func writeDatagram(pc net.PacketConn, frame *model.Frame) error {
+	addr, err := net.ResolveUDPAddr("udp", frame.Peer)
+	if err != nil {
+		return goerr.Wrap(err, "invalid peer address", goerr.V("peer", frame.Peer))
+	}
+
+	if _, err := pc.WriteTo(frame.Data, addr); err != nil {
+		return goerr.Wrap(err, "failed to write UDP datagram", goerr.V("peer", frame.Peer))
+	}
+	return nil
+}
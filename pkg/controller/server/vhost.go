@@ -0,0 +1,49 @@
+package server
+
+import (
+	"crypto/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/m-mizutani/backstream/pkg/utils/urlutil"
+)
+
+// randomTunnelLength is a length of tunnel name assigned to a client without tunnel name.
+const randomTunnelLength = 10
+
+// WithVirtualHost enables subdomain based routing under the host of base URL, e.g. "https://tunnel.example.com". A public request to "alice.tunnel.example.com" is routed to "alice" tunnel, and a client without tunnel name is assigned a random subdomain. The public URL of the tunnel is built from the scheme and host of base.
+func WithVirtualHost(base *url.URL) Option {
+	return func(x *Server) {
+		x.vhost = base
+	}
+}
+
+// vhostTunnel returns the tunnel name from the subdomain of the request host. It returns false if virtual hosting is disabled or the host is not a direct subdomain of the base host.
+func (x *Server) vhostTunnel(r *http.Request) (string, bool) {
+	if x.vhost == nil {
+		return "", false
+	}
+
+	host := strings.ToLower(urlutil.StripPort(r.Host))
+	name, found := strings.CutSuffix(host, "."+strings.ToLower(x.vhost.Hostname()))
+	if !found || name == "" || strings.Contains(name, ".") {
+		return "", false
+	}
+	return name, true
+}
+
+// publicURL returns the URL to reach the tunnel from the Internet.
+func (x *Server) publicURL(tunnel string) string {
+	host := tunnel + "." + x.vhost.Hostname()
+	if port := x.vhost.Port(); port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+	return (&url.URL{Scheme: x.vhost.Scheme, Host: host}).String()
+}
+
+// randomTunnelName generates an unguessable tunnel name that is valid as a DNS label.
+func randomTunnelName() string {
+	return strings.ToLower(rand.Text()[:randomTunnelLength])
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/service/hub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_VirtualHost(t *testing.T) {
+	base, err := url.Parse("https://tunnel.example.com")
+	require.NoError(t, err)
+
+	server := New(hub.New(), WithVirtualHost(base), WithRoutes(Route{Tunnel: "github", PathPrefix: "/github"}))
+
+	t.Run("route by subdomain", func(t *testing.T) {
+		testCases := map[string]struct {
+			host   string
+			path   string
+			expect string
+		}{
+			"subdomain":        {host: "alice.tunnel.example.com", path: "/", expect: "alice"},
+			"upper case":       {host: "Alice.Tunnel.Example.com:443", path: "/", expect: "alice"},
+			"base host":        {host: "tunnel.example.com", path: "/", expect: model.DefaultTunnel},
+			"nested subdomain": {host: "a.b.tunnel.example.com", path: "/", expect: model.DefaultTunnel},
+			"other domain":     {host: "alice.example.com", path: "/", expect: model.DefaultTunnel},
+			"route is prior":   {host: "alice.tunnel.example.com", path: "/github", expect: "github"},
+		}
+
+		for name, tc := range testCases {
+			t.Run(name, func(t *testing.T) {
+				r := httptest.NewRequest("GET", tc.path, nil)
+				r.Host = tc.host
+				assert.Equal(t, tc.expect, server.route(r).tunnel)
+			})
+		}
+	})
+
+	t.Run("public URL", func(t *testing.T) {
+		assert.Equal(t, "https://alice.tunnel.example.com", server.publicURL("alice"))
+
+		withPort := New(nil, WithVirtualHost(&url.URL{Scheme: "http", Host: "localhost:8080"}))
+		assert.Equal(t, "http://alice.localhost:8080", withPort.publicURL("alice"))
+	})
+
+	t.Run("assign random subdomain", func(t *testing.T) {
+		srv := httptest.NewServer(server)
+		defer srv.Close()
+		wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+		var names []string
+		for i := 0; i < 2; i++ {
+			conn, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Backstream-Client": {"test"}})
+			require.NoError(t, err)
+			conn.Close()
+
+			name := resp.Header.Get(model.HeaderTunnel)
+			require.NoError(t, model.ValidateTunnelName(name))
+			assert.Equal(t, "https://"+name+".tunnel.example.com", resp.Header.Get(model.HeaderPublicURL))
+			names = append(names, name)
+		}
+		assert.NotEqual(t, names[0], names[1])
+	})
+
+	t.Run("requested subdomain", func(t *testing.T) {
+		srv := httptest.NewServer(server)
+		defer srv.Close()
+
+		conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), http.Header{
+			"Backstream-Client": {"test"},
+			model.HeaderTunnel:  {"ci-123"},
+		})
+		require.NoError(t, err)
+		conn.Close()
+
+		assert.Equal(t, "ci-123", resp.Header.Get(model.HeaderTunnel))
+		assert.Equal(t, "https://ci-123.tunnel.example.com", resp.Header.Get(model.HeaderPublicURL))
+	})
+}
@@ -0,0 +1,115 @@
+package model
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-mizutani/goerr/v2"
+)
+
+// Codec is an encoding of frames over WebSocket. It's negotiated by HeaderCodec when the client connects.
+type Codec string
+
+const (
+	// CodecJSON encodes a frame as a JSON text message, and Data is encoded in base64. It's the fallback for peers that don't support negotiation.
+	CodecJSON Codec = "json"
+	// CodecBinary encodes a frame as a binary message that consists of a version byte, 4 bytes length of JSON header in big endian, the header and raw Data.
+	CodecBinary Codec = "binary"
+)
+
+const (
+	// HeaderCodec is a header of the connect request to list codecs supported by the client in order of preference, and of the response to tell the codec selected by the server.
+	HeaderCodec = "Backstream-Codec"
+
+	binaryVersion    = 1
+	binaryHeaderSize = 5
+)
+
+// NegotiateCodec selects a codec from the list of HeaderCodec in the connect request. It returns CodecJSON if no supported codec is found.
+func NegotiateCodec(accept string) Codec {
+	for _, v := range strings.Split(accept, ",") {
+		switch c := Codec(strings.TrimSpace(v)); c {
+		case CodecBinary, CodecJSON:
+			return c
+		}
+	}
+
+	return CodecJSON
+}
+
+// ParseCodec parses the codec selected by the server. Empty value means CodecJSON because the server doesn't support negotiation.
+func ParseCodec(v string) (Codec, error) {
+	switch c := Codec(v); c {
+	case "":
+		return CodecJSON, nil
+	case CodecJSON, CodecBinary:
+		return c, nil
+	default:
+		return "", goerr.New("unsupported codec", goerr.V("codec", v))
+	}
+}
+
+// Encode encodes the frame and returns WebSocket message type and data.
+func (x Codec) Encode(frame *Frame) (int, []byte, error) {
+	if x != CodecBinary {
+		data, err := json.Marshal(frame)
+		if err != nil {
+			return 0, nil, goerr.Wrap(err, "failed to marshal frame")
+		}
+		return websocket.TextMessage, data, nil
+	}
+
+	head := *frame
+	head.Data = nil
+	header, err := json.Marshal(&head)
+	if err != nil {
+		return 0, nil, goerr.Wrap(err, "failed to marshal frame header")
+	}
+
+	data := make([]byte, binaryHeaderSize+len(header)+len(frame.Data))
+	data[0] = binaryVersion
+	binary.BigEndian.PutUint32(data[1:binaryHeaderSize], uint32(len(header)))
+	n := copy(data[binaryHeaderSize:], header)
+	copy(data[binaryHeaderSize+n:], frame.Data)
+
+	return websocket.BinaryMessage, data, nil
+}
+
+// DecodeFrame decodes a WebSocket message into a frame. The codec is determined by the message type, so the receiver doesn't need to know the negotiated codec. Data of the returned frame refers to data.
+func DecodeFrame(messageType int, data []byte) (*Frame, error) {
+	var frame Frame
+
+	switch messageType {
+	case websocket.TextMessage:
+		if err := json.Unmarshal(data, &frame); err != nil {
+			return nil, goerr.Wrap(err, "failed to unmarshal frame")
+		}
+
+	case websocket.BinaryMessage:
+		if len(data) < binaryHeaderSize {
+			return nil, goerr.New("binary frame is too short", goerr.V("size", len(data)))
+		}
+		if data[0] != binaryVersion {
+			return nil, goerr.New("unsupported binary frame version", goerr.V("version", data[0]))
+		}
+
+		size := int(binary.BigEndian.Uint32(data[1:binaryHeaderSize]))
+		if size > len(data)-binaryHeaderSize {
+			return nil, goerr.New("invalid binary frame header size", goerr.V("header_size", size), goerr.V("size", len(data)))
+		}
+
+		if err := json.Unmarshal(data[binaryHeaderSize:binaryHeaderSize+size], &frame); err != nil {
+			return nil, goerr.Wrap(err, "failed to unmarshal frame header")
+		}
+		if body := data[binaryHeaderSize+size:]; len(body) > 0 {
+			frame.Data = body
+		}
+
+	default:
+		return nil, goerr.New("unsupported message type", goerr.V("type", messageType))
+	}
+
+	return &frame, nil
+}
@@ -0,0 +1,113 @@
+package model_test
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/gt"
+)
+
+func TestCodec(t *testing.T) {
+	frames := map[string]*model.Frame{
+		"request": {
+			Type: model.FrameRequest,
+			ID:   "req-1",
+			Request: &model.Request{
+				ID:     "req-1",
+				Method: http.MethodPost,
+				Path:   "/upload",
+				Header: http.Header{"Content-Type": {"application/octet-stream"}},
+			},
+		},
+		"data": {
+			Type:   model.FrameData,
+			ID:     "req-1",
+			Data:   []byte{0x00, 0xff, 0x10, 0x7f},
+			Opcode: websocket.BinaryMessage,
+			More:   true,
+		},
+		"empty data": {Type: model.FrameData, ID: "req-1"},
+		"end":        {Type: model.FrameEnd, ID: "req-1", Code: 4000, Reason: "bye"},
+	}
+
+	for _, codec := range []model.Codec{model.CodecJSON, model.CodecBinary} {
+		for name, frame := range frames {
+			t.Run(string(codec)+"/"+name, func(t *testing.T) {
+				messageType, data, err := codec.Encode(frame)
+				gt.NoError(t, err)
+
+				decoded := gt.R1(model.DecodeFrame(messageType, data)).NoError(t)
+				gt.V(t, decoded).Equal(frame)
+			})
+		}
+	}
+
+	t.Run("binary keeps data raw", func(t *testing.T) {
+		payload := bytes.Repeat([]byte{0xab}, 1024)
+		messageType, data := gt.R2(model.CodecBinary.Encode(&model.Frame{Type: model.FrameData, ID: "x", Data: payload})).NoError(t)
+		gt.V(t, messageType).Equal(websocket.BinaryMessage)
+		gt.True(t, bytes.HasSuffix(data, payload))
+		gt.N(t, len(data)).Less(len(payload) + 64)
+	})
+}
+
+func TestDecodeFrameError(t *testing.T) {
+	testCases := map[string]struct {
+		messageType int
+		data        []byte
+	}{
+		"too short":       {websocket.BinaryMessage, []byte{1, 0}},
+		"unknown version": {websocket.BinaryMessage, []byte{9, 0, 0, 0, 2, '{', '}'}},
+		"header overflow": {websocket.BinaryMessage, []byte{1, 0, 0, 1, 0, '{', '}'}},
+		"broken JSON":     {websocket.TextMessage, []byte("{")},
+		"unknown type":    {websocket.PingMessage, nil},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := model.DecodeFrame(tc.messageType, tc.data)
+			gt.Error(t, err)
+		})
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	gt.V(t, model.NegotiateCodec("binary, json")).Equal(model.CodecBinary)
+	gt.V(t, model.NegotiateCodec("msgpack, json")).Equal(model.CodecJSON)
+	gt.V(t, model.NegotiateCodec("")).Equal(model.CodecJSON)
+
+	gt.V(t, gt.R1(model.ParseCodec("")).NoError(t)).Equal(model.CodecJSON)
+	gt.V(t, gt.R1(model.ParseCodec("binary")).NoError(t)).Equal(model.CodecBinary)
+	_, err := model.ParseCodec("msgpack")
+	gt.Error(t, err)
+}
+
+func BenchmarkCodec(b *testing.B) {
+	for _, size := range []int{model.ChunkSize, 1024 * 1024} {
+		frame := &model.Frame{Type: model.FrameData, ID: "7b0c1c4e-2d1f-4b8a-9f4e-1f6f3c0e9a11", Data: bytes.Repeat([]byte{0x5a}, size)}
+
+		for _, codec := range []model.Codec{model.CodecJSON, model.CodecBinary} {
+			b.Run(fmt.Sprintf("%s/%dKB", codec, size/1024), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+
+				var wire int
+				for i := 0; i < b.N; i++ {
+					messageType, data, err := codec.Encode(frame)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := model.DecodeFrame(messageType, data); err != nil {
+						b.Fatal(err)
+					}
+					wire = len(data)
+				}
+				b.ReportMetric(float64(wire)/float64(size), "wire/payload")
+			})
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package model
+
+import (
+	"errors"
+	"io"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-mizutani/backstream/pkg/utils/flow"
+)
+
+// FrameType is a type of frame exchanged between server and client over WebSocket.
+type FrameType string
+
+const (
+	// FrameHello is the first frame from client to server that carries Hello.
+	FrameHello FrameType = "hello"
+	// FrameWelcome is a reply of FrameHello from server to client that carries Welcome.
+	FrameWelcome FrameType = "welcome"
+	// FrameRequest opens a stream with a request head. It's sent from server to client.
+	FrameRequest FrameType = "request"
+	// FrameResponse carries a response head of the stream. It's sent from client to server.
+	FrameResponse FrameType = "response"
+	// FrameData carries a chunk of body in Data.
+	FrameData FrameType = "data"
+	// FrameEnd indicates that the sender has no more body data. Error is set if the body ended abnormally, and Code and Reason are set if a WebSocket connection was closed.
+	FrameEnd FrameType = "end"
+	// FrameCancel aborts the stream. It's sent from server to client when the caller went away before the response was completed.
+	FrameCancel FrameType = "cancel"
+	// FrameAck returns Size bytes of send window to the peer after it consumed data.
+	FrameAck FrameType = "ack"
+	// FrameDatagram carries a UDP datagram in Data. Peer is the address of the remote peer on the server side. It's not a part of any stream and not flow controlled.
+	FrameDatagram FrameType = "datagram"
+	// FrameDrain is sent from client to server when the client is shutting down. The server stops routing new requests to the client while streams in progress continue, and replies a drain frame after all requests routed to the client if FeatureDrain is enabled.
+	FrameDrain FrameType = "drain"
+)
+
+const (
+	// ChunkSize is a max size of Data in a single data frame.
+	ChunkSize = 32 * 1024
+
+	// WindowSize is a flow control window per stream and direction. A sender must not have more than WindowSize bytes of data that are not acknowledged by the receiver.
+	WindowSize = 256 * 1024
+)
+
+// Frame is a unit of message over WebSocket. Request and response bodies are split into data frames and multiplexed by stream ID.
+type Frame struct {
+	Type     FrameType `json:"type"`
+	ID       string    `json:"id"`
+	Request  *Request  `json:"request,omitempty"`
+	Response *Response `json:"response,omitempty"`
+	Hello    *Hello    `json:"hello,omitempty"`
+	Welcome  *Welcome  `json:"welcome,omitempty"`
+	Data     []byte    `json:"data,omitempty"`
+	// Opcode is a WebSocket message type of Data. More indicates that following data frames belong to the same message.
+	Opcode int    `json:"opcode,omitempty"`
+	More   bool   `json:"more,omitempty"`
+	Size   int    `json:"size,omitempty"`
+	Peer   string `json:"peer,omitempty"`
+
+	Error  string `json:"error,omitempty"`
+	Code   int    `json:"code,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func NewDataFrame(id string, chunk flow.Chunk) *Frame {
+	return &Frame{
+		Type:   FrameData,
+		ID:     id,
+		Data:   chunk.Data,
+		Opcode: chunk.Type,
+		More:   chunk.More,
+	}
+}
+
+// Chunk returns data of the frame as flow.Chunk.
+func (x *Frame) Chunk() flow.Chunk {
+	return flow.Chunk{Type: x.Opcode, Data: x.Data, More: x.More}
+}
+
+// NewEndFrame creates an end frame from err that ended the stream. err is nil or io.EOF for the normal end, and *websocket.CloseError for a closed WebSocket connection.
+func NewEndFrame(id string, err error) *Frame {
+	frame := &Frame{Type: FrameEnd, ID: id}
+
+	var closeErr *websocket.CloseError
+	switch {
+	case err == nil, errors.Is(err, io.EOF):
+	case errors.As(err, &closeErr):
+		frame.Code = closeErr.Code
+		frame.Reason = closeErr.Text
+	default:
+		frame.Error = err.Error()
+	}
+
+	return frame
+}
+
+// EndError returns the error of the end frame that is reverse of NewEndFrame. It returns nil for the normal end.
+func (x *Frame) EndError() error {
+	switch {
+	case x.Code != 0:
+		return &websocket.CloseError{Code: x.Code, Text: x.Reason}
+	case x.Error != "":
+		return errors.New(x.Error)
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,49 @@
+package model
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hopHeaders are hop-by-hop headers that must not be forwarded by a proxy. See RFC 9110 Section 7.6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopHeaders removes hop-by-hop headers, including ones listed in the Connection header.
+func RemoveHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// setForwardedHeaders sets X-Forwarded-* headers from the original request.
+func setForwardedHeaders(h http.Header, host, remote string) {
+	if host != "" && h.Get("X-Forwarded-Host") == "" {
+		h.Set("X-Forwarded-Host", host)
+	}
+
+	if ip, _, err := net.SplitHostPort(remote); err == nil {
+		if prior := h.Values("X-Forwarded-For"); len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		h.Set("X-Forwarded-For", ip)
+	}
+}
@@ -1,84 +1,221 @@
 package model
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
+	"slices"
+	"strings"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 	"github.com/m-mizutani/goerr/v2"
 )
 
 type Request struct {
-	ID     string            `json:"id"`
-	Path   string            `json:"path"`
-	Method string            `json:"method"`
-	Body   []byte            `json:"body"`
-	Remote string            `json:"remote"`
-	Header map[string]string `json:"header"`
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	// RawPath is the original encoded path. It's set only when the path contains escaped characters that differ from the default encoding of Path (e.g. %2F).
+	RawPath  string `json:"raw_path,omitempty"`
+	RawQuery string `json:"raw_query,omitempty"`
+	Method   string `json:"method"`
+	Host     string `json:"host,omitempty"`
+	// ContentLength is a length of request body. -1 means unknown. The body itself is sent by data frames.
+	ContentLength int64 `json:"content_length"`
+	// WebSocket indicates a WebSocket upgrade request. Data frames of the stream carry WebSocket messages in both directions after the upgrade.
+	WebSocket bool   `json:"websocket,omitempty"`
+	Remote    string `json:"remote"`
+	// Header has all values of each header in the received order. It's encoded as "headers" and also as "header" with only the first values for compatibility with older clients.
+	Header http.Header `json:"-"`
 }
 
-func (x *Request) NewHTTPRequest(ctx context.Context, dst string) (*http.Request, error) {
+type requestAlias Request
+
+type requestJSON struct {
+	*requestAlias
+	LegacyHeader map[string]string   `json:"header"`
+	Headers      map[string][]string `json:"headers,omitempty"`
+}
+
+func (x Request) MarshalJSON() ([]byte, error) {
+	legacy := make(map[string]string, len(x.Header))
+	for k, v := range x.Header {
+		if len(v) > 0 {
+			legacy[k] = v[0]
+		}
+	}
+
+	return json.Marshal(requestJSON{
+		requestAlias: (*requestAlias)(&x),
+		LegacyHeader: legacy,
+		Headers:      x.Header,
+	})
+}
+
+func (x *Request) UnmarshalJSON(data []byte) error {
+	v := requestJSON{requestAlias: (*requestAlias)(x)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	switch {
+	case v.Headers != nil:
+		x.Header = v.Headers
+	case v.LegacyHeader != nil:
+		x.Header = make(http.Header, len(v.LegacyHeader))
+		for k, value := range v.LegacyHeader {
+			x.Header[k] = []string{value}
+		}
+	}
+
+	return nil
+}
+
+// EscapedPath returns the escaped form of the request path, preferring RawPath if it's a valid encoding of Path.
+func (x *Request) EscapedPath() string {
+	u := url.URL{Path: x.Path, RawPath: x.RawPath}
+	return u.EscapedPath()
+}
+
+// URL builds the destination URL by joining the base URL of dst with the request path and query.
+func (x *Request) URL(dst string) (*url.URL, error) {
 	baseURL, err := url.Parse(dst)
 	if err != nil {
 		return nil, goerr.Wrap(err, "failed to parse URL", goerr.V("dst", dst))
 	}
 
-	baseURL.Path = x.Path
-	body := io.NopCloser(bytes.NewReader(x.Body))
+	u := *baseURL
+	u.Path = joinPath(baseURL.Path, x.Path)
+	u.RawPath = joinPath(baseURL.EscapedPath(), x.EscapedPath())
+
+	switch {
+	case baseURL.RawQuery == "":
+		u.RawQuery = x.RawQuery
+	case x.RawQuery != "":
+		u.RawQuery = baseURL.RawQuery + "&" + x.RawQuery
+	}
+
+	return &u, nil
+}
+
+func joinPath(base, path string) string {
+	if path == "" {
+		path = "/"
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return strings.TrimSuffix(base, "/") + path
+}
+
+// NewHTTPRequest creates a request to the local application. The request body is read from body.
+func (x *Request) NewHTTPRequest(ctx context.Context, dst string, body io.Reader) (*http.Request, error) {
+	reqURL, err := x.URL(dst)
+	if err != nil {
+		return nil, err
+	}
 
-	req, err := http.NewRequestWithContext(ctx, x.Method, baseURL.String(), body)
+	req, err := http.NewRequestWithContext(ctx, x.Method, reqURL.String(), body)
 	if err != nil {
 		return nil, goerr.Wrap(err, "failed to create http.Request")
 	}
+	req.ContentLength = x.ContentLength
+	if x.ContentLength == 0 {
+		req.Body = http.NoBody
+	}
 
-	for k, v := range x.Header {
-		req.Header.Add(k, v)
+	for k, values := range x.Header {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
 	}
+	RemoveHopHeaders(req.Header)
+	setForwardedHeaders(req.Header, x.Host, x.Remote)
 
 	return req, nil
 }
 
-func NewRequest(r *http.Request) (*Request, error) {
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		return nil, goerr.Wrap(err, "Failed to read request body")
+// StripPrefix removes prefix from the request path, e.g. "/slack/events" becomes "/events" with "/slack". The removed prefix is set to X-Forwarded-Prefix header so that the local application can build external URLs.
+func (x *Request) StripPrefix(prefix string) {
+	trim := func(p string) string {
+		p = strings.TrimPrefix(p, prefix)
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+		return p
 	}
 
-	header := make(map[string]string)
-	for k, v := range r.Header {
-		header[k] = v[0]
+	x.Path = trim(x.Path)
+	if x.RawPath != "" {
+		x.RawPath = trim(x.RawPath)
 	}
+	if x.Header == nil {
+		x.Header = http.Header{}
+	}
+	x.Header.Set("X-Forwarded-Prefix", prefix)
+}
 
+// NewRequest creates a request head from r. The body of r is not read and should be streamed separately.
+func NewRequest(r *http.Request) *Request {
 	return &Request{
-		ID:     uuid.New().String(),
-		Path:   r.URL.Path,
-		Method: r.Method,
-		Body:   body,
-		Remote: r.RemoteAddr,
-		Header: header,
-	}, nil
+		ID:            uuid.New().String(),
+		Path:          r.URL.Path,
+		RawPath:       r.URL.RawPath,
+		RawQuery:      r.URL.RawQuery,
+		Method:        r.Method,
+		Host:          r.Host,
+		ContentLength: r.ContentLength,
+		WebSocket:     websocket.IsWebSocketUpgrade(r),
+		Remote:        r.RemoteAddr,
+		Header:        r.Header.Clone(),
+	}
 }
 
 type Response struct {
-	ID     string              `json:"id"`
-	Code   int                 `json:"code"`
-	Body   []byte              `json:"body"`
-	Header map[string][]string `json:"header"`
+	ID   string `json:"id"`
+	Code int    `json:"code"`
+	// ContentLength is a length of response body. -1 means unknown. The body itself is sent by data frames.
+	ContentLength int64               `json:"content_length"`
+	Header        map[string][]string `json:"header"`
+	// Stream indicates that body chunks should be forwarded and flushed to the caller as soon as they are read, e.g. Server-Sent Events.
+	Stream bool `json:"stream,omitempty"`
+}
+
+// streamContentTypes are media types of responses that are consumed incrementally by the caller.
+var streamContentTypes = []string{
+	"text/event-stream",
+	"application/x-ndjson",
+	"application/ndjson",
+	"application/jsonl",
+	"application/stream+json",
 }
 
-func (x *Request) NewResponse(r *http.Response) (*Response, error) {
-	body, err := io.ReadAll(r.Body)
+// isStreamResponse returns true if the response body should be forwarded in streaming mode. A response without Content-Length is also streamed because it may be a long-lived chunked response.
+func isStreamResponse(r *http.Response) bool {
+	if r.ContentLength < 0 {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
 	if err != nil {
-		return nil, goerr.Wrap(err, "Failed to read response body")
+		return false
 	}
+	return slices.Contains(streamContentTypes, mediaType)
+}
+
+// NewResponse creates a response head from r. The body of r is not read and should be streamed separately.
+func (x *Request) NewResponse(r *http.Response) *Response {
+	header := r.Header.Clone()
+	RemoveHopHeaders(header)
 
 	return &Response{
-		ID:     x.ID,
-		Code:   r.StatusCode,
-		Body:   body,
-		Header: r.Header,
-	}, nil
+		ID:            x.ID,
+		Code:          r.StatusCode,
+		ContentLength: r.ContentLength,
+		Header:        header,
+		Stream:        isStreamResponse(r),
+	}
 }
@@ -0,0 +1,178 @@
+package model_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/gt"
+)
+
+func TestRequestURL(t *testing.T) {
+	testCases := map[string]struct {
+		dst    string
+		target string
+		expect string
+	}{
+		"simple path": {
+			dst:    "http://localhost:8080",
+			target: "/hello",
+			expect: "http://localhost:8080/hello",
+		},
+		"query string": {
+			dst:    "http://localhost:8080",
+			target: "/callback?code=abc&state=xyz",
+			expect: "http://localhost:8080/callback?code=abc&state=xyz",
+		},
+		"repeated query keys": {
+			dst:    "http://localhost:8080",
+			target: "/search?tag=a&tag=b&tag=c",
+			expect: "http://localhost:8080/search?tag=a&tag=b&tag=c",
+		},
+		"encoded slash": {
+			dst:    "http://localhost:8080",
+			target: "/files/a%2Fb/c",
+			expect: "http://localhost:8080/files/a%2Fb/c",
+		},
+		"encoded slash with base path": {
+			dst:    "http://localhost:8080/api/",
+			target: "/files/a%2Fb?x=%20y",
+			expect: "http://localhost:8080/api/files/a%2Fb?x=%20y",
+		},
+		"base path without trailing slash": {
+			dst:    "http://localhost:8080/api",
+			target: "/v1/users",
+			expect: "http://localhost:8080/api/v1/users",
+		},
+		"root path with base path": {
+			dst:    "http://localhost:8080/api",
+			target: "/",
+			expect: "http://localhost:8080/api/",
+		},
+		"base query is merged": {
+			dst:    "http://localhost:8080/?token=t",
+			target: "/hook?sig=s",
+			expect: "http://localhost:8080/hook?token=t&sig=s",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			req := model.NewRequest(r)
+
+			u := gt.R1(req.URL(tc.dst)).NoError(t)
+			gt.V(t, u.String()).Equal(tc.expect)
+		})
+	}
+}
+
+func TestRequestNewHTTPRequest(t *testing.T) {
+	var received *http.Request
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer local.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/repos/owner%2Fname/hooks?event=push&event=ping&sig=a%2Bb", nil)
+	req := model.NewRequest(r)
+
+	httpReq := gt.R1(req.NewHTTPRequest(context.Background(), local.URL+"/base", http.NoBody)).NoError(t)
+	resp := gt.R1(http.DefaultClient.Do(httpReq)).NoError(t)
+	gt.NoError(t, resp.Body.Close())
+
+	gt.V(t, received.URL.Path).Equal("/base/repos/owner/name/hooks")
+	gt.V(t, received.URL.EscapedPath()).Equal("/base/repos/owner%2Fname/hooks")
+	gt.V(t, received.URL.RawQuery).Equal("event=push&event=ping&sig=a%2Bb")
+	gt.A(t, received.URL.Query()["event"]).Equal([]string{"push", "ping"})
+	gt.V(t, received.URL.Query().Get("sig")).Equal("a+b")
+}
+
+func TestRequestHeader(t *testing.T) {
+	var received *http.Request
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer local.Close()
+
+	r := httptest.NewRequest(http.MethodGet, "http://public.example.com/", nil)
+	r.RemoteAddr = "192.0.2.1:12345"
+	r.Header.Add("Accept", "text/html")
+	r.Header.Add("Accept", "application/json")
+	r.Header.Add("X-Forwarded-For", "198.51.100.1")
+	r.Header.Add("Connection", "X-Hop")
+	r.Header.Add("X-Hop", "should be removed")
+	r.Header.Add("Keep-Alive", "timeout=5")
+
+	req := model.NewRequest(r)
+	gt.V(t, req.Host).Equal("public.example.com")
+
+	httpReq := gt.R1(req.NewHTTPRequest(context.Background(), local.URL, http.NoBody)).NoError(t)
+	resp := gt.R1(http.DefaultClient.Do(httpReq)).NoError(t)
+	gt.NoError(t, resp.Body.Close())
+
+	gt.A(t, received.Header.Values("Accept")).Equal([]string{"text/html", "application/json"})
+	gt.V(t, received.Header.Get("X-Forwarded-For")).Equal("198.51.100.1, 192.0.2.1")
+	gt.V(t, received.Header.Get("X-Forwarded-Host")).Equal("public.example.com")
+	gt.V(t, received.Header.Get("X-Hop")).Equal("")
+	gt.V(t, received.Header.Get("Keep-Alive")).Equal("")
+}
+
+func TestRequestContentLength(t *testing.T) {
+	var received *http.Request
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer local.Close()
+
+	for _, body := range []string{"hello", ""} {
+		r := httptest.NewRequest(http.MethodPost, "http://public.example.com/", strings.NewReader(body))
+		req := model.NewRequest(r)
+
+		httpReq := gt.R1(req.NewHTTPRequest(context.Background(), local.URL, r.Body)).NoError(t)
+		resp := gt.R1(http.DefaultClient.Do(httpReq)).NoError(t)
+		gt.NoError(t, resp.Body.Close())
+
+		gt.V(t, received.ContentLength).Equal(int64(len(body)))
+		gt.A(t, received.TransferEncoding).Length(0)
+	}
+}
+
+func TestRequestJSON(t *testing.T) {
+	t.Run("all header values are encoded", func(t *testing.T) {
+		req := model.Request{
+			ID: "1",
+			Header: http.Header{
+				"Cookie": {"a=1", "b=2"},
+			},
+		}
+		raw := gt.R1(json.Marshal(req)).NoError(t)
+
+		var decoded model.Request
+		gt.NoError(t, json.Unmarshal(raw, &decoded))
+		gt.A(t, decoded.Header.Values("Cookie")).Equal([]string{"a=1", "b=2"})
+
+		// Older clients only read "header" that has the first value
+		var legacy struct {
+			Header map[string]string `json:"header"`
+		}
+		gt.NoError(t, json.Unmarshal(raw, &legacy))
+		gt.V(t, legacy.Header["Cookie"]).Equal("a=1")
+	})
+
+	t.Run("legacy header is decoded", func(t *testing.T) {
+		raw := []byte(`{"id":"1","path":"/","method":"GET","header":{"Cookie":"a=1"}}`)
+
+		var decoded model.Request
+		gt.NoError(t, json.Unmarshal(raw, &decoded))
+		gt.V(t, decoded.ID).Equal("1")
+		gt.A(t, decoded.Header.Values("Cookie")).Equal([]string{"a=1"})
+	})
+}
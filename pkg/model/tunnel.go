@@ -0,0 +1,55 @@
+package model
+
+import (
+	"errors"
+	"regexp"
+
+	"github.com/m-mizutani/goerr/v2"
+)
+
+// TunnelMode is a type of traffic that a client relays to the local destination.
+type TunnelMode string
+
+const (
+	// TunnelHTTP relays HTTP requests including WebSocket connections. It's the default mode.
+	TunnelHTTP TunnelMode = "http"
+	// TunnelTCP relays raw TCP connections accepted by a listener that the server allocates for the client.
+	TunnelTCP TunnelMode = "tcp"
+	// TunnelUDP relays UDP datagrams received by a socket that the server allocates for the client.
+	TunnelUDP TunnelMode = "udp"
+)
+
+const (
+	// HeaderTunnelMode is a header of the connect request to specify TunnelMode of the client.
+	HeaderTunnelMode = "Backstream-Tunnel-Mode"
+	// HeaderTCPAddr is a header of the connect response that has the address of TCP listener allocated for the client.
+	HeaderTCPAddr = "Backstream-Tcp-Addr"
+	// HeaderUDPAddr is a header of the connect response that has the address of UDP socket allocated for the client.
+	HeaderUDPAddr = "Backstream-Udp-Addr"
+	// HeaderTunnel is a header of the connect request to specify the tunnel name that the client subscribes, and of the connect response to notify the name that the server actually assigned.
+	HeaderTunnel = "Backstream-Tunnel"
+	// HeaderPublicURL is a header of the connect response that has the public URL of the tunnel if the server hosts tunnels by subdomain.
+	HeaderPublicURL = "Backstream-Public-Url"
+	// HeaderPathPrefix is a header of the connect request to register path prefixes routed to the tunnel of the client. Multiple prefixes are separated by comma.
+	HeaderPathPrefix = "Backstream-Path-Prefix"
+	// HeaderStripPrefix is a header of the connect request. If it's "true", the registered path prefix is removed from the request path before forwarding.
+	HeaderStripPrefix = "Backstream-Strip-Prefix"
+	// HeaderMirror is a header of the connect request. If it's "true", the client joins the tunnel as a mirror that receives copies of requests.
+	HeaderMirror = "Backstream-Mirror"
+)
+
+// DefaultTunnel is a name of tunnel for clients without tunnel name and public requests that match no route.
+const DefaultTunnel = "default"
+
+var tunnelNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// ErrInvalidTunnelName is returned when a tunnel name is not a valid DNS label.
+var ErrInvalidTunnelName = errors.New("invalid tunnel name")
+
+// ValidateTunnelName checks that name can be used as a tunnel name. It must be a lower case DNS label so that it can be also used as a subdomain.
+func ValidateTunnelName(name string) error {
+	if !tunnelNamePattern.MatchString(name) {
+		return goerr.Wrap(ErrInvalidTunnelName, "tunnel name must be a lower case DNS label", goerr.V("name", name))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package model
+
+import "slices"
+
+// AppVersion is a version of backstream. It's overwritten by -ldflags at build time.
+var AppVersion = "dev"
+
+const (
+	// ProtocolVersion is a version of the tunnel protocol between server and client. It must be incremented when the protocol is changed incompatibly.
+	ProtocolVersion = 2
+	// MinProtocolVersion is the oldest protocol version that this version can talk to.
+	MinProtocolVersion = 2
+)
+
+// Feature is an optional capability of the tunnel protocol. Features that both server and client support are enabled.
+type Feature string
+
+const (
+	FeatureStreaming Feature = "streaming"
+	FeatureBinary    Feature = "binary"
+	FeatureDrain     Feature = "drain"
+)
+
+// CloseIncompatible is a WebSocket close code sent by the server when the client can not talk with the server.
+const CloseIncompatible = 4400
+
+// Hello is sent by the client in the first frame after the connection is established.
+type Hello struct {
+	ProtocolVersion int       `json:"protocol_version"`
+	ClientVersion   string    `json:"client_version"`
+	Features        []Feature `json:"features,omitempty"`
+}
+
+// Welcome is the server's reply to Hello. Features are the ones enabled for the session.
+type Welcome struct {
+	ProtocolVersion int       `json:"protocol_version"`
+	ServerVersion   string    `json:"server_version"`
+	SessionID       string    `json:"session_id"`
+	Features        []Feature `json:"features,omitempty"`
+}
+
+// IsCompatibleProtocol returns true if the peer's protocol version can be talked with.
+func IsCompatibleProtocol(version int) bool {
+	return MinProtocolVersion <= version && version <= ProtocolVersion
+}
+
+// CommonFeatures returns features in both a and b keeping the order of a.
+func CommonFeatures(a, b []Feature) []Feature {
+	var common []Feature
+	for _, f := range a {
+		if slices.Contains(b, f) {
+			common = append(common, f)
+		}
+	}
+	return common
+}
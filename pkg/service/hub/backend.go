@@ -0,0 +1,128 @@
+package hub
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/m-mizutani/backstream/pkg/model"
+)
+
+// Backend shares clients and delivers frames among replicas of the server, so that a public request received by a replica can reach a client connected to another replica. A replica is a Service, and each replica has a unique ID.
+type Backend interface {
+	// Register adds or updates a client connected to the replica of info.
+	Register(ctx context.Context, info *ClientInfo) error
+	// Unregister removes the client and notifies all replicas that the client left.
+	Unregister(ctx context.Context, info *ClientInfo) error
+	// Clients returns clients of the tunnel connected to any replica.
+	Clients(ctx context.Context, tunnel string) ([]*ClientInfo, error)
+	// Publish delivers msg to the replica.
+	Publish(ctx context.Context, replica string, msg *Message) error
+	// Subscribe starts calling handler with messages to the replica and notifications of left clients until ctx is done. It returns after the subscription is ready. handler does not block.
+	Subscribe(ctx context.Context, replica string, handler func(*Message)) error
+}
+
+// ClientInfo is a client shared among replicas.
+type ClientInfo struct {
+	ID       string           `json:"id"`
+	Replica  string           `json:"replica"`
+	Tunnel   string           `json:"tunnel"`
+	Mode     model.TunnelMode `json:"mode"`
+	Mirror   bool             `json:"mirror,omitempty"`
+	Draining bool             `json:"draining,omitempty"`
+	// JoinedAt is used to order clients of a tunnel in the same way on all replicas
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// Message is a frame exchanged between replicas.
+type Message struct {
+	// From is the replica that sent the message
+	From string `json:"from"`
+	// ClientID is the client that Frame is sent to or received from
+	ClientID string `json:"client_id"`
+	// ToClient is true if Frame should be sent to the client. Otherwise Frame was received from the client for a stream of the destination replica.
+	ToClient bool         `json:"to_client,omitempty"`
+	Frame    *model.Frame `json:"frame,omitempty"`
+	// Left is true if the message notifies that the client left
+	Left bool `json:"left,omitempty"`
+	// Seq is a sequence number of messages of the stream from the replica, starting from 1. A gap means that messages were lost. 0 is not checked.
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// MemoryBackend is a Backend in memory. It's the default Backend of a Service, and can be shared by Services in one process.
+type MemoryBackend struct {
+	mutex    sync.RWMutex
+	clients  map[string]*ClientInfo
+	handlers map[string]func(*Message)
+}
+
+// NewMemoryBackend creates a Backend in memory.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		clients:  make(map[string]*ClientInfo),
+		handlers: make(map[string]func(*Message)),
+	}
+}
+
+func (x *MemoryBackend) Register(ctx context.Context, info *ClientInfo) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	v := *info
+	x.clients[info.ID] = &v
+	return nil
+}
+
+func (x *MemoryBackend) Unregister(ctx context.Context, info *ClientInfo) error {
+	x.mutex.Lock()
+	delete(x.clients, info.ID)
+	handlers := make([]func(*Message), 0, len(x.handlers))
+	for _, h := range x.handlers {
+		handlers = append(handlers, h)
+	}
+	x.mutex.Unlock()
+
+	for _, h := range handlers {
+		h(&Message{From: info.Replica, ClientID: info.ID, Left: true})
+	}
+	return nil
+}
+
+func (x *MemoryBackend) Clients(ctx context.Context, tunnel string) ([]*ClientInfo, error) {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	var clients []*ClientInfo
+	for _, info := range x.clients {
+		if info.Tunnel == tunnel {
+			v := *info
+			clients = append(clients, &v)
+		}
+	}
+	return clients, nil
+}
+
+// Publish calls the handler of the replica synchronously. A message to an unknown replica is dropped.
+func (x *MemoryBackend) Publish(ctx context.Context, replica string, msg *Message) error {
+	x.mutex.RLock()
+	h, ok := x.handlers[replica]
+	x.mutex.RUnlock()
+
+	if ok {
+		h(msg)
+	}
+	return nil
+}
+
+func (x *MemoryBackend) Subscribe(ctx context.Context, replica string, handler func(*Message)) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	x.handlers[replica] = handler
+	context.AfterFunc(ctx, func() {
+		x.mutex.Lock()
+		defer x.mutex.Unlock()
+		delete(x.handlers, replica)
+	})
+	return nil
+}
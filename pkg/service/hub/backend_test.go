@@ -0,0 +1,205 @@
+package hub
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/m-mizutani/gt"
+	"github.com/redis/go-redis/v9"
+)
+
+func newRedisBackend(t *testing.T) *RedisBackend {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	return NewRedisBackend(client)
+}
+
+// messages collects messages given to a handler of Subscribe.
+type messages struct {
+	mutex sync.Mutex
+	list  []*Message
+}
+
+func (x *messages) handle(msg *Message) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.list = append(x.list, msg)
+}
+
+func (x *messages) wait(t *testing.T, n int) []*Message {
+	t.Helper()
+	for i := 0; ; i++ {
+		x.mutex.Lock()
+		list := slices.Clone(x.list)
+		x.mutex.Unlock()
+		if len(list) >= n {
+			return list
+		}
+		if i > 100 {
+			t.Fatalf("messages are not received: %d < %d", len(list), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	logging.Disable()
+
+	testCases := map[string]func(t *testing.T) Backend{
+		"memory": func(t *testing.T) Backend { return NewMemoryBackend() },
+		"redis":  func(t *testing.T) Backend { return newRedisBackend(t) },
+	}
+
+	for name, newBackend := range testCases {
+		t.Run(name, func(t *testing.T) {
+			backend := newBackend(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			t.Cleanup(cancel)
+
+			var r1, r2 messages
+			gt.NoError(t, backend.Subscribe(ctx, "r1", r1.handle))
+			gt.NoError(t, backend.Subscribe(ctx, "r2", r2.handle))
+
+			alice := &ClientInfo{ID: "alice", Replica: "r1", Tunnel: "t", Mode: model.TunnelHTTP, JoinedAt: time.Now().UTC()}
+			bob := &ClientInfo{ID: "bob", Replica: "r2", Tunnel: "t", Mode: model.TunnelHTTP, JoinedAt: time.Now().UTC()}
+			other := &ClientInfo{ID: "carol", Replica: "r2", Tunnel: "other", Mode: model.TunnelHTTP}
+			for _, info := range []*ClientInfo{alice, bob, other} {
+				gt.NoError(t, backend.Register(ctx, info))
+			}
+
+			clients := func(tunnel string) []string {
+				infos := gt.R1(backend.Clients(ctx, tunnel)).NoError(t)
+				var ids []string
+				for _, info := range infos {
+					ids = append(ids, info.ID)
+				}
+				slices.Sort(ids)
+				return ids
+			}
+			gt.A(t, clients("t")).Equal([]string{"alice", "bob"})
+
+			// Register updates the client
+			draining := *bob
+			draining.Draining = true
+			gt.NoError(t, backend.Register(ctx, &draining))
+			infos := gt.R1(backend.Clients(ctx, "t")).NoError(t)
+			for _, info := range infos {
+				gt.V(t, info.Draining).Equal(info.ID == "bob")
+				gt.V(t, info.Replica).Equal(map[string]string{"alice": "r1", "bob": "r2"}[info.ID])
+			}
+
+			// Publish delivers a message only to the replica
+			frame := &model.Frame{Type: model.FrameData, ID: "s1", Data: []byte("hello")}
+			gt.NoError(t, backend.Publish(ctx, "r2", &Message{From: "r1", ClientID: "bob", ToClient: true, Frame: frame, Seq: 1}))
+			got := r2.wait(t, 1)[0]
+			gt.V(t, got.From).Equal("r1")
+			gt.V(t, got.ClientID).Equal("bob")
+			gt.True(t, got.ToClient)
+			gt.V(t, got.Seq).Equal(uint64(1))
+			gt.V(t, string(got.Frame.Data)).Equal("hello")
+
+			// Left of a client is notified to all replicas
+			gt.NoError(t, backend.Unregister(ctx, alice))
+			gt.A(t, clients("t")).Equal([]string{"bob"})
+			for _, msgs := range []*messages{&r1, &r2} {
+				list := msgs.wait(t, 1)
+				left := list[len(list)-1]
+				gt.True(t, left.Left)
+				gt.V(t, left.ClientID).Equal("alice")
+				gt.V(t, left.From).Equal("r1")
+			}
+			r1.mutex.Lock()
+			gt.A(t, r1.list).Length(1)
+			r1.mutex.Unlock()
+		})
+	}
+}
+
+func TestRedisBackend_Expire(t *testing.T) {
+	logging.Disable()
+
+	mr := miniredis.RunT(t)
+	newBackend := func() *RedisBackend {
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { _ = client.Close() })
+		backend := NewRedisBackend(client)
+		backend.ttl = 300 * time.Millisecond
+		return backend
+	}
+	alive, crashed := newBackend(), newBackend()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	gt.NoError(t, alive.Subscribe(ctx, "r1", func(*Message) {}))
+
+	gt.NoError(t, alive.Register(ctx, &ClientInfo{ID: "alice", Replica: "r1", Tunnel: "t"}))
+	gt.NoError(t, crashed.Register(ctx, &ClientInfo{ID: "bob", Replica: "r2", Tunnel: "t"}))
+	gt.A(t, gt.R1(alive.Clients(ctx, "t")).NoError(t)).Length(2)
+
+	// Clients of the replica without refresh expire
+	time.Sleep(500 * time.Millisecond)
+	infos := gt.R1(alive.Clients(ctx, "t")).NoError(t)
+	gt.A(t, infos).Length(1)
+	gt.V(t, infos[0].ID).Equal("alice")
+	// Expired clients are removed from Redis
+	gt.A(t, gt.R1(mr.HKeys(alive.tunnelKey("t"))).NoError(t)).Equal([]string{"alice"})
+}
+
+// lossyBackend drops the nth message of frameType.
+type lossyBackend struct {
+	*MemoryBackend
+	frameType model.FrameType
+	toClient  bool
+	nth       int64
+	count     atomic.Int64
+}
+
+func (x *lossyBackend) Publish(ctx context.Context, replica string, msg *Message) error {
+	if msg.Frame != nil && msg.Frame.Type == x.frameType && msg.ToClient == x.toClient && x.count.Add(1) == x.nth {
+		return nil
+	}
+	return x.MemoryBackend.Publish(ctx, replica, msg)
+}
+
+func TestService_LostMessage(t *testing.T) {
+	logging.Disable()
+
+	testCases := map[string]*lossyBackend{
+		"request body": {frameType: model.FrameData, toClient: true, nth: 2},
+		"response":     {frameType: model.FrameData, toClient: false, nth: 1},
+	}
+
+	for name, backend := range testCases {
+		t.Run(name, func(t *testing.T) {
+			backend.MemoryBackend = NewMemoryBackend()
+			emitter := New(WithBackend(backend))
+			t.Cleanup(emitter.Close)
+			receiver := New(WithBackend(backend))
+			t.Cleanup(receiver.Close)
+
+			go echoClient(receiver, "alice", receiver.Join("alice", model.DefaultTunnel, model.TunnelHTTP))
+			t.Cleanup(func() { receiver.Leave("alice") })
+
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			body := bytes.Repeat([]byte("a"), 4*model.ChunkSize)
+			stream, err := emitter.EmitAndWait(ctx, model.DefaultTunnel, &model.Request{ID: "req"}, bytes.NewReader(body))
+			if err == nil {
+				defer stream.Close()
+				_, err = io.ReadAll(stream)
+			}
+			gt.Error(t, err).Must()
+			gt.S(t, err.Error()).Contains(ErrMessageLost.Error())
+		})
+	}
+}
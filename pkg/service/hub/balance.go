@@ -0,0 +1,79 @@
+package hub
+
+import (
+	"math/rand/v2"
+	"slices"
+	"strings"
+
+	"github.com/m-mizutani/goerr/v2"
+)
+
+// Strategy is a way to choose clients of a tunnel for a request.
+type Strategy string
+
+const (
+	// StrategyRoundRobin sends requests to clients in turn. It's the default.
+	StrategyRoundRobin Strategy = "round-robin"
+	// StrategyLeastInFlight sends a request to the client that has the fewest requests in progress.
+	StrategyLeastInFlight Strategy = "least-in-flight"
+	// StrategyRandom sends a request to a client chosen at random.
+	StrategyRandom Strategy = "random"
+)
+
+var strategies = []Strategy{StrategyRoundRobin, StrategyLeastInFlight, StrategyRandom}
+
+// ParseStrategy parses a name of Strategy.
+func ParseStrategy(v string) (Strategy, error) {
+	s := Strategy(strings.TrimSpace(v))
+	if !slices.Contains(strategies, s) {
+		return "", goerr.New("unsupported load balancing strategy", goerr.V("strategy", v), goerr.V("supported", strategies))
+	}
+	return s, nil
+}
+
+// WithStrategy sets the strategy of the tunnel.
+func WithStrategy(tunnel string, strategy Strategy) Option {
+	return func(x *Service) {
+		x.strategies[tunnel] = strategy
+	}
+}
+
+// WithDefaultStrategy sets the strategy of tunnels without WithStrategy. The default is StrategyRoundRobin.
+func WithDefaultStrategy(strategy Strategy) Option {
+	return func(x *Service) {
+		x.defaultStrategy = strategy
+	}
+}
+
+func (x *Service) strategy(tunnel string) Strategy {
+	if s, ok := x.strategies[tunnel]; ok {
+		return s
+	}
+	return x.defaultStrategy
+}
+
+// balance chooses a client for a request from candidates sorted by join time. It must be called with clientsMutex locked.
+func (x *Service) balance(tunnel string, candidates []*client) *client {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	switch x.strategy(tunnel) {
+	case StrategyRandom:
+		return candidates[rand.N(len(candidates))]
+
+	case StrategyLeastInFlight:
+		chosen := candidates[0]
+		for _, c := range candidates[1:] {
+			if c.inFlight.Load() < chosen.inFlight.Load() {
+				chosen = c
+			}
+		}
+		return chosen
+
+	default:
+		n := x.turns[tunnel]
+		x.turns[tunnel] = n + 1
+		return candidates[n%len(candidates)]
+	}
+}
@@ -1,123 +1,518 @@
 package hub
 
 import (
+	"cmp"
+	"context"
 	"errors"
+	"io"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/m-mizutani/backstream/pkg/model"
 	"github.com/m-mizutani/backstream/pkg/utils/logging"
 	"github.com/m-mizutani/opaq"
 )
 
 const (
-	// channelBufferSize is a buffer size of request channel. It's required to avoid blocking when WebSocket server is slow and disconnected.
+	// channelBufferSize is a buffer size of frame channel. It's required to avoid blocking when WebSocket server is slow and disconnected.
 	channelBufferSize = 32
+
+	// waitClientInterval is an interval of WaitClient to check clients of other replicas that do not notify their join.
+	waitClientInterval = 500 * time.Millisecond
 )
 
 type Service struct {
 	policy *opaq.Client
 
-	reqCh      map[string]chan *model.Request
-	reqChMutex sync.Mutex
+	// replica is a unique ID of the Service among replicas sharing backend
+	replica string
+	backend Backend
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	clients map[string]*client
+	// remotes has clients connected to other replicas
+	remotes      map[string]*client
+	clientsMutex sync.Mutex
+	// joined is closed and replaced when a client joins to wake up WaitClient
+	joined chan struct{}
+
+	// routes has replicas that emitted streams of local clients
+	routes      map[routeKey]*route
+	routesMutex sync.Mutex
+	// inbounds has messages from other replicas to be handled for each client
+	inbounds      map[string]*inbound
+	inboundsMutex sync.Mutex
+
+	strategies      map[string]Strategy
+	defaultStrategy Strategy
+	// turns is a counter of round-robin for each tunnel
+	turns map[string]int
+
+	streams      map[string]*Stream
+	streamsMutex sync.Mutex
+	// mirrorTimeout is a max duration to wait for responses of mirrors after the primary response
+	mirrorTimeout time.Duration
+}
+
+type client struct {
+	id     string
+	tunnel string
+	mode   model.TunnelMode
+	// joinedAt is used to choose clients in a stable order
+	joinedAt time.Time
+	// mirror receives copies of requests and its responses are only compared with the primary
+	mirror bool
+
+	out  chan *model.Frame
+	done chan struct{}
+	// publish sends a frame to the client connected to another replica. It's nil for local clients.
+	publish func(*model.Frame) error
+	// sequences number frames published for each stream to the client connected to another replica
+	sequences      map[string]*sequence
+	sequencesMutex sync.Mutex
+
+	// draining is true after the client requested not to receive new requests. It's set with clientsMutex locked.
+	draining atomic.Bool
+	// routing is read-locked while a request is sent to the client, so that Drain sends the drain frame after requests routed before draining
+	routing sync.RWMutex
+	// inFlight is a number of streams of the client in progress
+	inFlight atomic.Int64
+}
+
+var ErrClientLeft = errors.New("client left")
+
+// ErrClientDraining is an error of a request routed by another replica to a client that is draining.
+var ErrClientDraining = errors.New("client is draining")
+
+// send queues a frame to the client. It fails if the client has already left.
+func (x *client) send(frame *model.Frame) error {
+	if x.publish != nil {
+		return x.publish(frame)
+	}
+
+	select {
+	case x.out <- frame:
+		return nil
+	case <-x.done:
+		return ErrClientLeft
+	}
+}
 
-	respCh      map[string]chan *model.Response
-	respChMutex sync.Mutex
+func (x *client) info(replica string) *ClientInfo {
+	return &ClientInfo{
+		ID:       x.id,
+		Replica:  replica,
+		Tunnel:   x.tunnel,
+		Mode:     x.mode,
+		Mirror:   x.mirror,
+		Draining: x.draining.Load(),
+		JoinedAt: x.joinedAt,
+	}
 }
 
+// routeKey identifies a stream of a local client emitted by another replica.
+type routeKey struct {
+	client string
+	stream string
+}
+
+// New creates a Service. Close should be called when the Service is no longer used.
 func New(opts ...Option) *Service {
 	x := &Service{
-		reqCh:  make(map[string]chan *model.Request),
-		respCh: make(map[string]chan *model.Response),
+		replica:  uuid.NewString(),
+		clients:  make(map[string]*client),
+		remotes:  make(map[string]*client),
+		joined:   make(chan struct{}),
+		routes:   make(map[routeKey]*route),
+		inbounds: make(map[string]*inbound),
+		streams:  make(map[string]*Stream),
+
+		mirrorTimeout: mirrorTimeout,
+
+		strategies:      make(map[string]Strategy),
+		defaultStrategy: StrategyRoundRobin,
+		turns:           make(map[string]int),
 	}
 
 	for _, opt := range opts {
 		opt(x)
 	}
+	if x.backend == nil {
+		x.backend = NewMemoryBackend()
+	}
+
+	x.ctx, x.cancel = context.WithCancel(context.Background())
+	if err := x.backend.Subscribe(x.ctx, x.replica, x.receive); err != nil {
+		logging.Default().Error("failed to subscribe hub backend", "replica", x.replica, "error", err)
+	}
 
 	return x
 }
 
+// Close stops receiving messages from other replicas.
+func (x *Service) Close() {
+	x.cancel()
+}
+
 type Option func(*Service)
 
+// WithBackend sets a Backend shared with other replicas. The default is a MemoryBackend only for the Service.
+func WithBackend(backend Backend) Option {
+	return func(x *Service) {
+		x.backend = backend
+	}
+}
+
 func WithPolicy(policy *opaq.Client) Option {
 	return func(x *Service) {
 		x.policy = policy
 	}
 }
 
-// Join waits for a request from HTTP server.
+// JoinOption is an option of a client for Join.
+type JoinOption func(*client)
+
+// AsMirror makes the client a mirror of the tunnel. A mirror receives a copy of every request with body sent to the tunnel, and its response is compared with the response of the primary client instead of being returned to the caller.
+func AsMirror() JoinOption {
+	return func(c *client) {
+		c.mirror = true
+	}
+}
+
+// Join registers a client subscribing the tunnel and returns a channel of frames to be sent to the client. Only clients of TunnelHTTP receive requests emitted by EmitAndWait, and they are shared with other replicas by the backend.
 // This function should be called by WebSocket server.
-func (x *Service) Join(clientID string) chan *model.Request {
-	x.reqChMutex.Lock()
-	defer x.reqChMutex.Unlock()
+func (x *Service) Join(clientID, tunnel string, mode model.TunnelMode, opts ...JoinOption) <-chan *model.Frame {
+	c := &client{
+		id:       clientID,
+		tunnel:   tunnel,
+		mode:     mode,
+		joinedAt: time.Now(),
+		out:      make(chan *model.Frame, channelBufferSize),
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	x.clientsMutex.Lock()
+	x.clients[clientID] = c
+	close(x.joined)
+	x.joined = make(chan struct{})
+	x.clientsMutex.Unlock()
 
-	ch := make(chan *model.Request, channelBufferSize)
-	x.reqCh[clientID] = ch
-	return ch
+	x.register(c)
+	return c.out
 }
 
-// Leave removes a request channel.
+// register shares the local client with other replicas. A failure is only logged because the client is still available for this replica.
+func (x *Service) register(c *client) {
+	if c.mode != model.TunnelHTTP {
+		return
+	}
+	if err := x.backend.Register(x.ctx, c.info(x.replica)); err != nil {
+		logging.Default().Warn("failed to register client to hub backend", "client", c.id, "error", err)
+	}
+}
+
+// Leave removes a client. Streams waiting for the client fail with ErrClientLeft.
 // This function should be called by WebSocket server.
 func (x *Service) Leave(clientID string) {
-	x.reqChMutex.Lock()
-	defer x.reqChMutex.Unlock()
+	x.clientsMutex.Lock()
+	c, ok := x.clients[clientID]
+	if ok {
+		close(c.done)
+		delete(x.clients, clientID)
+	}
+	x.clientsMutex.Unlock()
 
-	if ch, ok := x.reqCh[clientID]; ok {
-		close(ch)
-		delete(x.reqCh, clientID)
+	if ok && c.mode == model.TunnelHTTP {
+		x.routesMutex.Lock()
+		for key := range x.routes {
+			if key.client == clientID {
+				delete(x.routes, key)
+			}
+		}
+		x.routesMutex.Unlock()
+
+		if err := x.backend.Unregister(x.ctx, c.info(x.replica)); err != nil {
+			logging.Default().Warn("failed to unregister client from hub backend", "client", clientID, "error", err)
+		}
 	}
+
+	x.leaveStreams(clientID)
+}
+
+// leaveRemote removes a client of another replica that left.
+func (x *Service) leaveRemote(clientID string) {
+	x.clientsMutex.Lock()
+	delete(x.remotes, clientID)
+	x.clientsMutex.Unlock()
+
+	x.leaveStreams(clientID)
 }
 
-// PutResponse puts a response to the response channel.
+func (x *Service) leaveStreams(clientID string) {
+	x.streamsMutex.Lock()
+	streams := make([]*Stream, 0, len(x.streams))
+	for _, stream := range x.streams {
+		streams = append(streams, stream)
+	}
+	x.streamsMutex.Unlock()
+
+	for _, stream := range streams {
+		stream.leave(clientID)
+	}
+}
+
+// Drain stops routing new requests to the client, and sends a drain frame to the client as an acknowledgment. The drain frame follows all requests routed to the client, so the client has received every request when it receives the drain frame. Streams in progress are not affected.
 // This function should be called by WebSocket server.
-func (x *Service) PutResponse(resp *model.Response) {
-	x.respChMutex.Lock()
-	defer x.respChMutex.Unlock()
+func (x *Service) Drain(clientID string) {
+	x.clientsMutex.Lock()
+	c, ok := x.clients[clientID]
+	if ok {
+		c.draining.Store(true)
+	}
+	x.clientsMutex.Unlock()
 
-	if ch, ok := x.respCh[resp.ID]; ok {
-		ch <- resp
-		close(ch)
-		delete(x.respCh, resp.ID)
+	if !ok {
+		return
 	}
+	x.register(c)
+
+	// Wait for requests routed before draining to be sent
+	c.routing.Lock()
+	defer c.routing.Unlock()
+	_ = c.send(&model.Frame{Type: model.FrameDrain})
+}
+
+// InFlight returns the number of streams of the client in progress.
+func (x *Service) InFlight(clientID string) int64 {
+	x.clientsMutex.Lock()
+	defer x.clientsMutex.Unlock()
+
+	if c, ok := x.clients[clientID]; ok {
+		return c.inFlight.Load()
+	}
+	return 0
+}
+
+// Tunnels returns sorted names of tunnels that have local clients to receive requests. Mirrors and draining clients are not counted.
+func (x *Service) Tunnels() []string {
+	x.clientsMutex.Lock()
+	defer x.clientsMutex.Unlock()
+
+	var tunnels []string
+	for _, c := range x.clients {
+		if c.mode == model.TunnelHTTP && !c.mirror && !c.draining.Load() && !slices.Contains(tunnels, c.tunnel) {
+			tunnels = append(tunnels, c.tunnel)
+		}
+	}
+	slices.Sort(tunnels)
+	return tunnels
 }
 
-// EmitAndWait emits a request and wait for the response.
+// PutFrame dispatches a frame received from the client to the stream.
+// This function should be called by WebSocket server.
+func (x *Service) PutFrame(clientID string, frame *model.Frame) {
+	x.streamsMutex.Lock()
+	stream, ok := x.streams[frame.ID]
+	x.streamsMutex.Unlock()
+
+	if !ok {
+		if x.forward(clientID, frame) {
+			return
+		}
+		// The stream has been already closed. Acknowledge data anyway not to stall the sender.
+		if frame.Type == model.FrameData {
+			x.ack(clientID, frame.ID, len(frame.Data))
+		}
+		return
+	}
+
+	stream.put(clientID, frame)
+}
+
+// EmitAndWait emits a request with body to a client subscribing the tunnel on any replica, chosen by the strategy of the tunnel, and waits for the response head until ctx is done. It returns ErrNoClient if the tunnel has no client other than mirrors. If body is not nil, mirrors of the tunnel also receive the request. It returns ErrTimeout if the deadline of ctx exceeded. The response body can be read from the returned Stream, and the Stream must be closed after use. If body is nil, data should be sent by Stream.Send after the response, e.g. WebSocket messages.
 // This function should be called by HTTP server.
-func (x *Service) EmitAndWait(req *model.Request) (*model.Response, error) {
-	respCh := x.joinRespCh(req.ID)
+func (x *Service) EmitAndWait(ctx context.Context, tunnel string, req *model.Request, body io.Reader) (*Stream, error) {
+	infos := x.remoteInfos(tunnel)
+	x.clientsMutex.Lock()
+	primaries, mirrors := x.candidates(tunnel, infos)
+	if len(primaries) == 0 {
+		x.clientsMutex.Unlock()
+		return nil, ErrNoClient
+	}
+	primary := x.balance(tunnel, primaries)
+	primary.routing.RLock()
+	x.clientsMutex.Unlock()
 
-	if err := x.broadcast(req); err != nil {
-		return nil, err
+	// Streams without body such as WebSocket are interactive, so they are not mirrored
+	if body == nil {
+		mirrors = nil
+	}
+
+	return x.emit(ctx, req, primary, mirrors, body)
+}
+
+// WaitClient waits until the tunnel has a client to receive requests on any replica, or ctx is done. It returns immediately if the tunnel already has one.
+func (x *Service) WaitClient(ctx context.Context, tunnel string) error {
+	ticker := time.NewTicker(waitClientInterval)
+	defer ticker.Stop()
+
+	for {
+		infos := x.remoteInfos(tunnel)
+		x.clientsMutex.Lock()
+		primaries, _ := x.candidates(tunnel, infos)
+		joined := x.joined
+		x.clientsMutex.Unlock()
+
+		if len(primaries) > 0 {
+			return nil
+		}
+
+		select {
+		case <-joined:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// remoteInfos returns clients of the tunnel connected to other replicas. A failure of the backend is only logged because local clients are still available.
+func (x *Service) remoteInfos(tunnel string) []*ClientInfo {
+	infos, err := x.backend.Clients(x.ctx, tunnel)
+	if err != nil {
+		logging.Default().Warn("failed to get clients from hub backend", "tunnel", tunnel, "error", err)
 	}
 
-	return <-respCh, nil
+	var remotes []*ClientInfo
+	for _, info := range infos {
+		if info.Replica != x.replica {
+			remotes = append(remotes, info)
+		}
+	}
+	return remotes
+}
+
+// candidates returns clients to receive requests of the tunnel. Primaries are sorted by join time. It must be called with clientsMutex locked.
+func (x *Service) candidates(tunnel string, remotes []*ClientInfo) ([]*client, []*client) {
+	all := make([]*client, 0, len(x.clients)+len(remotes))
+	for _, c := range x.clients {
+		all = append(all, c)
+	}
+	for _, info := range remotes {
+		all = append(all, x.remoteClient(info))
+	}
+
+	var primaries, mirrors []*client
+	for _, c := range all {
+		if c.tunnel != tunnel || c.mode != model.TunnelHTTP || c.draining.Load() {
+			continue
+		}
+		if c.mirror {
+			mirrors = append(mirrors, c)
+		} else {
+			primaries = append(primaries, c)
+		}
+	}
+
+	slices.SortFunc(primaries, func(a, b *client) int {
+		if n := a.joinedAt.Compare(b.joinedAt); n != 0 {
+			return n
+		}
+		return cmp.Compare(a.id, b.id)
+	})
+	return primaries, mirrors
+}
+
+// Open emits a request to the specified client and waits for the response head. Data of the stream should be sent by Stream.Send, e.g. a raw TCP connection.
+func (x *Service) Open(ctx context.Context, clientID string, req *model.Request) (*Stream, error) {
+	x.clientsMutex.Lock()
+	c, ok := x.clients[clientID]
+	ok = ok && !c.draining.Load()
+	if ok {
+		c.routing.RLock()
+	}
+	x.clientsMutex.Unlock()
+
+	if !ok {
+		return nil, ErrNoClient
+	}
+
+	return x.emit(ctx, req, c, nil, nil)
 }
 
 var ErrNoClient = errors.New("no client")
 
-func (x *Service) broadcast(req *model.Request) error {
-	x.reqChMutex.Lock()
-	defer x.reqChMutex.Unlock()
+// SendDatagram sends a UDP datagram received from peer to the specified client.
+func (x *Service) SendDatagram(clientID, peer string, data []byte) error {
+	x.clientsMutex.Lock()
+	c, ok := x.clients[clientID]
+	x.clientsMutex.Unlock()
 
-	if len(x.reqCh) == 0 {
+	if !ok {
 		return ErrNoClient
 	}
 
-	for _, ch := range x.reqCh {
-		ch <- req
+	return c.send(&model.Frame{Type: model.FrameDatagram, Peer: peer, Data: data})
+}
+
+// emit sends the request to the primary and mirrors, and waits for the response head. primary.routing must be read-locked by the caller, and it's unlocked after the request is sent to the primary.
+func (x *Service) emit(ctx context.Context, req *model.Request, primary *client, mirrors []*client, body io.Reader) (*Stream, error) {
+	stream := newStream(x, req.ID, primary, mirrors)
+
+	x.streamsMutex.Lock()
+	x.streams[req.ID] = stream
+	x.streamsMutex.Unlock()
+
+	logger := logging.Default()
+	frame := &model.Frame{Type: model.FrameRequest, ID: req.ID, Request: req}
+	for _, l := range stream.legs {
+		n := l.client.inFlight.Add(1)
+		logger.Debug("emitted request", "id", req.ID, "client", l.client.id, "tunnel", l.client.tunnel, "in_flight", n)
+		// Mirrors receive the request by sendBody not to block the primary
+		if l.mirror {
+			continue
+		}
+		if err := l.client.send(frame); err != nil {
+			l.respond(stream.respCh, nil, err)
+		}
 	}
-	logging.Default().Debug("broadcasted request", "id", req.ID, "count", len(x.reqCh))
-	return nil
+	primary.routing.RUnlock()
+
+	if body != nil {
+		go stream.sendBody(frame, body)
+	}
+
+	if err := stream.wait(ctx); err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	return stream, nil
 }
 
-func (x *Service) joinRespCh(id string) chan *model.Response {
-	x.respChMutex.Lock()
-	defer x.respChMutex.Unlock()
+func (x *Service) closeStream(id string) {
+	x.streamsMutex.Lock()
+	defer x.streamsMutex.Unlock()
 
-	ch := make(chan *model.Response)
-	x.respCh[id] = ch
+	delete(x.streams, id)
+}
 
-	logging.Default().Debug("joined response channel", "id", id)
+func (x *Service) ack(clientID, streamID string, n int) {
+	x.clientsMutex.Lock()
+	c, ok := x.clients[clientID]
+	if !ok {
+		c, ok = x.remotes[clientID]
+	}
+	x.clientsMutex.Unlock()
 
-	return ch
+	if ok {
+		_ = c.send(&model.Frame{Type: model.FrameAck, ID: streamID, Size: n})
+	}
 }
@@ -0,0 +1,62 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/m-mizutani/gt"
+)
+
+func TestService_Drain(t *testing.T) {
+	logging.Disable()
+
+	svc := New()
+	t.Cleanup(svc.Close)
+	frames := svc.Join("alice", model.DefaultTunnel, model.TunnelHTTP)
+	t.Cleanup(func() { svc.Leave("alice") })
+
+	// Requests are emitted while the client is draining
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			if stream, err := svc.EmitAndWait(ctx, model.DefaultTunnel, &model.Request{ID: fmt.Sprint(i)}, nil); err == nil {
+				stream.Close()
+			}
+		}()
+	}
+	go svc.Drain("alice")
+
+	// No request follows the drain frame
+	drained := false
+	timeout := time.After(500 * time.Millisecond)
+	for end := false; !end; {
+		select {
+		case frame := <-frames:
+			switch frame.Type {
+			case model.FrameDrain:
+				drained = true
+			case model.FrameRequest:
+				gt.False(t, drained)
+			}
+		case <-timeout:
+			end = true
+		}
+	}
+	wg.Wait()
+	gt.True(t, drained)
+
+	_, err := svc.EmitAndWait(context.Background(), model.DefaultTunnel, &model.Request{ID: "new"}, nil)
+	gt.True(t, errors.Is(err, ErrNoClient))
+	_, err = svc.Open(context.Background(), "alice", &model.Request{ID: "tcp"})
+	gt.True(t, errors.Is(err, ErrNoClient))
+}
@@ -0,0 +1,185 @@
+package hub
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+)
+
+const (
+	// mirrorTimeout is a default max duration to wait for responses of mirrors after the primary response.
+	mirrorTimeout = 30 * time.Second
+	// mirrorBodyLimit is a max size of response body kept to compare. Bodies over the limit are compared only by size.
+	mirrorBodyLimit = 1024 * 1024
+)
+
+// mirrorIgnoredHeaders are response headers that differ for every response.
+var mirrorIgnoredHeaders = []string{"Date"}
+
+// capture keeps a response body to compare primary and mirror.
+type capture struct {
+	mutex     sync.Mutex
+	buf       bytes.Buffer
+	size      int64
+	truncated bool
+	err       error
+
+	done chan struct{}
+	once sync.Once
+}
+
+func newCapture() *capture {
+	return &capture{done: make(chan struct{})}
+}
+
+// write appends p to the capture. The capture is done when err is not nil.
+func (x *capture) write(p []byte, err error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if len(p) > 0 {
+		x.size += int64(len(p))
+		if room := mirrorBodyLimit - x.buf.Len(); room < len(p) {
+			p = p[:max(room, 0)]
+			x.truncated = true
+		}
+		x.buf.Write(p)
+	}
+
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			x.err = err
+		}
+		x.once.Do(func() { close(x.done) })
+	}
+}
+
+func (x *capture) readFrom(r io.Reader) {
+	buf := make([]byte, model.ChunkSize)
+	for {
+		n, err := r.Read(buf)
+		x.write(buf[:n], err)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// completed returns true if the whole body has been read successfully.
+func (x *capture) completed() bool {
+	select {
+	case <-x.done:
+	default:
+		return false
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return x.err == nil
+}
+
+func (x *capture) readErr() error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return x.err
+}
+
+// compareMirrors waits for responses of mirrors, logs differences from the primary response, and releases the stream.
+func (x *Stream) compareMirrors() {
+	logger := logging.Default()
+	defer func() {
+		x.mirrorCancel()
+		x.svc.closeStream(x.id)
+	}()
+
+	// All mirrors share one deadline so that the wait ends even if some of them stall
+	deadline := time.Now().Add(x.svc.mirrorTimeout)
+
+	for _, l := range x.legs {
+		if !l.mirror {
+			continue
+		}
+
+		if x.primary.response != nil {
+			select {
+			case <-l.capture.done:
+			case <-time.After(time.Until(deadline)):
+			}
+		}
+		l.close(x.id)
+
+		switch {
+		case x.primary.response == nil:
+			// The primary failed, nothing to compare
+
+		case !l.capture.completed():
+			logger.Warn("mirror response is not completed", "id", x.id, "mirror", l.client.id, "error", l.capture.readErr())
+
+		default:
+			diff := diffResponse(x.primary.response, x.capture, l.response, l.capture)
+			if len(diff) == 0 {
+				logger.Info("mirror response matched", "id", x.id, "mirror", l.client.id)
+			} else {
+				logger.Warn("mirror response differs", "id", x.id, "mirror", l.client.id, "diff", diff)
+			}
+		}
+	}
+}
+
+// diffResponse returns differences of status code, headers and body between primary and mirror. The body is not compared if the primary body was not completely read by the caller.
+func diffResponse(primary *model.Response, primaryBody *capture, mirror *model.Response, mirrorBody *capture) []string {
+	var diff []string
+
+	if primary.Code != mirror.Code {
+		diff = append(diff, fmt.Sprintf("status: %d != %d", primary.Code, mirror.Code))
+	}
+
+	names := make(map[string]struct{})
+	for k := range primary.Header {
+		names[http.CanonicalHeaderKey(k)] = struct{}{}
+	}
+	for k := range mirror.Header {
+		names[http.CanonicalHeaderKey(k)] = struct{}{}
+	}
+	sorted := make([]string, 0, len(names))
+	for k := range names {
+		if !slices.Contains(mirrorIgnoredHeaders, k) {
+			sorted = append(sorted, k)
+		}
+	}
+	slices.Sort(sorted)
+	for _, k := range sorted {
+		p, m := http.Header(primary.Header).Values(k), http.Header(mirror.Header).Values(k)
+		if !slices.Equal(p, m) {
+			diff = append(diff, fmt.Sprintf("header %s: %q != %q", k, p, m))
+		}
+	}
+
+	if !primaryBody.completed() {
+		return diff
+	}
+	switch {
+	case primaryBody.size != mirrorBody.size:
+		diff = append(diff, fmt.Sprintf("body size: %d != %d", primaryBody.size, mirrorBody.size))
+	case primaryBody.truncated || mirrorBody.truncated:
+		// Bodies over the limit are compared only by size
+	default:
+		p, m := primaryBody.buf.Bytes(), mirrorBody.buf.Bytes()
+		for i := range p {
+			if p[i] != m[i] {
+				diff = append(diff, fmt.Sprintf("body: differs at byte %d", i))
+				break
+			}
+		}
+	}
+
+	return diff
+}
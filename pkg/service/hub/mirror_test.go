@@ -0,0 +1,110 @@
+package hub
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/gt"
+)
+
+func newCaptured(body []byte, err error) *capture {
+	c := newCapture()
+	c.write(body, err)
+	return c
+}
+
+func TestCapture(t *testing.T) {
+	t.Run("body is kept until the end", func(t *testing.T) {
+		c := newCapture()
+		gt.False(t, c.completed())
+		c.readFrom(bytes.NewReader([]byte("hello")))
+		gt.True(t, c.completed())
+		gt.V(t, c.buf.String()).Equal("hello")
+		gt.V(t, c.size).Equal(int64(5))
+		gt.False(t, c.truncated)
+	})
+
+	t.Run("body over the limit is truncated", func(t *testing.T) {
+		c := newCapture()
+		c.readFrom(bytes.NewReader(make([]byte, mirrorBodyLimit+10)))
+		gt.True(t, c.completed())
+		gt.True(t, c.truncated)
+		gt.V(t, c.buf.Len()).Equal(mirrorBodyLimit)
+		gt.V(t, c.size).Equal(int64(mirrorBodyLimit + 10))
+	})
+
+	t.Run("read error is not completed", func(t *testing.T) {
+		c := newCaptured([]byte("partial"), io.ErrUnexpectedEOF)
+		gt.False(t, c.completed())
+		gt.True(t, errors.Is(c.readErr(), io.ErrUnexpectedEOF))
+	})
+}
+
+func TestDiffResponse(t *testing.T) {
+	large := make([]byte, mirrorBodyLimit+1)
+	largeOther := bytes.Clone(large)
+	largeOther[len(largeOther)-1] = 1
+
+	testCases := map[string]struct {
+		primary     *model.Response
+		primaryBody *capture
+		mirror      *model.Response
+		mirrorBody  *capture
+		expect      []string
+	}{
+		"same": {
+			primary:     &model.Response{Code: 200, Header: http.Header{"Content-Type": {"text/plain"}, "Date": {"Mon"}}},
+			primaryBody: newCaptured([]byte("ok"), io.EOF),
+			mirror:      &model.Response{Code: 200, Header: http.Header{"Content-Type": {"text/plain"}, "Date": {"Tue"}}},
+			mirrorBody:  newCaptured([]byte("ok"), io.EOF),
+		},
+		"status and header": {
+			primary:     &model.Response{Code: 200, Header: http.Header{"X-Version": {"1"}}},
+			primaryBody: newCaptured(nil, io.EOF),
+			mirror:      &model.Response{Code: 500, Header: http.Header{"X-Version": {"2"}, "X-Extra": {"a"}}},
+			mirrorBody:  newCaptured(nil, io.EOF),
+			expect: []string{
+				"status: 200 != 500",
+				`header X-Extra: [] != ["a"]`,
+				`header X-Version: ["1"] != ["2"]`,
+			},
+		},
+		"body": {
+			primary:     &model.Response{Code: 200},
+			primaryBody: newCaptured([]byte("abcd"), io.EOF),
+			mirror:      &model.Response{Code: 200},
+			mirrorBody:  newCaptured([]byte("abXd"), io.EOF),
+			expect:      []string{"body: differs at byte 2"},
+		},
+		"body size": {
+			primary:     &model.Response{Code: 200},
+			primaryBody: newCaptured([]byte("abcd"), io.EOF),
+			mirror:      &model.Response{Code: 200},
+			mirrorBody:  newCaptured([]byte("abc"), io.EOF),
+			expect:      []string{"body size: 4 != 3"},
+		},
+		"truncated body is compared only by size": {
+			primary:     &model.Response{Code: 200},
+			primaryBody: newCaptured(large, io.EOF),
+			mirror:      &model.Response{Code: 200},
+			mirrorBody:  newCaptured(largeOther, io.EOF),
+		},
+		"body not read by the caller": {
+			primary:     &model.Response{Code: 200},
+			primaryBody: newCaptured([]byte("ab"), nil),
+			mirror:      &model.Response{Code: 200},
+			mirrorBody:  newCaptured([]byte("other"), io.EOF),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			diff := diffResponse(tc.primary, tc.primaryBody, tc.mirror, tc.mirrorBody)
+			gt.A(t, diff).Equal(tc.expect)
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/m-mizutani/goerr/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// DefaultRedisPrefix is a prefix of keys and channels of RedisBackend.
+	DefaultRedisPrefix = "backstream"
+
+	// redisClientTTL is a duration until a client registered by a replica expires. Replicas refresh their clients in redisClientTTL/3 so that clients of a crashed replica disappear.
+	redisClientTTL = 30 * time.Second
+)
+
+// RedisBackend is a Backend with Redis. Clients are kept in a hash per tunnel, and messages are delivered by Redis pub/sub with a channel per replica.
+type RedisBackend struct {
+	client *redis.Client
+	prefix string
+	// ttl is a duration until a client expires without refresh
+	ttl time.Duration
+
+	// local has clients registered by this process to be refreshed
+	local      map[string]*ClientInfo
+	localMutex sync.Mutex
+}
+
+// RedisOption is an option of NewRedisBackend.
+type RedisOption func(*RedisBackend)
+
+// WithRedisPrefix sets a prefix of keys and channels. Servers with different prefixes do not share clients on the same Redis.
+func WithRedisPrefix(prefix string) RedisOption {
+	return func(x *RedisBackend) {
+		x.prefix = prefix
+	}
+}
+
+// NewRedisBackend creates a Backend with the Redis client.
+func NewRedisBackend(client *redis.Client, opts ...RedisOption) *RedisBackend {
+	x := &RedisBackend{
+		client: client,
+		prefix: DefaultRedisPrefix,
+		ttl:    redisClientTTL,
+		local:  make(map[string]*ClientInfo),
+	}
+	for _, opt := range opts {
+		opt(x)
+	}
+	return x
+}
+
+// redisEntry is a value of the tunnel hash.
+type redisEntry struct {
+	*ClientInfo
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (x *RedisBackend) tunnelKey(tunnel string) string {
+	return x.prefix + ":tunnel:" + tunnel
+}
+
+func (x *RedisBackend) replicaChannel(replica string) string {
+	return x.prefix + ":replica:" + replica
+}
+
+func (x *RedisBackend) leftChannel() string {
+	return x.prefix + ":left"
+}
+
+func (x *RedisBackend) Register(ctx context.Context, info *ClientInfo) error {
+	v := *info
+	x.localMutex.Lock()
+	x.local[info.ID] = &v
+	x.localMutex.Unlock()
+
+	return x.store(ctx, &v)
+}
+
+func (x *RedisBackend) store(ctx context.Context, info *ClientInfo) error {
+	raw, err := json.Marshal(redisEntry{ClientInfo: info, ExpiresAt: time.Now().Add(x.ttl)})
+	if err != nil {
+		return goerr.Wrap(err, "failed to marshal client info", goerr.V("client", info.ID))
+	}
+	if err := x.client.HSet(ctx, x.tunnelKey(info.Tunnel), info.ID, raw).Err(); err != nil {
+		return goerr.Wrap(err, "failed to register client to Redis", goerr.V("client", info.ID))
+	}
+	return nil
+}
+
+func (x *RedisBackend) Unregister(ctx context.Context, info *ClientInfo) error {
+	x.localMutex.Lock()
+	delete(x.local, info.ID)
+	x.localMutex.Unlock()
+
+	if err := x.client.HDel(ctx, x.tunnelKey(info.Tunnel), info.ID).Err(); err != nil {
+		return goerr.Wrap(err, "failed to unregister client from Redis", goerr.V("client", info.ID))
+	}
+
+	raw, err := json.Marshal(&Message{From: info.Replica, ClientID: info.ID, Left: true})
+	if err != nil {
+		return goerr.Wrap(err, "failed to marshal message")
+	}
+	if err := x.client.Publish(ctx, x.leftChannel(), raw).Err(); err != nil {
+		return goerr.Wrap(err, "failed to publish left client", goerr.V("client", info.ID))
+	}
+	return nil
+}
+
+// Clients returns clients of the tunnel that are not expired. Expired clients are removed.
+func (x *RedisBackend) Clients(ctx context.Context, tunnel string) ([]*ClientInfo, error) {
+	values, err := x.client.HGetAll(ctx, x.tunnelKey(tunnel)).Result()
+	if err != nil {
+		return nil, goerr.Wrap(err, "failed to get clients from Redis", goerr.V("tunnel", tunnel))
+	}
+
+	now := time.Now()
+	var clients []*ClientInfo
+	var expired []string
+	for id, raw := range values {
+		var entry redisEntry
+		if err := json.Unmarshal([]byte(raw), &entry); err != nil || entry.ClientInfo == nil {
+			expired = append(expired, id)
+			continue
+		}
+		if now.After(entry.ExpiresAt) {
+			expired = append(expired, id)
+			continue
+		}
+		clients = append(clients, entry.ClientInfo)
+	}
+
+	if len(expired) > 0 {
+		if err := x.client.HDel(ctx, x.tunnelKey(tunnel), expired...).Err(); err != nil {
+			logging.Extract(ctx).Warn("failed to remove expired clients", "tunnel", tunnel, "error", err)
+		}
+	}
+
+	return clients, nil
+}
+
+func (x *RedisBackend) Publish(ctx context.Context, replica string, msg *Message) error {
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return goerr.Wrap(err, "failed to marshal message")
+	}
+	if err := x.client.Publish(ctx, x.replicaChannel(replica), raw).Err(); err != nil {
+		return goerr.Wrap(err, "failed to publish message", goerr.V("replica", replica))
+	}
+	return nil
+}
+
+// Subscribe receives messages to the replica and refreshes clients registered by this process until ctx is done.
+func (x *RedisBackend) Subscribe(ctx context.Context, replica string, handler func(*Message)) error {
+	pubsub := x.client.Subscribe(ctx, x.replicaChannel(replica), x.leftChannel())
+	if _, err := pubsub.Receive(ctx); err != nil {
+		_ = pubsub.Close()
+		return goerr.Wrap(err, "failed to subscribe Redis channel", goerr.V("replica", replica))
+	}
+
+	// Refresh runs apart from receiving messages so that clients do not expire while messages are busy
+	go func() {
+		ticker := time.NewTicker(x.ttl / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				x.refresh(ctx)
+			}
+		}
+	}()
+
+	go func() {
+		defer pubsub.Close()
+		logger := logging.Default()
+
+		ch := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case m, ok := <-ch:
+				if !ok {
+					return
+				}
+				var msg Message
+				if err := json.Unmarshal([]byte(m.Payload), &msg); err != nil {
+					logger.Warn("failed to unmarshal message from Redis", "channel", m.Channel, "error", err)
+					continue
+				}
+				handler(&msg)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// refresh extends expiration of clients registered by this process.
+func (x *RedisBackend) refresh(ctx context.Context) {
+	x.localMutex.Lock()
+	clients := make([]*ClientInfo, 0, len(x.local))
+	for _, info := range x.local {
+		clients = append(clients, info)
+	}
+	x.localMutex.Unlock()
+
+	for _, info := range clients {
+		if err := x.store(ctx, info); err != nil {
+			logging.Default().Warn("failed to refresh client", "client", info.ID, "error", err)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package hub
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+)
+
+// ErrMessageLost is an error of a stream that lost messages between replicas, e.g. dropped by the backend.
+var ErrMessageLost = errors.New("messages between replicas were lost")
+
+// sequence numbers messages of a stream published to another replica from 1, so that the receiver detects lost messages by a gap.
+type sequence struct {
+	mutex sync.Mutex
+	last  uint64
+}
+
+// publish calls fn with the next number. fn is called with mutex locked so that messages are published in the order of numbers.
+func (x *sequence) publish(fn func(seq uint64) error) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	x.last++
+	return fn(x.last)
+}
+
+// route is a stream of a local client emitted by another replica.
+type route struct {
+	replica string
+	// received is a sequence number of the last message from the replica
+	received uint64
+	// sent numbers messages from the client to the replica
+	sent sequence
+}
+
+// inbound is a queue of messages from other replicas for a client.
+type inbound struct {
+	messages []*Message
+}
+
+// sequence returns the sequence of the stream of frame. It's created by the request frame, and nil for a frame of a stream without the request, e.g. an acknowledgment after the stream was closed.
+func (x *client) sequence(frame *model.Frame) *sequence {
+	x.sequencesMutex.Lock()
+	defer x.sequencesMutex.Unlock()
+
+	if frame.Type == model.FrameRequest {
+		x.sequences[frame.ID] = &sequence{}
+	}
+	return x.sequences[frame.ID]
+}
+
+// forget removes the sequence of the stream that was closed.
+func (x *client) forget(id string) {
+	x.sequencesMutex.Lock()
+	defer x.sequencesMutex.Unlock()
+
+	delete(x.sequences, id)
+}
+
+// remoteClient returns a client connected to another replica. Frames sent to the client are published to the replica by the backend. It must be called with clientsMutex locked.
+func (x *Service) remoteClient(info *ClientInfo) *client {
+	c, ok := x.remotes[info.ID]
+	if !ok {
+		c = &client{
+			id:        info.ID,
+			tunnel:    info.Tunnel,
+			mode:      info.Mode,
+			joinedAt:  info.JoinedAt,
+			mirror:    info.Mirror,
+			done:      make(chan struct{}),
+			sequences: make(map[string]*sequence),
+		}
+		replica := info.Replica
+		c.publish = func(frame *model.Frame) error {
+			msg := &Message{From: x.replica, ClientID: c.id, ToClient: true, Frame: frame}
+			seq := c.sequence(frame)
+			if seq == nil {
+				return x.backend.Publish(x.ctx, replica, msg)
+			}
+			return seq.publish(func(n uint64) error {
+				msg.Seq = n
+				return x.backend.Publish(x.ctx, replica, msg)
+			})
+		}
+		x.remotes[info.ID] = c
+	}
+	c.draining.Store(info.Draining)
+	return c
+}
+
+// receive queues a message from another replica. Messages of each client are handled in order by a goroutine apart from the backend, so that a client slow to receive frames does not block messages of other clients.
+func (x *Service) receive(msg *Message) {
+	if msg.From == x.replica {
+		return
+	}
+
+	x.inboundsMutex.Lock()
+	defer x.inboundsMutex.Unlock()
+
+	q, ok := x.inbounds[msg.ClientID]
+	if !ok {
+		q = &inbound{}
+		x.inbounds[msg.ClientID] = q
+		go x.dispatch(msg.ClientID, q)
+	}
+	q.messages = append(q.messages, msg)
+}
+
+// dispatch handles messages in the queue of the client until it's empty.
+func (x *Service) dispatch(clientID string, q *inbound) {
+	for {
+		x.inboundsMutex.Lock()
+		if len(q.messages) == 0 {
+			delete(x.inbounds, clientID)
+			x.inboundsMutex.Unlock()
+			return
+		}
+		msg := q.messages[0]
+		q.messages = q.messages[1:]
+		x.inboundsMutex.Unlock()
+
+		x.handle(msg)
+	}
+}
+
+// handle handles a message from another replica.
+func (x *Service) handle(msg *Message) {
+	switch {
+	case msg.Left:
+		x.leaveRemote(msg.ClientID)
+	case msg.Frame == nil:
+		return
+	case msg.ToClient:
+		x.deliver(msg)
+	default:
+		x.put(msg)
+	}
+}
+
+// put dispatches a frame from the client connected to another replica to the stream. The leg of the client fails if preceding messages were lost.
+func (x *Service) put(msg *Message) {
+	x.streamsMutex.Lock()
+	stream, ok := x.streams[msg.Frame.ID]
+	x.streamsMutex.Unlock()
+
+	if ok && !stream.received(msg.ClientID, msg.Seq) {
+		logging.Default().Warn("lost messages from replica", "id", msg.Frame.ID, "client", msg.ClientID, "replica", msg.From, "seq", msg.Seq)
+		stream.fail(msg.ClientID, ErrMessageLost)
+		return
+	}
+
+	x.PutFrame(msg.ClientID, msg.Frame)
+}
+
+// deliver sends a frame from another replica to the local client, and remembers the replica to forward frames of the stream from the client. The stream is aborted if preceding messages were lost, and a request to the draining client is rejected.
+func (x *Service) deliver(msg *Message) {
+	x.clientsMutex.Lock()
+	c, ok := x.clients[msg.ClientID]
+	x.clientsMutex.Unlock()
+
+	if !ok {
+		// Let the replica fail the stream because the client already left
+		if err := x.backend.Publish(x.ctx, msg.From, &Message{From: x.replica, ClientID: msg.ClientID, Left: true}); err != nil {
+			logging.Default().Warn("failed to notify left client", "client", msg.ClientID, "replica", msg.From, "error", err)
+		}
+		return
+	}
+
+	key := routeKey{client: c.id, stream: msg.Frame.ID}
+	x.routesMutex.Lock()
+	r, ok := x.routes[key]
+	switch msg.Frame.Type {
+	case model.FrameRequest:
+		r, ok = &route{replica: msg.From}, true
+		x.routes[key] = r
+	case model.FrameCancel:
+		delete(x.routes, key)
+	}
+	lost := ok && msg.Seq != 0 && msg.Seq != r.received+1
+	if ok && msg.Seq != 0 {
+		r.received = msg.Seq
+	}
+	x.routesMutex.Unlock()
+
+	if lost {
+		logging.Default().Warn("lost messages from replica", "id", key.stream, "client", key.client, "replica", r.replica)
+		_ = c.send(&model.Frame{Type: model.FrameCancel, ID: key.stream})
+		x.abort(key, r, ErrMessageLost)
+		return
+	}
+
+	if msg.Frame.Type == model.FrameRequest {
+		// The request must not follow the drain frame sent by Drain
+		c.routing.RLock()
+		defer c.routing.RUnlock()
+		if c.draining.Load() {
+			x.abort(key, r, ErrClientDraining)
+			return
+		}
+	}
+	_ = c.send(msg.Frame)
+}
+
+// abort removes the route of the stream, and fails the stream on the replica with err.
+func (x *Service) abort(key routeKey, r *route, err error) {
+	x.routesMutex.Lock()
+	delete(x.routes, key)
+	x.routesMutex.Unlock()
+
+	msg := &Message{From: x.replica, ClientID: key.client, Frame: model.NewEndFrame(key.stream, err)}
+	if err := r.sent.publish(func(seq uint64) error {
+		msg.Seq = seq
+		return x.backend.Publish(x.ctx, r.replica, msg)
+	}); err != nil {
+		logging.Default().Warn("failed to notify aborted stream", "id", key.stream, "client", key.client, "replica", r.replica, "error", err)
+	}
+}
+
+// forward sends a frame from the local client to the replica that emitted the stream. It returns false if the stream was not emitted by another replica.
+func (x *Service) forward(clientID string, frame *model.Frame) bool {
+	key := routeKey{client: clientID, stream: frame.ID}
+	x.routesMutex.Lock()
+	r, ok := x.routes[key]
+	if ok && frame.Type == model.FrameEnd {
+		delete(x.routes, key)
+	}
+	x.routesMutex.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	msg := &Message{From: x.replica, ClientID: clientID, Frame: frame}
+	if err := r.sent.publish(func(seq uint64) error {
+		msg.Seq = seq
+		return x.backend.Publish(x.ctx, r.replica, msg)
+	}); err != nil {
+		logging.Default().Warn("failed to forward frame to replica", "id", frame.ID, "client", clientID, "replica", r.replica, "error", err)
+	}
+	return true
+}
@@ -0,0 +1,354 @@
+package hub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/utils/flow"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+)
+
+var (
+	ErrStreamClosed = errors.New("stream closed")
+	// ErrTimeout is returned when the context deadline exceeded before the response head arrived.
+	ErrTimeout = errors.New("response timeout")
+
+	errMirrorDropped = errors.New("request body to mirror is dropped")
+)
+
+// mirrorQueueSize is a number of request body chunks buffered for a mirror. A mirror that falls behind by more chunks is dropped so that it never slows down the primary.
+const mirrorQueueSize = 32
+
+// Stream is an exchange of a request and a response with clients. The request is sent to every leg (client), and the response of the primary leg is the response of the stream. Responses of mirror legs are compared with the primary after the stream is closed.
+type Stream struct {
+	id   string
+	svc  *Service
+	legs map[string]*leg
+
+	respCh  chan *leg
+	primary *leg
+
+	// capture has the response body of the primary to be compared with mirrors
+	capture *capture
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// mirrorCtx is canceled after mirrors are compared, apart from ctx so that Close does not wait for mirrors
+	mirrorCtx    context.Context
+	mirrorCancel context.CancelFunc
+	closeOnce    sync.Once
+}
+
+type leg struct {
+	client *client
+	window *flow.Window
+	body   *flow.Buffer
+	mirror bool
+	// capture has the response body of a mirror
+	capture *capture
+
+	once     sync.Once
+	response *model.Response
+	err      error
+
+	// ended is true after the client finished sending the response body
+	ended atomic.Bool
+	// received is a sequence number of the last message from the client connected to another replica
+	received uint64
+}
+
+func newStream(svc *Service, id string, primary *client, mirrors []*client) *Stream {
+	ctx, cancel := context.WithCancel(context.Background())
+	x := &Stream{
+		id:     id,
+		svc:    svc,
+		legs:   make(map[string]*leg, len(mirrors)+1),
+		respCh: make(chan *leg, len(mirrors)+1),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	x.mirrorCtx, x.mirrorCancel = context.WithCancel(context.Background())
+
+	newLeg := func(c *client) *leg {
+		return &leg{
+			client: c,
+			window: flow.NewWindow(model.WindowSize),
+			body: flow.NewBuffer(func(n int) {
+				svc.ack(c.id, id, n)
+			}),
+		}
+	}
+
+	x.primary = newLeg(primary)
+	x.legs[primary.id] = x.primary
+	for _, c := range mirrors {
+		l := newLeg(c)
+		l.mirror = true
+		l.capture = newCapture()
+		x.legs[c.id] = l
+	}
+	if len(mirrors) > 0 {
+		x.capture = newCapture()
+	}
+
+	return x
+}
+
+// Response returns the response head of the stream.
+func (x *Stream) Response() *model.Response {
+	return x.primary.response
+}
+
+// Read reads the response body of the stream.
+func (x *Stream) Read(p []byte) (int, error) {
+	n, err := x.primary.body.Read(p)
+	if x.capture != nil {
+		x.capture.write(p[:n], err)
+	}
+	return n, err
+}
+
+// ReadChunk reads data from the client keeping message boundaries.
+func (x *Stream) ReadChunk() (flow.Chunk, error) {
+	return x.primary.body.ReadChunk()
+}
+
+// Send sends data to the primary client. It's available only for a stream emitted without request body.
+func (x *Stream) Send(ctx context.Context, chunk flow.Chunk) error {
+	return x.primary.sendData(ctx, x.id, chunk)
+}
+
+// CloseSend notifies the primary client that no more data will be sent. err is sent as the reason of the end.
+func (x *Stream) CloseSend(err error) error {
+	return x.primary.client.send(model.NewEndFrame(x.id, err))
+}
+
+// Close releases the stream. The response body can not be read after Close. A cancel frame is sent to the primary client if it has not finished the response so that it aborts the request to the local application. Mirrors are released in background after their responses are completed and compared.
+func (x *Stream) Close() {
+	x.closeOnce.Do(func() {
+		x.primary.close(x.id)
+		x.cancel()
+
+		if x.capture == nil {
+			x.mirrorCancel()
+			x.svc.closeStream(x.id)
+			return
+		}
+		go x.compareMirrors()
+	})
+}
+
+func (x *Stream) put(clientID string, frame *model.Frame) {
+	l, ok := x.legs[clientID]
+	if !ok {
+		return
+	}
+
+	switch frame.Type {
+	case model.FrameResponse:
+		l.respond(x.respCh, frame.Response, nil)
+	case model.FrameData:
+		l.body.Push(frame.Chunk())
+	case model.FrameEnd:
+		l.ended.Store(true)
+		err := frame.EndError()
+		// An end with error before the response head fails the leg, e.g. messages between replicas were lost
+		if err != nil {
+			l.respond(x.respCh, nil, err)
+		}
+		l.body.Close(err)
+	case model.FrameAck:
+		l.window.Release(frame.Size)
+	}
+}
+
+// leave fails the leg of the client that left.
+func (x *Stream) leave(clientID string) {
+	l, ok := x.legs[clientID]
+	if !ok {
+		return
+	}
+
+	l.ended.Store(true)
+	l.fail(x.respCh, ErrClientLeft)
+}
+
+// fail fails the leg of the client with err. The request of the client is canceled when the stream is closed.
+func (x *Stream) fail(clientID string, err error) {
+	if l, ok := x.legs[clientID]; ok {
+		l.fail(x.respCh, err)
+	}
+}
+
+// received checks the sequence number of a message from the client connected to another replica, and returns false if preceding messages were lost. seq 0 is not checked.
+func (x *Stream) received(clientID string, seq uint64) bool {
+	l, ok := x.legs[clientID]
+	if !ok || seq == 0 {
+		return true
+	}
+	lost := seq != l.received+1
+	l.received = seq
+	return !lost
+}
+
+// wait waits for the response head of the primary until ctx is done. Response bodies of mirrors are captured in background.
+func (x *Stream) wait(ctx context.Context) error {
+	for _, l := range x.legs {
+		if l.mirror {
+			go l.capture.readFrom(l.body)
+		}
+	}
+
+	for {
+		select {
+		case l := <-x.respCh:
+			if l != x.primary {
+				continue
+			}
+			return l.err
+
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return ErrTimeout
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// bodyChunk is a result of a read of the request body.
+type bodyChunk struct {
+	data []byte
+	err  error
+}
+
+// readBody reads body into chunks until an error or ctx is done. It runs apart from sendBody because a read from a stalled caller can not be canceled, and the stream must be released without waiting for it.
+func readBody(ctx context.Context, body io.Reader, chunks chan<- bodyChunk) {
+	buf := make([]byte, model.ChunkSize)
+	for {
+		n, err := body.Read(buf)
+		select {
+		case chunks <- bodyChunk{data: bytes.Clone(buf[:n]), err: err}:
+		case <-ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// sendBody sends the request body to the primary as data frames with flow control until the body ends or the stream is canceled. Mirrors receive the request frame and copies of the body through their queues so that a slow mirror does not block the primary.
+func (x *Stream) sendBody(request *model.Frame, body io.Reader) {
+	chunks := make(chan bodyChunk)
+	go readBody(x.ctx, body, chunks)
+
+	queues := make(map[*leg]chan bodyChunk)
+	for _, l := range x.legs {
+		if l.mirror {
+			queues[l] = make(chan bodyChunk, mirrorQueueSize)
+			go x.sendMirror(l, request, queues[l])
+		}
+	}
+	// Closing a queue before the end of the body aborts the mirror
+	defer func() {
+		for _, queue := range queues {
+			close(queue)
+		}
+	}()
+
+	failed := false
+	for {
+		var read bodyChunk
+		select {
+		case read = <-chunks:
+		case <-x.ctx.Done():
+			return
+		}
+
+		for l, queue := range queues {
+			select {
+			case queue <- read:
+			default:
+				logging.Default().Warn("mirror fell behind the request body", "id", x.id, "mirror", l.client.id)
+				close(queue)
+				delete(queues, l)
+			}
+		}
+
+		if len(read.data) > 0 && !failed {
+			if err := x.primary.sendData(x.ctx, x.id, flow.Chunk{Data: read.data}); err != nil {
+				logging.Default().Debug("failed to send request body", "id", x.id, "client", x.primary.client.id, "error", err)
+				failed = true
+				x.primary.respond(x.respCh, nil, err)
+			}
+		}
+
+		if read.err != nil {
+			_ = x.primary.client.send(model.NewEndFrame(x.id, read.err))
+			return
+		}
+	}
+}
+
+// sendMirror sends the request frame and body chunks in queue to the mirror until the end of the body. If queue is closed before the end, the mirror is aborted by an end frame with an error.
+func (x *Stream) sendMirror(l *leg, request *model.Frame, queue <-chan bodyChunk) {
+	if err := l.client.send(request); err != nil {
+		l.respond(x.respCh, nil, err)
+		return
+	}
+
+	for read := range queue {
+		if len(read.data) > 0 {
+			if err := l.sendData(x.mirrorCtx, x.id, flow.Chunk{Data: read.data}); err != nil {
+				logging.Default().Debug("failed to send request body to mirror", "id", x.id, "mirror", l.client.id, "error", err)
+				l.respond(x.respCh, nil, err)
+				return
+			}
+		}
+		if read.err != nil {
+			_ = l.client.send(model.NewEndFrame(x.id, read.err))
+			return
+		}
+	}
+
+	_ = l.client.send(model.NewEndFrame(x.id, errMirrorDropped))
+	l.respond(x.respCh, nil, errMirrorDropped)
+}
+
+// respond notifies the result of the leg only once. Either resp or err should be set.
+func (x *leg) respond(respCh chan *leg, resp *model.Response, err error) {
+	x.once.Do(func() {
+		x.response = resp
+		x.err = err
+		respCh <- x
+	})
+}
+
+func (x *leg) fail(respCh chan *leg, err error) {
+	x.respond(respCh, nil, err)
+	x.window.Close()
+	x.body.Close(err)
+}
+
+// close releases the leg and cancels the request of the client if the response is not finished.
+func (x *leg) close(id string) {
+	x.client.inFlight.Add(-1)
+	x.window.Close()
+	x.body.Close(ErrStreamClosed)
+	if !x.ended.Load() {
+		_ = x.client.send(&model.Frame{Type: model.FrameCancel, ID: id})
+	}
+	x.client.forget(id)
+}
+
+func (x *leg) sendData(ctx context.Context, id string, chunk flow.Chunk) error {
+	return x.window.Send(ctx, chunk, func(c flow.Chunk) error {
+		return x.client.send(model.NewDataFrame(id, c))
+	})
+}
@@ -0,0 +1,104 @@
+package hub
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/utils/flow"
+	"github.com/m-mizutani/backstream/pkg/utils/logging"
+	"github.com/m-mizutani/gt"
+)
+
+// echoClient acknowledges the request body from frames and responds with the body.
+func echoClient(svc *Service, clientID string, frames <-chan *model.Frame) {
+	var body []byte
+	for frame := range frames {
+		switch frame.Type {
+		case model.FrameData:
+			body = append(body, frame.Data...)
+			svc.PutFrame(clientID, &model.Frame{Type: model.FrameAck, ID: frame.ID, Size: len(frame.Data)})
+		case model.FrameEnd:
+			svc.PutFrame(clientID, &model.Frame{Type: model.FrameResponse, ID: frame.ID, Response: &model.Response{Code: http.StatusOK}})
+			svc.PutFrame(clientID, model.NewDataFrame(frame.ID, flow.Chunk{Data: body}))
+			svc.PutFrame(clientID, model.NewEndFrame(frame.ID, nil))
+			body = nil
+		}
+	}
+}
+
+func TestStream_StalledMirror(t *testing.T) {
+	logging.Disable()
+
+	svc := New()
+	t.Cleanup(svc.Close)
+
+	go echoClient(svc, "primary", svc.Join("primary", model.DefaultTunnel, model.TunnelHTTP))
+	// The mirror never reads frames
+	svc.Join("mirror", model.DefaultTunnel, model.TunnelHTTP, AsMirror())
+	t.Cleanup(func() { svc.Leave("mirror") })
+
+	body := bytes.Repeat([]byte("a"), 4*1024*1024)
+	done := make(chan []byte)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stream, err := svc.EmitAndWait(ctx, model.DefaultTunnel, &model.Request{ID: "req"}, bytes.NewReader(body))
+		if err != nil {
+			done <- nil
+			return
+		}
+		resp, _ := io.ReadAll(stream)
+		stream.Close()
+		done <- resp
+	}()
+
+	select {
+	case resp := <-done:
+		gt.V(t, len(resp)).Equal(len(body))
+	case <-time.After(5 * time.Second):
+		t.Fatal("primary is blocked by the mirror")
+	}
+}
+
+func TestStream_StalledMirrors(t *testing.T) {
+	logging.Disable()
+
+	svc := New()
+	svc.mirrorTimeout = 100 * time.Millisecond
+	t.Cleanup(svc.Close)
+
+	go echoClient(svc, "primary", svc.Join("primary", model.DefaultTunnel, model.TunnelHTTP))
+	// Mirrors receive frames but never respond
+	for _, id := range []string{"mirror1", "mirror2"} {
+		frames := svc.Join(id, model.DefaultTunnel, model.TunnelHTTP, AsMirror())
+		go func() {
+			for range frames {
+			}
+		}()
+		t.Cleanup(func() { svc.Leave(id) })
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream := gt.R1(svc.EmitAndWait(ctx, model.DefaultTunnel, &model.Request{ID: "req"}, bytes.NewReader([]byte("hello")))).NoError(t)
+	gt.V(t, string(gt.R1(io.ReadAll(stream)).NoError(t))).Equal("hello")
+	stream.Close()
+
+	// The stream is released after the timeout of mirrors
+	released := func() bool {
+		svc.streamsMutex.Lock()
+		defer svc.streamsMutex.Unlock()
+		return len(svc.streams) == 0
+	}
+	for i := 0; i < 100 && !released(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	gt.True(t, released())
+	gt.V(t, svc.InFlight("mirror1")).Equal(int64(0))
+	gt.V(t, svc.InFlight("mirror2")).Equal(int64(0))
+}
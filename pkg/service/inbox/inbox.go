@@ -0,0 +1,478 @@
+package inbox
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/goerr/v2"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// DefaultRetention is a default duration to keep entries after they are received.
+	DefaultRetention = 7 * 24 * time.Hour
+	// DefaultMaxEntries is a default max number of entries in the inbox.
+	DefaultMaxEntries = 10000
+	// DefaultMaxBodySize is a default max size of a request body to be stored.
+	DefaultMaxBodySize = 10 * 1024 * 1024
+)
+
+var (
+	// ErrFull is returned by Put when the inbox has max entries and all of them are pending.
+	ErrFull = errors.New("inbox is full")
+	// ErrTooLarge is returned by Put when the request body exceeds the max body size.
+	ErrTooLarge = errors.New("request body is too large for inbox")
+	// ErrNotFound is returned when the entry does not exist or has been purged.
+	ErrNotFound = errors.New("inbox entry not found")
+)
+
+var (
+	// bucketEntries has Entry in JSON by sequence number
+	bucketEntries = []byte("entries")
+	// bucketBodies has request bodies of pending entries by sequence number
+	bucketBodies = []byte("bodies")
+	// bucketIDs has sequence numbers by entry ID
+	bucketIDs = []byte("ids")
+	// bucketPending has a nested bucket per tunnel with sequence numbers of pending entries, so that the oldest one of the tunnel is found by the first key
+	bucketPending = []byte("pending")
+	// bucketMeta has counters updated in the same transaction as entries, so that they are read without walking buckets
+	bucketMeta = []byte("meta")
+
+	// keyCount is a key of the number of entries in bucketMeta
+	keyCount = []byte("count")
+)
+
+// Status is a delivery status of an entry.
+type Status string
+
+const (
+	// StatusPending means the request has not been delivered to a client yet.
+	StatusPending Status = "pending"
+	// StatusDelivered means a client returned a response of the request.
+	StatusDelivered Status = "delivered"
+)
+
+// Entry is a request stored in the inbox while no client of the tunnel was connected.
+type Entry struct {
+	ID         string         `json:"id"`
+	Seq        uint64         `json:"seq"`
+	Tunnel     string         `json:"tunnel"`
+	Request    *model.Request `json:"request"`
+	Status     Status         `json:"status"`
+	ReceivedAt time.Time      `json:"received_at"`
+	// Attempts is a number of failed deliveries before the last one
+	Attempts int `json:"attempts"`
+	// LastError is an error of the last failed delivery
+	LastError   string    `json:"last_error,omitempty"`
+	Code        int       `json:"code,omitempty"`
+	DeliveredAt time.Time `json:"delivered_at,omitzero"`
+}
+
+// Inbox is a durable store of requests with bbolt. Requests are kept in the received order, and pending ones of each tunnel are taken from the oldest by Next.
+type Inbox struct {
+	db          *bolt.DB
+	retention   time.Duration
+	maxEntries  int
+	maxBodySize int64
+}
+
+// Option is an option of Open.
+type Option func(*Inbox)
+
+// WithRetention sets a duration to keep entries after they are received. Entries older than it are removed by Purge even if they are pending.
+func WithRetention(d time.Duration) Option {
+	return func(x *Inbox) {
+		x.retention = d
+	}
+}
+
+// WithMaxEntries sets a max number of entries. The oldest delivered entries are removed to store a new one, and Put returns ErrFull if all entries are pending.
+func WithMaxEntries(n int) Option {
+	return func(x *Inbox) {
+		x.maxEntries = n
+	}
+}
+
+// WithMaxBodySize sets a max size of a request body to be stored.
+func WithMaxBodySize(size int64) Option {
+	return func(x *Inbox) {
+		x.maxBodySize = size
+	}
+}
+
+// Open opens the inbox in the bbolt database file at path. The file is created if it does not exist, and it's locked until Close is called.
+func Open(path string, opts ...Option) (*Inbox, error) {
+	x := &Inbox{
+		retention:   DefaultRetention,
+		maxEntries:  DefaultMaxEntries,
+		maxBodySize: DefaultMaxBodySize,
+	}
+	for _, opt := range opts {
+		opt(x)
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, goerr.Wrap(err, "failed to open inbox database", goerr.V("path", path))
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketEntries, bucketBodies, bucketIDs, bucketPending, bucketMeta} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return goerr.Wrap(err, "failed to create bucket", goerr.V("bucket", string(name)))
+			}
+		}
+		// A database without the counter is counted only once
+		if tx.Bucket(bucketMeta).Get(keyCount) == nil {
+			return setCount(tx, tx.Bucket(bucketEntries).Stats().KeyN)
+		}
+		return nil
+	}); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	x.db = db
+	return x, nil
+}
+
+// Close closes the database.
+func (x *Inbox) Close() error {
+	if err := x.db.Close(); err != nil {
+		return goerr.Wrap(err, "failed to close inbox database")
+	}
+	return nil
+}
+
+// MaxBodySize returns the max size of a request body to be stored.
+func (x *Inbox) MaxBodySize() int64 {
+	return x.maxBodySize
+}
+
+// Put stores the request and body of the tunnel as a pending entry.
+func (x *Inbox) Put(tunnel string, req *model.Request, body []byte) (*Entry, error) {
+	if int64(len(body)) > x.maxBodySize {
+		return nil, goerr.Wrap(ErrTooLarge, "failed to store request", goerr.V("size", len(body)), goerr.V("max", x.maxBodySize))
+	}
+
+	stored := *req
+	stored.ContentLength = int64(len(body))
+	entry := &Entry{
+		ID:         req.ID,
+		Tunnel:     tunnel,
+		Request:    &stored,
+		Status:     StatusPending,
+		ReceivedAt: time.Now(),
+	}
+
+	if err := x.db.Update(func(tx *bolt.Tx) error {
+		if n := count(tx); x.maxEntries > 0 && n >= x.maxEntries {
+			if err := removeDelivered(tx, n-x.maxEntries+1); err != nil {
+				return err
+			}
+		}
+
+		seq, err := tx.Bucket(bucketEntries).NextSequence()
+		if err != nil {
+			return goerr.Wrap(err, "failed to get sequence of inbox")
+		}
+		entry.Seq = seq
+
+		key := seqKey(seq)
+		if err := putEntry(tx, entry); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketBodies).Put(key, body); err != nil {
+			return goerr.Wrap(err, "failed to put request body")
+		}
+		if err := tx.Bucket(bucketIDs).Put([]byte(entry.ID), key); err != nil {
+			return goerr.Wrap(err, "failed to put entry ID")
+		}
+		pending, err := tx.Bucket(bucketPending).CreateBucketIfNotExists([]byte(tunnel))
+		if err != nil {
+			return goerr.Wrap(err, "failed to create pending bucket", goerr.V("tunnel", tunnel))
+		}
+		if err := pending.Put(key, nil); err != nil {
+			return goerr.Wrap(err, "failed to put pending entry")
+		}
+		return setCount(tx, count(tx)+1)
+	}); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// removeDelivered removes up to n delivered entries from the oldest. It returns ErrFull if not enough entries are removed.
+func removeDelivered(tx *bolt.Tx, n int) error {
+	var keys [][]byte
+	c := tx.Bucket(bucketEntries).Cursor()
+	for k, v := c.First(); k != nil && len(keys) < n; k, v = c.Next() {
+		var entry Entry
+		if err := json.Unmarshal(v, &entry); err != nil {
+			return goerr.Wrap(err, "failed to unmarshal inbox entry", goerr.V("seq", binary.BigEndian.Uint64(k)))
+		}
+		if entry.Status == StatusDelivered {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) < n {
+		return ErrFull
+	}
+
+	for _, k := range keys {
+		if err := deleteEntry(tx, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pending returns true if the tunnel has pending entries.
+func (x *Inbox) Pending(tunnel string) (bool, error) {
+	var found bool
+	if err := x.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucketPending).Bucket([]byte(tunnel)); b != nil {
+			k, _ := b.Cursor().First()
+			found = k != nil
+		}
+		return nil
+	}); err != nil {
+		return false, goerr.Wrap(err, "failed to check pending entries", goerr.V("tunnel", tunnel))
+	}
+	return found, nil
+}
+
+// Tunnels returns tunnels that have pending entries.
+func (x *Inbox) Tunnels() ([]string, error) {
+	var tunnels []string
+	if err := x.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketPending).ForEachBucket(func(name []byte) error {
+			if k, _ := tx.Bucket(bucketPending).Bucket(name).Cursor().First(); k != nil {
+				tunnels = append(tunnels, string(name))
+			}
+			return nil
+		})
+	}); err != nil {
+		return nil, goerr.Wrap(err, "failed to list tunnels of inbox")
+	}
+	return tunnels, nil
+}
+
+// Next returns the oldest pending entry of the tunnel and its request body. It returns nil if the tunnel has no pending entry.
+func (x *Inbox) Next(tunnel string) (*Entry, []byte, error) {
+	var entry *Entry
+	var body []byte
+	if err := x.db.View(func(tx *bolt.Tx) error {
+		pending := tx.Bucket(bucketPending).Bucket([]byte(tunnel))
+		if pending == nil {
+			return nil
+		}
+		key, _ := pending.Cursor().First()
+		if key == nil {
+			return nil
+		}
+
+		var err error
+		if entry, err = getEntry(tx, key); err != nil {
+			return err
+		}
+		// The value is valid only in the transaction
+		body = append([]byte{}, tx.Bucket(bucketBodies).Get(key)...)
+		return nil
+	}); err != nil {
+		return nil, nil, goerr.Wrap(err, "failed to get next entry", goerr.V("tunnel", tunnel))
+	}
+	return entry, body, nil
+}
+
+// Delivered marks the entry as delivered with the response code from the client. The request body is removed because it's no longer needed.
+func (x *Inbox) Delivered(id string, code int) error {
+	return x.update(id, func(tx *bolt.Tx, key []byte, entry *Entry) error {
+		entry.Status = StatusDelivered
+		entry.Code = code
+		entry.DeliveredAt = time.Now()
+
+		if err := tx.Bucket(bucketBodies).Delete(key); err != nil {
+			return goerr.Wrap(err, "failed to delete request body")
+		}
+		if pending := tx.Bucket(bucketPending).Bucket([]byte(entry.Tunnel)); pending != nil {
+			if err := pending.Delete(key); err != nil {
+				return goerr.Wrap(err, "failed to delete pending entry")
+			}
+		}
+		return nil
+	})
+}
+
+// Failed records a failure of delivery. The entry stays pending to be delivered again.
+func (x *Inbox) Failed(id string, cause error) error {
+	return x.update(id, func(tx *bolt.Tx, key []byte, entry *Entry) error {
+		entry.Attempts++
+		entry.LastError = cause.Error()
+		return nil
+	})
+}
+
+func (x *Inbox) update(id string, f func(tx *bolt.Tx, key []byte, entry *Entry) error) error {
+	if err := x.db.Update(func(tx *bolt.Tx) error {
+		key := tx.Bucket(bucketIDs).Get([]byte(id))
+		if key == nil {
+			return ErrNotFound
+		}
+		entry, err := getEntry(tx, key)
+		if err != nil {
+			return err
+		}
+		if err := f(tx, key, entry); err != nil {
+			return err
+		}
+		return putEntry(tx, entry)
+	}); err != nil {
+		return goerr.Wrap(err, "failed to update inbox entry", goerr.V("id", id))
+	}
+	return nil
+}
+
+// Get returns the entry of the ID.
+func (x *Inbox) Get(id string) (*Entry, error) {
+	var entry *Entry
+	if err := x.db.View(func(tx *bolt.Tx) error {
+		key := tx.Bucket(bucketIDs).Get([]byte(id))
+		if key == nil {
+			return ErrNotFound
+		}
+		var err error
+		entry, err = getEntry(tx, key)
+		return err
+	}); err != nil {
+		return nil, goerr.Wrap(err, "failed to get inbox entry", goerr.V("id", id))
+	}
+	return entry, nil
+}
+
+// List returns entries of the tunnel in the received order. All entries are returned if tunnel is empty.
+func (x *Inbox) List(tunnel string) ([]*Entry, error) {
+	entries := []*Entry{}
+	if err := x.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketEntries).ForEach(func(k, v []byte) error {
+			var entry Entry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return goerr.Wrap(err, "failed to unmarshal inbox entry", goerr.V("seq", binary.BigEndian.Uint64(k)))
+			}
+			if tunnel == "" || entry.Tunnel == tunnel {
+				entries = append(entries, &entry)
+			}
+			return nil
+		})
+	}); err != nil {
+		return nil, goerr.Wrap(err, "failed to list inbox entries", goerr.V("tunnel", tunnel))
+	}
+	return entries, nil
+}
+
+// Purge removes entries received before the retention from now, and returns them. Pending entries in them are never delivered.
+func (x *Inbox) Purge(now time.Time) ([]*Entry, error) {
+	if x.retention <= 0 {
+		return nil, nil
+	}
+	deadline := now.Add(-x.retention)
+
+	var purged []*Entry
+	if err := x.db.Update(func(tx *bolt.Tx) error {
+		var keys [][]byte
+		c := tx.Bucket(bucketEntries).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var entry Entry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return goerr.Wrap(err, "failed to unmarshal inbox entry", goerr.V("seq", binary.BigEndian.Uint64(k)))
+			}
+			// Entries are in the received order, so the rest are newer
+			if !entry.ReceivedAt.Before(deadline) {
+				break
+			}
+			keys = append(keys, k)
+			purged = append(purged, &entry)
+		}
+
+		for _, k := range keys {
+			if err := deleteEntry(tx, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, goerr.Wrap(err, "failed to purge inbox entries")
+	}
+	return purged, nil
+}
+
+// count returns the number of entries.
+func count(tx *bolt.Tx) int {
+	v := tx.Bucket(bucketMeta).Get(keyCount)
+	if len(v) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(v))
+}
+
+func setCount(tx *bolt.Tx, n int) error {
+	if err := tx.Bucket(bucketMeta).Put(keyCount, binary.BigEndian.AppendUint64(nil, uint64(max(n, 0)))); err != nil {
+		return goerr.Wrap(err, "failed to put number of inbox entries")
+	}
+	return nil
+}
+
+func seqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+func getEntry(tx *bolt.Tx, key []byte) (*Entry, error) {
+	raw := tx.Bucket(bucketEntries).Get(key)
+	if raw == nil {
+		return nil, ErrNotFound
+	}
+	var entry Entry
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return nil, goerr.Wrap(err, "failed to unmarshal inbox entry", goerr.V("seq", binary.BigEndian.Uint64(key)))
+	}
+	return &entry, nil
+}
+
+func putEntry(tx *bolt.Tx, entry *Entry) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return goerr.Wrap(err, "failed to marshal inbox entry", goerr.V("id", entry.ID))
+	}
+	if err := tx.Bucket(bucketEntries).Put(seqKey(entry.Seq), raw); err != nil {
+		return goerr.Wrap(err, "failed to put inbox entry", goerr.V("id", entry.ID))
+	}
+	return nil
+}
+
+// deleteEntry removes the entry of key from all buckets.
+func deleteEntry(tx *bolt.Tx, key []byte) error {
+	entry, err := getEntry(tx, key)
+	if err != nil {
+		return err
+	}
+	if pending := tx.Bucket(bucketPending).Bucket([]byte(entry.Tunnel)); pending != nil {
+		if err := pending.Delete(key); err != nil {
+			return goerr.Wrap(err, "failed to delete pending entry")
+		}
+	}
+	for _, b := range [][]byte{bucketEntries, bucketBodies} {
+		if err := tx.Bucket(b).Delete(key); err != nil {
+			return goerr.Wrap(err, "failed to delete inbox entry", goerr.V("bucket", string(b)))
+		}
+	}
+	if err := tx.Bucket(bucketIDs).Delete([]byte(entry.ID)); err != nil {
+		return goerr.Wrap(err, "failed to delete entry ID")
+	}
+	return setCount(tx, count(tx)-1)
+}
@@ -0,0 +1,111 @@
+package inbox_test
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/service/inbox"
+	"github.com/m-mizutani/gt"
+)
+
+func newRequest(id string) *model.Request {
+	return &model.Request{
+		ID:     id,
+		Method: http.MethodPost,
+		Path:   "/hook",
+		Header: http.Header{"X-Event": {"push"}},
+	}
+}
+
+func TestInbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inbox.db")
+	box := gt.R1(inbox.Open(path)).NoError(t)
+
+	gt.R1(box.Put("alice", newRequest("a1"), []byte("first"))).NoError(t)
+	gt.R1(box.Put("bob", newRequest("b1"), []byte("other"))).NoError(t)
+	gt.R1(box.Put("alice", newRequest("a2"), []byte("second"))).NoError(t)
+	gt.True(t, gt.R1(box.Pending("alice")).NoError(t))
+	gt.A(t, gt.R1(box.Tunnels()).NoError(t)).Length(2)
+
+	// Entries survive reopen
+	gt.NoError(t, box.Close())
+	box = gt.R1(inbox.Open(path)).NoError(t)
+	t.Cleanup(func() { _ = box.Close() })
+
+	entry, body := gt.R2(box.Next("alice")).NoError(t)
+	gt.V(t, entry.ID).Equal("a1")
+	gt.V(t, string(body)).Equal("first")
+	gt.V(t, entry.Request.ContentLength).Equal(int64(5))
+	gt.V(t, entry.Request.Header.Get("X-Event")).Equal("push")
+
+	gt.NoError(t, box.Failed("a1", errors.New("connection lost")))
+	entry = gt.R1(box.Get("a1")).NoError(t)
+	gt.V(t, entry.Status).Equal(inbox.StatusPending)
+	gt.V(t, entry.Attempts).Equal(1)
+	gt.V(t, entry.LastError).Equal("connection lost")
+
+	gt.NoError(t, box.Delivered("a1", http.StatusOK))
+	entry, body = gt.R2(box.Next("alice")).NoError(t)
+	gt.V(t, entry.ID).Equal("a2")
+	gt.V(t, string(body)).Equal("second")
+
+	gt.NoError(t, box.Delivered("a2", http.StatusNoContent))
+	entry, _ = gt.R2(box.Next("alice")).NoError(t)
+	gt.Nil(t, entry)
+	gt.False(t, gt.R1(box.Pending("alice")).NoError(t))
+	gt.A(t, gt.R1(box.Tunnels()).NoError(t)).Equal([]string{"bob"})
+
+	entries := gt.R1(box.List("alice")).NoError(t)
+	gt.A(t, entries).Length(2)
+	gt.V(t, entries[0].Status).Equal(inbox.StatusDelivered)
+	gt.V(t, entries[0].Code).Equal(http.StatusOK)
+	gt.V(t, entries[1].Code).Equal(http.StatusNoContent)
+
+	_, err := box.Get("unknown")
+	gt.True(t, errors.Is(err, inbox.ErrNotFound))
+}
+
+func TestInbox_Limits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inbox.db")
+	open := func() *inbox.Inbox {
+		return gt.R1(inbox.Open(path,
+			inbox.WithMaxEntries(2),
+			inbox.WithMaxBodySize(8),
+			inbox.WithRetention(time.Hour),
+		)).NoError(t)
+	}
+	box := open()
+
+	_, err := box.Put("alice", newRequest("large"), []byte("too large body"))
+	gt.True(t, errors.Is(err, inbox.ErrTooLarge))
+
+	gt.R1(box.Put("alice", newRequest("1"), nil)).NoError(t)
+	gt.R1(box.Put("alice", newRequest("2"), nil)).NoError(t)
+	_, err = box.Put("alice", newRequest("3"), nil)
+	gt.True(t, errors.Is(err, inbox.ErrFull))
+
+	// The number of entries survives reopen
+	gt.NoError(t, box.Close())
+	box = open()
+	t.Cleanup(func() { _ = box.Close() })
+	_, err = box.Put("alice", newRequest("3"), nil)
+	gt.True(t, errors.Is(err, inbox.ErrFull))
+
+	// The oldest delivered entry is removed for a new one
+	gt.NoError(t, box.Delivered("1", http.StatusOK))
+	gt.R1(box.Put("alice", newRequest("3"), nil)).NoError(t)
+	_, err = box.Get("1")
+	gt.True(t, errors.Is(err, inbox.ErrNotFound))
+
+	// Entries over the retention are purged even if they are pending
+	purged := gt.R1(box.Purge(time.Now())).NoError(t)
+	gt.A(t, purged).Length(0)
+	purged = gt.R1(box.Purge(time.Now().Add(2 * time.Hour))).NoError(t)
+	gt.A(t, purged).Length(2)
+	gt.False(t, gt.R1(box.Pending("alice")).NoError(t))
+	gt.A(t, gt.R1(box.List("")).NoError(t)).Length(0)
+}
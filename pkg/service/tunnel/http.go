@@ -2,15 +2,20 @@ package tunnel
 
 import (
 	"context"
+	"io"
 	"net/http"
+	"strings"
 
 	"github.com/m-mizutani/backstream/pkg/interfaces"
 	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/goerr/v2"
 )
 
 type Service struct {
-	dst        string
-	httpClient interfaces.HTTPClient
+	dst          string
+	rules        []Rule
+	httpClient   interfaces.HTTPClient
+	preserveHost bool
 }
 
 type Option func(*Service)
@@ -21,6 +26,14 @@ func WithHTTPClient(httpClient interfaces.HTTPClient) Option {
 	}
 }
 
+// WithPreserveHost sends the Host header of the original request to the local application instead of the host of the destination URL.
+func WithPreserveHost() Option {
+	return func(x *Service) {
+		x.preserveHost = true
+	}
+}
+
+// New creates a tunnel service to dst. dst is a URL of the local application, or "tcp://host:port" and "udp://host:port" for a raw TCP and UDP destination. dst can be empty if HTTP requests are sent by WithRules only.
 func New(dst string, opts ...Option) *Service {
 	x := &Service{
 		dst:        dst,
@@ -34,16 +47,37 @@ func New(dst string, opts ...Option) *Service {
 	return x
 }
 
-func (x *Service) ToLocal(ctx context.Context, req *model.Request) (*model.Response, error) {
-	httpReq, err := req.NewHTTPRequest(ctx, x.dst)
+// Mode returns the tunnel mode determined by the scheme of the destination.
+func (x *Service) Mode() model.TunnelMode {
+	switch {
+	case strings.HasPrefix(x.dst, "tcp://"):
+		return model.TunnelTCP
+	case strings.HasPrefix(x.dst, "udp://"):
+		return model.TunnelUDP
+	default:
+		return model.TunnelHTTP
+	}
+}
+
+// ToLocal sends the request to the local application with body and returns the response. The caller must close the response body.
+func (x *Service) ToLocal(ctx context.Context, req *model.Request, body io.Reader) (*http.Response, error) {
+	dst, req, err := x.destination(req)
 	if err != nil {
 		return nil, err
 	}
 
-	httpResp, err := x.httpClient.Do(httpReq)
+	httpReq, err := req.NewHTTPRequest(ctx, dst, body)
 	if err != nil {
 		return nil, err
 	}
+	if x.preserveHost && req.Host != "" {
+		httpReq.Host = req.Host
+	}
+
+	httpResp, err := x.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, goerr.Wrap(err, "failed to send request to local", goerr.V("dst", dst))
+	}
 
-	return req.NewResponse(httpResp)
+	return httpResp, nil
 }
@@ -0,0 +1,122 @@
+package tunnel
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/utils/urlutil"
+	"github.com/m-mizutani/goerr/v2"
+)
+
+// ErrNoDestination is returned when a request matches no rule and the service has no default destination.
+var ErrNoDestination = errors.New("no destination for request")
+
+// Rule is a rule to select the local destination of a request. All of set conditions must match, and a rule without conditions matches any request.
+type Rule struct {
+	// Dst is a URL of the local application.
+	Dst string
+
+	// PathPrefix matches the request path at a segment boundary, e.g. "/api" matches "/api" and "/api/users" but not "/apis".
+	PathPrefix string
+	// Host matches the host name of the original request without port.
+	Host string
+	// Method matches the request method.
+	Method string
+	// Strip removes PathPrefix from the request path before forwarding.
+	Strip bool
+}
+
+func (x Rule) match(req *model.Request) bool {
+	if x.PathPrefix != "" && !urlutil.MatchPrefix(req.Path, x.PathPrefix) {
+		return false
+	}
+	if x.Host != "" && !strings.EqualFold(urlutil.StripPort(req.Host), x.Host) {
+		return false
+	}
+	if x.Method != "" && !strings.EqualFold(req.Method, x.Method) {
+		return false
+	}
+	return true
+}
+
+// ParseRule parses a rule in "<condition>[,<condition>...]=<url>" format. condition is one of "path:<prefix>", "host:<name>", "method:<method>" and "strip" that removes the path prefix before forwarding. e.g. "path:/api,strip=http://localhost:8080", "host:auth.example.com=http://localhost:9000".
+func ParseRule(v string) (Rule, error) {
+	conditions, dst, found := strings.Cut(v, "=")
+	if !found {
+		return Rule{}, goerr.New("rule must be in '<condition>[,<condition>...]=<url>' format", goerr.V("rule", v))
+	}
+
+	dstURL, err := url.Parse(dst)
+	if err != nil {
+		return Rule{}, goerr.Wrap(err, "invalid destination URL of rule", goerr.V("rule", v))
+	}
+	if dstURL.Scheme != "http" && dstURL.Scheme != "https" {
+		return Rule{}, goerr.New("destination of rule must be HTTP or HTTPS URL", goerr.V("rule", v))
+	}
+
+	rule := Rule{Dst: dst}
+	for _, cond := range strings.Split(conditions, ",") {
+		cond = strings.TrimSpace(cond)
+		if cond == "strip" {
+			rule.Strip = true
+			continue
+		}
+
+		kind, pattern, _ := strings.Cut(cond, ":")
+		if pattern == "" {
+			return Rule{}, goerr.New("rule condition is empty", goerr.V("rule", v), goerr.V("condition", cond))
+		}
+		switch kind {
+		case "path":
+			if !strings.HasPrefix(pattern, "/") {
+				return Rule{}, goerr.New("path prefix must start with '/'", goerr.V("rule", v))
+			}
+			if pattern != "/" {
+				pattern = strings.TrimSuffix(pattern, "/")
+			}
+			rule.PathPrefix = pattern
+		case "host":
+			rule.Host = pattern
+		case "method":
+			rule.Method = strings.ToUpper(pattern)
+		default:
+			return Rule{}, goerr.New("unsupported rule condition", goerr.V("rule", v), goerr.V("condition", cond))
+		}
+	}
+
+	if rule.Strip && rule.PathPrefix == "" {
+		return Rule{}, goerr.New("strip requires path condition", goerr.V("rule", v))
+	}
+
+	return rule, nil
+}
+
+// WithRules sets rules to select the local destination of HTTP requests. Rules are evaluated in order and the first matched rule is used. Requests that match no rule are sent to the destination given to New.
+func WithRules(rules ...Rule) Option {
+	return func(x *Service) {
+		x.rules = append(x.rules, rules...)
+	}
+}
+
+// destination returns the URL of the local application for req and the request to be sent to it. req is not modified.
+func (x *Service) destination(req *model.Request) (string, *model.Request, error) {
+	for _, rule := range x.rules {
+		if !rule.match(req) {
+			continue
+		}
+		if rule.Strip {
+			stripped := *req
+			stripped.Header = req.Header.Clone()
+			stripped.StripPrefix(rule.PathPrefix)
+			return rule.Dst, &stripped, nil
+		}
+		return rule.Dst, req, nil
+	}
+
+	if x.dst == "" {
+		return "", nil, goerr.Wrap(ErrNoDestination, "request matches no rule", goerr.V("path", req.Path), goerr.V("host", req.Host), goerr.V("method", req.Method))
+	}
+	return x.dst, req, nil
+}
@@ -0,0 +1,43 @@
+package tunnel_test
+
+import (
+	"testing"
+
+	"github.com/m-mizutani/backstream/pkg/service/tunnel"
+	"github.com/m-mizutani/gt"
+)
+
+func TestParseRule(t *testing.T) {
+	testCases := map[string]struct {
+		input  string
+		expect tunnel.Rule
+		isErr  bool
+	}{
+		"path with strip": {
+			input:  "path:/api/,strip=http://localhost:8080",
+			expect: tunnel.Rule{Dst: "http://localhost:8080", PathPrefix: "/api", Strip: true},
+		},
+		"host and method": {
+			input:  "host:auth.example.com,method:post=http://localhost:9000/v1",
+			expect: tunnel.Rule{Dst: "http://localhost:9000/v1", Host: "auth.example.com", Method: "POST"},
+		},
+		"no destination":       {input: "path:/api", isErr: true},
+		"not HTTP destination": {input: "path:/api=tcp://localhost:5432", isErr: true},
+		"relative path":        {input: "path:api=http://localhost:8080", isErr: true},
+		"unsupported kind":     {input: "query:a=http://localhost:8080", isErr: true},
+		"empty pattern":        {input: "host:=http://localhost:8080", isErr: true},
+		"strip without path":   {input: "host:a.example.com,strip=http://localhost:8080", isErr: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rule, err := tunnel.ParseRule(tc.input)
+			if tc.isErr {
+				gt.Error(t, err)
+				return
+			}
+			gt.NoError(t, err)
+			gt.V(t, rule).Equal(tc.expect)
+		})
+	}
+}
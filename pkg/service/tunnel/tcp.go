@@ -0,0 +1,22 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/m-mizutani/goerr/v2"
+)
+
+// DialTCP opens a TCP connection to the local destination of TCP mode.
+func (x *Service) DialTCP(ctx context.Context) (net.Conn, error) {
+	addr := strings.TrimPrefix(x.dst, "tcp://")
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, goerr.Wrap(err, "failed to dial local TCP", goerr.V("addr", addr))
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,22 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/m-mizutani/goerr/v2"
+)
+
+// DialUDP opens a connected UDP socket to the local destination of UDP mode. A socket should be opened for each remote peer so that replies from the destination can be routed back to the peer.
+func (x *Service) DialUDP(ctx context.Context) (net.Conn, error) {
+	addr := strings.TrimPrefix(x.dst, "udp://")
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, goerr.Wrap(err, "failed to dial local UDP", goerr.V("addr", addr))
+	}
+
+	return conn, nil
+}
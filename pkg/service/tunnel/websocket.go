@@ -0,0 +1,61 @@
+package tunnel
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/goerr/v2"
+)
+
+// webSocketHandshakeHeaders are set by websocket.Dialer and must not be copied from the original request.
+var webSocketHandshakeHeaders = []string{
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Extensions",
+	"Sec-Websocket-Protocol",
+}
+
+// DialWebSocket opens a WebSocket connection to the local application for the upgrade request. If the local application rejects the handshake, the HTTP response is returned with an error. The response body of a rejected handshake must be closed by the caller.
+func (x *Service) DialWebSocket(ctx context.Context, req *model.Request) (*websocket.Conn, *http.Response, error) {
+	dst, req, err := x.destination(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	httpReq, err := req.NewHTTPRequest(ctx, dst, http.NoBody)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wsURL := *httpReq.URL
+	switch wsURL.Scheme {
+	case "http":
+		wsURL.Scheme = "ws"
+	case "https":
+		wsURL.Scheme = "wss"
+	}
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 30 * time.Second,
+		Subprotocols:     websocket.Subprotocols(httpReq),
+	}
+
+	header := httpReq.Header.Clone()
+	for _, name := range webSocketHandshakeHeaders {
+		header.Del(name)
+	}
+	if x.preserveHost && req.Host != "" {
+		header.Set("Host", req.Host)
+	}
+
+	conn, resp, err := dialer.DialContext(ctx, wsURL.String(), header)
+	if err != nil {
+		return nil, resp, goerr.Wrap(err, "failed to dial local WebSocket", goerr.V("url", wsURL.String()))
+	}
+
+	return conn, resp, nil
+}
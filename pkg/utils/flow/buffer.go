@@ -0,0 +1,137 @@
+package flow
+
+import (
+	"io"
+	"sync"
+)
+
+// Chunk is a piece of data in a stream. Type and More keep boundaries of messages, e.g. WebSocket messages, and they are ignored when the stream is read as a byte stream.
+type Chunk struct {
+	// Type is a type of message that the chunk belongs to.
+	Type int
+	Data []byte
+	// More indicates that following chunks belong to the same message.
+	More bool
+}
+
+// Buffer is a receive buffer of a stream. Chunks are pushed by a frame reader and consumed by Read or ReadChunk. The size of buffered data is bounded by the sender's Window, so Push never blocks.
+type Buffer struct {
+	mutex  sync.Mutex
+	chunks []Chunk
+	err    error
+	notify chan struct{}
+
+	// onRead is called with the size of consumed data to acknowledge it to the sender.
+	onRead func(n int)
+}
+
+func NewBuffer(onRead func(n int)) *Buffer {
+	return &Buffer{
+		notify: make(chan struct{}, 1),
+		onRead: onRead,
+	}
+}
+
+// Push appends a chunk to the buffer. It's ignored after the buffer is closed.
+func (x *Buffer) Push(chunk Chunk) {
+	x.mutex.Lock()
+	if x.err == nil {
+		x.chunks = append(x.chunks, chunk)
+	}
+	x.mutex.Unlock()
+	x.signal()
+}
+
+// Close closes the buffer. Read returns remaining data and then err, or io.EOF if err is nil. Only the first call takes effect.
+func (x *Buffer) Close(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+
+	x.mutex.Lock()
+	if x.err == nil {
+		x.err = err
+	}
+	x.mutex.Unlock()
+	x.signal()
+}
+
+// Read reads buffered data as a byte stream. It blocks until data is pushed or the buffer is closed.
+func (x *Buffer) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for {
+		x.mutex.Lock()
+		for len(x.chunks) > 0 && len(x.chunks[0].Data) == 0 {
+			x.chunks = x.chunks[1:]
+		}
+
+		if len(x.chunks) > 0 {
+			n := copy(p, x.chunks[0].Data)
+			if n < len(x.chunks[0].Data) {
+				x.chunks[0].Data = x.chunks[0].Data[n:]
+			} else {
+				x.chunks[0] = Chunk{}
+				x.chunks = x.chunks[1:]
+			}
+			x.mutex.Unlock()
+
+			x.consumed(n)
+			return n, nil
+		}
+
+		if err := x.closed(); err != nil {
+			return 0, err
+		}
+
+		<-x.notify
+	}
+}
+
+// ReadChunk reads a whole chunk as it was pushed. It blocks until a chunk is pushed or the buffer is closed.
+func (x *Buffer) ReadChunk() (Chunk, error) {
+	for {
+		x.mutex.Lock()
+		if len(x.chunks) > 0 {
+			chunk := x.chunks[0]
+			x.chunks[0] = Chunk{}
+			x.chunks = x.chunks[1:]
+			x.mutex.Unlock()
+
+			x.consumed(len(chunk.Data))
+			return chunk, nil
+		}
+
+		if err := x.closed(); err != nil {
+			return Chunk{}, err
+		}
+
+		<-x.notify
+	}
+}
+
+// closed returns the close error and unlocks mutex. It must be called with mutex locked.
+func (x *Buffer) closed() error {
+	err := x.err
+	x.mutex.Unlock()
+	if err != nil {
+		x.signal()
+	}
+	return err
+}
+
+func (x *Buffer) consumed(n int) {
+	x.signal()
+	if x.onRead != nil && n > 0 {
+		x.onRead(n)
+	}
+}
+
+func (x *Buffer) signal() {
+	select {
+	case x.notify <- struct{}{}:
+	default:
+	}
+}
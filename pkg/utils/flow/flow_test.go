@@ -0,0 +1,100 @@
+package flow_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/backstream/pkg/utils/flow"
+	"github.com/m-mizutani/gt"
+)
+
+func TestWindow(t *testing.T) {
+	ctx := context.Background()
+	w := flow.NewWindow(10)
+
+	gt.V(t, gt.R1(w.Acquire(ctx, 4)).NoError(t)).Equal(4)
+	gt.V(t, gt.R1(w.Acquire(ctx, 100)).NoError(t)).Equal(6)
+
+	// Window is exhausted
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err := w.Acquire(timeoutCtx, 1)
+	gt.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	// Released window wakes up a waiter
+	acquired := make(chan int)
+	go func() {
+		n, _ := w.Acquire(ctx, 8)
+		acquired <- n
+	}()
+	w.Release(5)
+	gt.V(t, <-acquired).Equal(5)
+
+	w.Close()
+	_, err = w.Acquire(ctx, 1)
+	gt.True(t, errors.Is(err, flow.ErrClosed))
+}
+
+func TestBuffer(t *testing.T) {
+	var acked int
+	b := flow.NewBuffer(func(n int) { acked += n })
+
+	b.Push(flow.Chunk{Data: []byte("hello, ")})
+	b.Push(flow.Chunk{Data: []byte("world")})
+	b.Close(nil)
+	b.Push(flow.Chunk{Data: []byte("ignored")})
+
+	data := gt.R1(io.ReadAll(b)).NoError(t)
+	gt.V(t, string(data)).Equal("hello, world")
+	gt.V(t, acked).Equal(12)
+
+	errAbort := errors.New("abort")
+	b = flow.NewBuffer(nil)
+	go func() {
+		b.Push(flow.Chunk{Data: []byte("abc")})
+		b.Close(errAbort)
+	}()
+	data, err := io.ReadAll(b)
+	gt.V(t, string(data)).Equal("abc")
+	gt.True(t, errors.Is(err, errAbort))
+}
+
+func TestBufferReadChunk(t *testing.T) {
+	b := flow.NewBuffer(nil)
+	b.Push(flow.Chunk{Type: 1, Data: []byte("a"), More: true})
+	b.Push(flow.Chunk{Type: 1})
+	b.Close(nil)
+
+	c := gt.R1(b.ReadChunk()).NoError(t)
+	gt.V(t, c).Equal(flow.Chunk{Type: 1, Data: []byte("a"), More: true})
+	c = gt.R1(b.ReadChunk()).NoError(t)
+	gt.V(t, c).Equal(flow.Chunk{Type: 1})
+
+	_, err := b.ReadChunk()
+	gt.True(t, errors.Is(err, io.EOF))
+}
+
+func TestWindowSend(t *testing.T) {
+	w := flow.NewWindow(4)
+	var sent []flow.Chunk
+	send := func(c flow.Chunk) error {
+		sent = append(sent, c)
+		w.Release(len(c.Data))
+		return nil
+	}
+
+	gt.NoError(t, w.Send(context.Background(), flow.Chunk{Type: 2, Data: []byte("0123456789")}, send))
+	gt.A(t, sent).Equal([]flow.Chunk{
+		{Type: 2, Data: []byte("0123"), More: true},
+		{Type: 2, Data: []byte("4567"), More: true},
+		{Type: 2, Data: []byte("89")},
+	})
+
+	// Empty chunk is sent as is
+	sent = nil
+	gt.NoError(t, w.Send(context.Background(), flow.Chunk{Type: 1}, send))
+	gt.A(t, sent).Equal([]flow.Chunk{{Type: 1}})
+}
@@ -0,0 +1,100 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrClosed = errors.New("flow closed")
+
+// Window is a send window of flow control. A sender acquires the window before sending data, and the window is replenished when the receiver acknowledges consumption of the data.
+type Window struct {
+	mutex  sync.Mutex
+	size   int
+	closed bool
+	notify chan struct{}
+}
+
+func NewWindow(size int) *Window {
+	return &Window{
+		size:   size,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// Acquire waits until the window is available and consumes up to n bytes of it. It returns the acquired size.
+func (x *Window) Acquire(ctx context.Context, n int) (int, error) {
+	for {
+		x.mutex.Lock()
+		if x.closed {
+			x.mutex.Unlock()
+			x.signal()
+			return 0, ErrClosed
+		}
+
+		if x.size > 0 {
+			n = min(n, x.size)
+			x.size -= n
+			remain := x.size
+			x.mutex.Unlock()
+
+			if remain > 0 {
+				x.signal()
+			}
+			return n, nil
+		}
+		x.mutex.Unlock()
+
+		select {
+		case <-x.notify:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// Send sends chunk by send function, splitting Data into pieces that fit in the acquired window. All pieces except the last one have More set. An empty chunk is sent as is without acquiring the window.
+func (x *Window) Send(ctx context.Context, chunk Chunk, send func(Chunk) error) error {
+	data := chunk.Data
+	for first := true; first || len(data) > 0; first = false {
+		piece := data
+		if len(data) > 0 {
+			n, err := x.Acquire(ctx, len(data))
+			if err != nil {
+				return err
+			}
+			piece = data[:n]
+		}
+		data = data[len(piece):]
+
+		if err := send(Chunk{Type: chunk.Type, Data: piece, More: chunk.More || len(data) > 0}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Release returns n bytes to the window.
+func (x *Window) Release(n int) {
+	x.mutex.Lock()
+	x.size += n
+	x.mutex.Unlock()
+	x.signal()
+}
+
+// Close wakes up all waiters of Acquire and makes them fail with ErrClosed.
+func (x *Window) Close() {
+	x.mutex.Lock()
+	x.closed = true
+	x.mutex.Unlock()
+	x.signal()
+}
+
+func (x *Window) signal() {
+	select {
+	case x.notify <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,92 @@
+package keepalive
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DefaultInterval is a default interval of pings. It should be shorter than idle timeouts of proxies, e.g. 60 seconds of nginx.
+	DefaultInterval = 20 * time.Second
+	// DefaultTimeout is a default max duration without any message from the peer.
+	DefaultTimeout = 60 * time.Second
+
+	// pingWriteTimeout is a max duration to write a ping.
+	pingWriteTimeout = 10 * time.Second
+)
+
+// Config is a configuration of keepalive of a WebSocket connection.
+type Config struct {
+	// Interval is a duration between pings. 0 disables keepalive.
+	Interval time.Duration
+	// Timeout is a max duration to wait for any message from the peer including pong, and to write a message to the peer. The connection is regarded as dead after that.
+	Timeout time.Duration
+}
+
+// Default returns Config with DefaultInterval and DefaultTimeout.
+func Default() Config {
+	return Config{Interval: DefaultInterval, Timeout: DefaultTimeout}
+}
+
+// Keeper sends pings to the peer and manages deadlines of the connection. Received must be called after every message is read, and Sending before every message is written.
+type Keeper struct {
+	conn *websocket.Conn
+	cfg  Config
+}
+
+// Start starts sending pings until ctx is done. A read of the connection fails if no message, including pong, arrives within Timeout.
+func Start(ctx context.Context, conn *websocket.Conn, cfg Config) *Keeper {
+	if cfg.Interval <= 0 || cfg.Timeout <= 0 {
+		return &Keeper{}
+	}
+
+	x := &Keeper{conn: conn, cfg: cfg}
+	x.Received()
+	conn.SetPongHandler(func(string) error {
+		x.Received()
+		return nil
+	})
+
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// Errors are detected by the reader of the connection
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingWriteTimeout)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	return x
+}
+
+// Received extends the read deadline. It must be called by the reader goroutine. It does nothing for nil Keeper.
+func (x *Keeper) Received() {
+	if x != nil && x.conn != nil {
+		_ = x.conn.SetReadDeadline(time.Now().Add(x.cfg.Timeout))
+	}
+}
+
+// Sending sets the write deadline not to be blocked by a dead peer forever. It must be called by the writer. It does nothing for nil Keeper.
+func (x *Keeper) Sending() {
+	if x != nil && x.conn != nil {
+		_ = x.conn.SetWriteDeadline(time.Now().Add(x.cfg.Timeout))
+	}
+}
+
+// IsTimeout returns true if err is caused by the deadline set by Keeper, that means the peer is not responding.
+func IsTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
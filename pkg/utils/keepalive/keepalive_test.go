@@ -0,0 +1,80 @@
+package keepalive_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-mizutani/backstream/pkg/utils/keepalive"
+	"github.com/m-mizutani/gt"
+)
+
+// serve starts a WebSocket server with keepalive that reads messages until an error occurs, and returns the error channel and URL.
+func serve(t *testing.T, cfg keepalive.Config) (<-chan error, string) {
+	errCh := make(chan error, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		keeper := keepalive.Start(ctx, conn, cfg)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				errCh <- err
+				return
+			}
+			keeper.Received()
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return errCh, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestKeeper(t *testing.T) {
+	cfg := keepalive.Config{Interval: 20 * time.Millisecond, Timeout: 100 * time.Millisecond}
+
+	t.Run("alive peer answers pings", func(t *testing.T) {
+		errCh, url := serve(t, cfg)
+		conn, _ := gt.R2(websocket.DefaultDialer.Dial(url, nil)).NoError(t)
+		defer conn.Close()
+
+		// Reading makes gorilla reply pongs
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		select {
+		case err := <-errCh:
+			t.Fatalf("connection is closed: %v", err)
+		case <-time.After(5 * cfg.Timeout):
+		}
+	})
+
+	t.Run("dead peer is detected", func(t *testing.T) {
+		errCh, url := serve(t, cfg)
+		conn, _ := gt.R2(websocket.DefaultDialer.Dial(url, nil)).NoError(t)
+		defer conn.Close()
+
+		// The peer never reads, so no pong is returned
+		select {
+		case err := <-errCh:
+			gt.True(t, keepalive.IsTimeout(err))
+		case <-time.After(10 * cfg.Timeout):
+			t.Fatal("dead peer is not detected")
+		}
+	})
+}
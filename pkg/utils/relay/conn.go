@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/utils/flow"
+	"github.com/m-mizutani/goerr/v2"
+)
+
+// Conn relays a raw byte stream between conn and stream in both directions. EOF of one direction is forwarded as half-close, and Conn returns after both directions are closed or either direction fails.
+func Conn(ctx context.Context, conn net.Conn, stream Stream) error {
+	errCh := make(chan error, 2)
+	go func() { errCh <- connToStream(ctx, conn, stream) }()
+	go func() { errCh <- streamToConn(conn, stream) }()
+
+	for range 2 {
+		select {
+		case err := <-errCh:
+			if err != nil {
+				_ = conn.Close()
+				return err
+			}
+		case <-ctx.Done():
+			_ = conn.Close()
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+func connToStream(ctx context.Context, conn net.Conn, stream Stream) error {
+	buf := make([]byte, model.ChunkSize)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if err := stream.Send(ctx, flow.Chunk{Data: bytes.Clone(buf[:n])}); err != nil {
+				return goerr.Wrap(err, "failed to send data")
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return stream.CloseSend(nil)
+		}
+		if err != nil {
+			_ = stream.CloseSend(err)
+			return goerr.Wrap(err, "failed to read connection")
+		}
+	}
+}
+
+func streamToConn(conn net.Conn, stream Stream) error {
+	for {
+		chunk, err := stream.ReadChunk()
+		if errors.Is(err, io.EOF) {
+			return closeWrite(conn)
+		}
+		if err != nil {
+			return goerr.Wrap(err, "failed to read stream")
+		}
+
+		if _, err := conn.Write(chunk.Data); err != nil {
+			return goerr.Wrap(err, "failed to write connection")
+		}
+	}
+}
+
+// closeWrite shuts down the writing side of conn. If conn does not support half-close, it's closed after a grace period for the peer to finish sending.
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return conn.SetReadDeadline(time.Now().Add(closeTimeout))
+}
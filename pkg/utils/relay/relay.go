@@ -0,0 +1,18 @@
+package relay
+
+import (
+	"context"
+	"time"
+
+	"github.com/m-mizutani/backstream/pkg/utils/flow"
+)
+
+// closeTimeout is a max duration to wait for the other direction after one direction is closed.
+const closeTimeout = 5 * time.Second
+
+// Stream is a tunnel side of the relay. Data is carried as chunks, and WebSocket messages keep their boundaries by Chunk.More.
+type Stream interface {
+	ReadChunk() (flow.Chunk, error)
+	Send(ctx context.Context, chunk flow.Chunk) error
+	CloseSend(err error) error
+}
@@ -0,0 +1,116 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-mizutani/backstream/pkg/model"
+	"github.com/m-mizutani/backstream/pkg/utils/flow"
+	"github.com/m-mizutani/goerr/v2"
+)
+
+// WebSocket relays WebSocket messages between conn and stream in both directions. A close message from one side is forwarded to the other side, and WebSocket returns after both directions are closed.
+func WebSocket(ctx context.Context, conn *websocket.Conn, stream Stream) error {
+	errCh := make(chan error, 2)
+	go func() { errCh <- toStream(ctx, conn, stream) }()
+	go func() { errCh <- toConn(conn, stream) }()
+
+	err := <-errCh
+	select {
+	case <-errCh:
+	case <-time.After(closeTimeout):
+	}
+
+	return err
+}
+
+// toStream reads messages from conn and sends them to stream until conn is closed.
+func toStream(ctx context.Context, conn *websocket.Conn, stream Stream) error {
+	buf := make([]byte, model.ChunkSize)
+	for {
+		msgType, r, err := conn.NextReader()
+		if err != nil {
+			if err := stream.CloseSend(err); err != nil {
+				return goerr.Wrap(err, "failed to send close")
+			}
+			return normalClose(err)
+		}
+
+		for {
+			n, err := io.ReadFull(r, buf)
+			final := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+			if err != nil && !final {
+				_ = stream.CloseSend(err)
+				return goerr.Wrap(err, "failed to read message")
+			}
+
+			chunk := flow.Chunk{Type: msgType, Data: bytes.Clone(buf[:n]), More: !final}
+			if err := stream.Send(ctx, chunk); err != nil {
+				return goerr.Wrap(err, "failed to send message")
+			}
+			if final {
+				break
+			}
+		}
+	}
+}
+
+// toConn reads chunks from stream and writes them to conn as messages until stream is ended.
+func toConn(conn *websocket.Conn, stream Stream) error {
+	var w io.WriteCloser
+	for {
+		chunk, err := stream.ReadChunk()
+		if err != nil {
+			if w != nil {
+				_ = w.Close()
+			}
+			_ = conn.WriteControl(websocket.CloseMessage, closeMessage(err), time.Now().Add(closeTimeout))
+			// Do not wait for the close reply from the peer forever
+			_ = conn.SetReadDeadline(time.Now().Add(closeTimeout))
+			return normalClose(err)
+		}
+
+		if w == nil {
+			if w, err = conn.NextWriter(chunk.Type); err != nil {
+				return goerr.Wrap(err, "failed to get message writer")
+			}
+		}
+		if _, err := w.Write(chunk.Data); err != nil {
+			return goerr.Wrap(err, "failed to write message")
+		}
+		if !chunk.More {
+			if err := w.Close(); err != nil {
+				return goerr.Wrap(err, "failed to write message")
+			}
+			w = nil
+		}
+	}
+}
+
+// closeMessage creates a close message to be forwarded from the reason of the end. Status codes that must not be sent in a close message are replaced with CloseGoingAway.
+func closeMessage(err error) []byte {
+	var closeErr *websocket.CloseError
+	switch {
+	case err == nil, errors.Is(err, io.EOF):
+		return websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	case errors.As(err, &closeErr) &&
+		closeErr.Code != websocket.CloseAbnormalClosure &&
+		closeErr.Code != websocket.CloseTLSHandshake:
+		return websocket.FormatCloseMessage(closeErr.Code, closeErr.Text)
+	default:
+		return websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+	}
+}
+
+// normalClose returns nil if err is an expected end of the connection.
+func normalClose(err error) error {
+	if err == nil || errors.Is(err, io.EOF) ||
+		websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,24 @@
+package urlutil
+
+import (
+	"net"
+	"strings"
+)
+
+// MatchPrefix returns true if path is prefix or under prefix, e.g. "/slack" matches "/slack" and "/slack/events" but not "/slacker".
+func MatchPrefix(path, prefix string) bool {
+	if prefix == "/" {
+		return true
+	}
+	rest, found := strings.CutPrefix(path, prefix)
+	return found && (rest == "" || rest[0] == '/')
+}
+
+// StripPort returns the host of hostport without the port. hostport is returned as it is if it has no port.
+func StripPort(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
@@ -0,0 +1,33 @@
+package urlutil_test
+
+import (
+	"testing"
+
+	"github.com/m-mizutani/backstream/pkg/utils/urlutil"
+	"github.com/m-mizutani/gt"
+)
+
+func TestMatchPrefix(t *testing.T) {
+	testCases := map[string]struct {
+		path   string
+		prefix string
+		expect bool
+	}{
+		"same":        {path: "/slack", prefix: "/slack", expect: true},
+		"under":       {path: "/slack/events", prefix: "/slack", expect: true},
+		"root":        {path: "/anything", prefix: "/", expect: true},
+		"not segment": {path: "/slacker", prefix: "/slack", expect: false},
+		"other":       {path: "/github", prefix: "/slack", expect: false},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			gt.V(t, urlutil.MatchPrefix(tc.path, tc.prefix)).Equal(tc.expect)
+		})
+	}
+}
+
+func TestStripPort(t *testing.T) {
+	gt.V(t, urlutil.StripPort("example.com:8080")).Equal("example.com")
+	gt.V(t, urlutil.StripPort("example.com")).Equal("example.com")
+	gt.V(t, urlutil.StripPort("[::1]:8080")).Equal("::1")
+}